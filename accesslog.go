@@ -0,0 +1,67 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp_server
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessEntry describes a completed command for an AccessLogger.
+type AccessEntry struct {
+	RemoteAddr string
+	User       string
+	Time       time.Time
+	Command    string
+	// the parameter of the command, passwords are masked
+	Param string
+	// the code of the last response sent for the command
+	Code int
+	// the number of bytes transferred over data streams
+	Bytes int64
+}
+
+// AccessLogger receives an entry for every command completed by the server.
+type AccessLogger interface {
+	LogAccess(entry AccessEntry)
+}
+
+// CLFAccessLogger writes access entries in the Common Log Format, one line
+// per command, e.g.
+//
+//	192.0.2.1:4242 - admin [02/Jan/2018:03:04:05 +0000] "RETR /file" 226 4
+type CLFAccessLogger struct {
+	Writer io.Writer
+	mutex  sync.Mutex
+}
+
+// NewCLFAccessLogger returns a CLFAccessLogger writing to writer.
+func NewCLFAccessLogger(writer io.Writer) *CLFAccessLogger {
+	return &CLFAccessLogger{Writer: writer}
+}
+
+// LogAccess writes entry as one line. Unknown users and commands without
+// data transfer are written as "-".
+func (logger *CLFAccessLogger) LogAccess(entry AccessEntry) {
+	user := entry.User
+	if user == "" {
+		user = "-"
+	}
+	bytes := "-"
+	if entry.Bytes > 0 {
+		bytes = strconv.FormatInt(entry.Bytes, 10)
+	}
+	request := entry.Command
+	if entry.Param != "" {
+		request += " " + entry.Param
+	}
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	fmt.Fprintf(logger.Writer, "%s - %s [%s] %q %d %s\n", entry.RemoteAddr, user,
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"), request, entry.Code, bytes)
+}
@@ -0,0 +1,36 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp_server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestCLFAccessLogger(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewCLFAccessLogger(&buffer)
+	logger.LogAccess(AccessEntry{
+		RemoteAddr: "192.0.2.1:4242",
+		User:       "admin",
+		Time:       time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+		Command:    "RETR",
+		Param:      "/file \"x\"",
+		Code:       226,
+		Bytes:      4,
+	})
+	logger.LogAccess(AccessEntry{
+		RemoteAddr: "192.0.2.1:4242",
+		Time:       time.Date(2018, 1, 2, 3, 4, 6, 0, time.FixedZone("", 3600)),
+		Command:    "NOOP",
+		Code:       200,
+	})
+	expected := "192.0.2.1:4242 - admin [02/Jan/2018:03:04:05 +0000] \"RETR /file \\\"x\\\"\" 226 4\n" +
+		"192.0.2.1:4242 - - [02/Jan/2018:03:04:06 +0100] \"NOOP\" 200 -\n"
+	if result := buffer.String(); result != expected {
+		t.Errorf("got %q, want %q", result, expected)
+	}
+}
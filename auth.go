@@ -4,19 +4,51 @@
 
 package ftp_server
 
+import (
+	"crypto/x509"
+	"fmt"
+)
+
 // Auth is an interface to auth your ftp user login.
 type Auth interface {
 	CheckPasswd(string, string) (bool, error)
 }
 
+// CertAuth is an optional interface an Auth can implement to log users in
+// by the certificate they presented to a TLS server requesting client
+// certificates. If it accepts the certificate for the name sent with USER,
+// the user is logged in without PASS. Otherwise the password is required
+// as usual.
+type CertAuth interface {
+	// params  - username, verified client certificate, e.g. to compare its
+	//           Subject.CommonName with the username
+	// returns - true if the certificate authenticates the user
+	CheckCert(string, *x509.Certificate) (bool, error)
+}
+
+// HomeDirAuth is an optional interface an Auth can implement to let users
+// start in their home directory instead of the root after logging in.
+type HomeDirAuth interface {
+	// params  - username
+	// returns - the initial working directory of the user, "" for the root
+	HomeDir(string) string
+}
+
 var (
-	_ Auth = &SimpleAuth{}
+	_ Auth        = &SimpleAuth{}
+	_ HomeDirAuth = &SimpleAuth{}
 )
 
 // SimpleAuth implements Auth interface to provide a memory user login auth
 type SimpleAuth struct {
 	Name     string
 	Password string
+	// MinPasswordLength is the minimum length in characters of a new
+	// password. 0 means no limit.
+	MinPasswordLength int
+	// Home is the initial working directory of the user. The root is used
+	// if it is empty.
+	Home string
 }
 
 // CheckPasswd will check user's password
@@ -26,3 +58,23 @@ func (a *SimpleAuth) CheckPasswd(name, pass string) (bool, error) {
 	}
 	return true, nil
 }
+
+// checkNewPassword returns an error if pass is not acceptable as a new
+// password of the user.
+func (a *SimpleAuth) checkNewPassword(pass string) error {
+	return checkPasswordLength(pass, a.MinPasswordLength)
+}
+
+// HomeDir returns Home for the user.
+func (a *SimpleAuth) HomeDir(name string) string {
+	return a.Home
+}
+
+// checkPasswordLength returns an error if pass has less than minLength
+// characters.
+func checkPasswordLength(pass string, minLength int) error {
+	if length := len([]rune(pass)); length < minLength {
+		return fmt.Errorf("Password too short, at least %d characters required", minLength)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp_server
+
+import "testing"
+
+func TestSimpleAuthMinPasswordLength(t *testing.T) {
+	auth := SimpleAuth{Name: "admin", Password: "secret", MinPasswordLength: 8}
+
+	if err := auth.checkNewPassword("short"); err == nil {
+		t.Error("too short password accepted")
+	}
+	if err := auth.checkNewPassword("äöüäöüä"); err == nil {
+		t.Error("password of 7 characters accepted")
+	}
+	if err := auth.checkNewPassword("long enough"); err != nil {
+		t.Errorf("acceptable password: got %v", err)
+	}
+	if err := auth.checkNewPassword("äöüäöüäö"); err != nil {
+		t.Errorf("password of 8 characters: got %v", err)
+	}
+
+	auth.MinPasswordLength = 0
+	if err := auth.checkNewPassword(""); err != nil {
+		t.Errorf("no limit: got %v", err)
+	}
+}
@@ -4,7 +4,21 @@
 
 package ftp_server
 
-import "io"
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrQuotaExceeded is returned by PutFile if the upload does not fit into
+// the quota of the user. The client gets 552 as response.
+var ErrQuotaExceeded = errors.New("Quota exceeded")
+
+// SizeUnknown is returned by GetFile instead of the number of bytes, if the
+// data is not known in advance, e.g. a report generated while it is sent.
+const SizeUnknown int64 = -1
 
 // DriverFactory is a driver factory to create driver. For each client that connects to the server, a new FTPDriver is required.
 // Create an implementation if this interface and provide it to FTPServer.
@@ -42,18 +56,158 @@ type Driver interface {
 	DeleteFile(string) error
 
 	// params  - from_path, to_path
-	// returns - nil if the file was renamed or any error encountered
+	// returns - nil if the file was renamed or any error encountered.
+	//           Errors for which os.IsExist, os.IsNotExist or
+	//           os.IsPermission hold are reported to the client as
+	//           "target exists", "source gone" and "permission denied".
+	//           The source must be left untouched if an error is returned.
 	Rename(string, string) error
 
 	// params  - path
 	// returns - nil if the new directory was created or any error encountered
 	MakeDir(string) error
 
-	// params  - path
-	// returns - a string containing the file data to send to the client
+	// params  - path, offset to start reading at
+	// returns - the number of bytes to send or SizeUnknown, a reader
+	//           containing the file data to send to the client and any
+	//           error encountered
 	GetFile(string, int64) (int64, io.ReadCloser, error)
 
 	// params  - destination path, an io.Reader containing the file data
 	// returns - the number of bytes writen and the first error encountered while writing, if any.
 	PutFile(string, io.Reader, bool) (int64, error)
 }
+
+// DiskUsageDriver is an optional interface a Driver can implement if it is
+// able to sum up the size of a directory tree more efficiently than the
+// server walking it with ListDir.
+type DiskUsageDriver interface {
+	// params  - path
+	// returns - the total size in bytes of all files below the path
+	DiskUsage(string) (int64, error)
+}
+
+// CommandLogger is an optional interface a Driver can implement to keep an
+// audit trail of all commands received, e.g. next to the stored data.
+type CommandLogger interface {
+	// params  - user, command, parameter with passwords masked, response code
+	LogCommand(string, string, string, int)
+}
+
+// SyncDriver is an optional interface a Driver can implement to flush
+// written data to stable storage on request of the client.
+type SyncDriver interface {
+	// params  - path
+	// returns - nil if the data of the file is on stable storage
+	Sync(string) error
+}
+
+// DownloadDriver is an optional interface a Driver can implement to open a
+// file for download and report its metadata in one call, instead of the
+// server calling Stat and GetFile separately.
+type DownloadDriver interface {
+	// params  - path, offset to start reading at
+	// returns - the file info of the path or nil if the size is not known
+	//           in advance, a reader starting at the offset and any error
+	//           encountered
+	OpenForDownload(string, int64) (FileInfo, io.ReadCloser, error)
+}
+
+// ResumeDriver is an optional interface a Driver can implement to continue
+// an interrupted upload at the offset given with REST. Without it the server
+// can only continue uploads at the end of the file, by appending to it.
+type ResumeDriver interface {
+	// params  - destination path, an io.Reader containing the file data,
+	//           offset to start writing at
+	// returns - the number of bytes written and the first error encountered
+	//           while writing, if any. The file ends after the written data,
+	//           a longer file is truncated.
+	PutFileFrom(string, io.Reader, int64) (int64, error)
+}
+
+// RealPathDriver is an optional interface a Driver can implement to let the
+// server verify, that a path does not leave the root of the driver through
+// a symlink. It is required by the ConfineToRoot server option.
+//
+// Without it the server only cleans the paths sent by the client, which
+// removes ".." but can not see symlinks. Keeping clients inside the root
+// then depends on the driver alone, e.g. on a storage without symlinks.
+type RealPathDriver interface {
+	// params  - path
+	// returns - the path with all symlinks resolved, relative to the root
+	//           of the driver and separated by slashes, e.g. "dir/file" or
+	//           "." for the root itself. Paths outside of the root start
+	//           with "../". An error for which os.IsNotExist holds if the
+	//           path does not exist.
+	RealPath(string) (string, error)
+}
+
+// BatchStatDriver is an optional interface a Driver can implement to fetch
+// the metadata of several paths in one call, e.g. to save round trips to a
+// backend with a high latency. Listings use it instead of calling Stat for
+// every path.
+type BatchStatDriver interface {
+	// params  - paths
+	// returns - one FileInfo per path in the same order, nil for paths
+	//           that do not exist. An error only if the batch as a whole
+	//           failed.
+	StatBatch([]string) ([]FileInfo, error)
+}
+
+// QuotaDriver is an optional interface a Driver can implement to report the
+// space left in the quota of the user, which is then included in the
+// response to uploads failing with ErrQuotaExceeded.
+type QuotaDriver interface {
+	// params  - path of the upload
+	// returns - the number of bytes that can still be stored
+	AvailableSpace(string) (int64, error)
+}
+
+// ModTimeDriver is an optional interface a Driver can implement to let
+// clients set the modification time of a file, e.g. to preserve it on
+// upload.
+type ModTimeDriver interface {
+	// params  - path, new modification time
+	// returns - nil if the time was set or any error encountered
+	SetModTime(string, time.Time) error
+}
+
+// ChecksumDriver is an optional interface a Driver can implement to compute
+// the checksums of the HASH command itself, e.g. from checksums it stores
+// anyway, instead of the server reading the file with GetFile.
+type ChecksumDriver interface {
+	// params  - path, algorithm ("SHA-256", "SHA-1", "CRC32" or "MD5"),
+	//           offset of the first byte and offset after the last byte
+	// returns - the checksum of the range and any error encountered
+	Checksum(string, string, int64, int64) ([]byte, error)
+}
+
+// ChmodDriver is an optional interface a Driver can implement to let clients
+// change the permissions of files and directories with SITE CHMOD. The
+// server also uses it to apply the umask set with SITE UMASK.
+type ChmodDriver interface {
+	// params  - path, new permission bits
+	// returns - nil if the permissions were changed or any error encountered
+	Chmod(string, os.FileMode) error
+}
+
+// ContextDriver is an optional interface a Driver can implement to abort
+// slow operations, e.g. requests to a network storage, when the client goes
+// away. The context passed is canceled when the control stream of the
+// command ends and, for transfers, when the client sends ABOR. The server
+// uses these methods instead of their counterparts of Driver for listings
+// and transfers. OpenForDownload of a DownloadDriver and PutFileFrom of a
+// ResumeDriver get no context, ABOR only resets their data stream.
+type ContextDriver interface {
+	// like Stat of Driver
+	StatContext(context.Context, string) (FileInfo, error)
+
+	// like ListDir of Driver
+	ListDirContext(context.Context, string, func(FileInfo) error) error
+
+	// like GetFile of Driver
+	GetFileContext(context.Context, string, int64) (int64, io.ReadCloser, error)
+
+	// like PutFile of Driver
+	PutFileContext(context.Context, string, io.Reader, bool) (int64, error)
+}
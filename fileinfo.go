@@ -4,7 +4,10 @@
 
 package ftp_server
 
-import "os"
+import (
+	"os"
+	"time"
+)
 
 type FileInfo interface {
 	os.FileInfo
@@ -12,3 +15,33 @@ type FileInfo interface {
 	Owner() string
 	Group() string
 }
+
+// UniqueFileInfo is an optional interface a FileInfo can implement to
+// report a token identifying the underlying file, like device and inode
+// number. All names of the same file, e.g. hardlinks, share the token.
+type UniqueFileInfo interface {
+	UniqueID() string
+}
+
+// CreationTimeFileInfo is an optional interface a FileInfo can implement to
+// report when the file was created, if the underlying storage records it.
+type CreationTimeFileInfo interface {
+	// returns - the creation time, the zero time if it is unknown
+	CreationTime() time.Time
+}
+
+// renamedFileInfo presents a FileInfo under another name.
+type renamedFileInfo struct {
+	FileInfo
+	name string
+}
+
+func (info renamedFileInfo) Name() string {
+	return info.name
+}
+
+// RenameFileInfo returns a FileInfo that reports name instead of the name
+// of info, like the "." and ".." entries of a listing.
+func RenameFileInfo(info FileInfo, name string) FileInfo {
+	return renamedFileInfo{info, name}
+}
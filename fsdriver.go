@@ -0,0 +1,159 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp_server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	_ Driver        = &fsDriver{}
+	_ DriverFactory = &FSDriverFactory{}
+)
+
+// ErrReadOnly is returned by the drivers of NewFSDriver for all operations
+// that would modify the file system.
+var ErrReadOnly = errors.New("Read-only file system")
+
+// fsDriver serves the files of an fs.FS, see NewFSDriver.
+type fsDriver struct {
+	fsys fs.FS
+}
+
+// NewFSDriver returns a read-only Driver serving the files of fsys, e.g. an
+// embed.FS or the files of a zip.Reader. The root of the FTP namespace is
+// the root of fsys.
+func NewFSDriver(fsys fs.FS) Driver {
+	return &fsDriver{fsys}
+}
+
+// FSDriverFactory creates a driver of NewFSDriver for FS for every client.
+type FSDriverFactory struct {
+	FS fs.FS
+}
+
+// NewDriver returns a driver serving FS
+func (f *FSDriverFactory) NewDriver() (Driver, error) {
+	return NewFSDriver(f.FS), nil
+}
+
+// fsName converts an absolute FTP path to a name valid in an fs.FS, which
+// has no leading slash and is "." for the root.
+func fsName(filePath string) string {
+	name := strings.TrimPrefix(path.Clean("/"+filePath), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// fsFileInfo is the FileInfo of a file of an fs.FS, which knows no owners.
+type fsFileInfo struct {
+	fs.FileInfo
+}
+
+func (f fsFileInfo) Owner() string { return "root" }
+func (f fsFileInfo) Group() string { return "root" }
+
+// Stat returns the file info of path
+func (d *fsDriver) Stat(filePath string) (FileInfo, error) {
+	info, err := fs.Stat(d.fsys, fsName(filePath))
+	if err != nil {
+		return nil, err
+	}
+	return fsFileInfo{info}, nil
+}
+
+// ChangeDir checks path is a directory
+func (d *fsDriver) ChangeDir(filePath string) error {
+	info, err := fs.Stat(d.fsys, fsName(filePath))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "chdir", Path: filePath, Err: errors.New("Not a directory")}
+	}
+	return nil
+}
+
+// ListDir lists the entries of path in the order of their names
+func (d *fsDriver) ListDir(filePath string, callback func(FileInfo) error) error {
+	entries, err := fs.ReadDir(d.fsys, fsName(filePath))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if err := callback(fsFileInfo{info}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteDir returns ErrReadOnly
+func (d *fsDriver) DeleteDir(filePath string) error {
+	return ErrReadOnly
+}
+
+// DeleteFile returns ErrReadOnly
+func (d *fsDriver) DeleteFile(filePath string) error {
+	return ErrReadOnly
+}
+
+// Rename returns ErrReadOnly
+func (d *fsDriver) Rename(fromPath string, toPath string) error {
+	return ErrReadOnly
+}
+
+// MakeDir returns ErrReadOnly
+func (d *fsDriver) MakeDir(filePath string) error {
+	return ErrReadOnly
+}
+
+// GetFile reads path from offset on. Files implementing io.Seeker are
+// positioned directly, others are read up to the offset.
+func (d *fsDriver) GetFile(filePath string, offset int64) (int64, io.ReadCloser, error) {
+	file, err := d.fsys.Open(fsName(filePath))
+	if err != nil {
+		return 0, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return 0, nil, &os.PathError{Op: "open", Path: filePath, Err: errors.New("Is a directory")}
+	}
+	if offset > info.Size() {
+		offset = info.Size()
+	}
+	if seeker, ok := file.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, file, offset)
+	}
+	if err != nil {
+		file.Close()
+		return 0, nil, err
+	}
+	return info.Size() - offset, file, nil
+}
+
+// PutFile returns ErrReadOnly
+func (d *fsDriver) PutFile(filePath string, data io.Reader, appendData bool) (int64, error) {
+	return 0, ErrReadOnly
+}
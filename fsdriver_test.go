@@ -0,0 +1,101 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp_server
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// unseekableFS hides the Seek method of the files of an fs.FS.
+type unseekableFS struct {
+	fs.FS
+}
+
+func (u unseekableFS) Open(name string) (fs.File, error) {
+	file, err := u.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		fs.File
+	}{file}, nil
+}
+
+func TestFSDriver(t *testing.T) {
+	fsys := fstest.MapFS{
+		"readme.txt":   {Data: []byte("hello world")},
+		"docs/a.txt":   {Data: []byte("a")},
+		"docs/b.txt":   {Data: []byte("bb")},
+		"docs/sub/c.t": {Data: []byte("c")},
+	}
+	driver, err := (&FSDriverFactory{FS: fsys}).NewDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := driver.Stat("/")
+	if err != nil || !info.IsDir() {
+		t.Errorf("Stat of the root: %v, %v", info, err)
+	}
+	if info, err := driver.Stat("/docs/b.txt"); err != nil || info.Size() != 2 || info.Owner() != "root" {
+		t.Errorf("Stat of a file: %v, %v", info, err)
+	}
+	if _, err := driver.Stat("/missing"); !os.IsNotExist(err) {
+		t.Errorf("Stat of a missing file: %v", err)
+	}
+	if err := driver.ChangeDir("/docs/sub"); err != nil {
+		t.Errorf("ChangeDir: %v", err)
+	}
+	if err := driver.ChangeDir("/readme.txt"); err == nil {
+		t.Error("ChangeDir to a file")
+	}
+
+	var names []string
+	err = driver.ListDir("/docs", func(info FileInfo) error {
+		names = append(names, info.Name())
+		return nil
+	})
+	if err != nil || strings.Join(names, ",") != "a.txt,b.txt,sub" {
+		t.Errorf("ListDir: %v, %v", names, err)
+	}
+
+	if _, err := driver.PutFile("/new", strings.NewReader("data"), false); err != ErrReadOnly {
+		t.Errorf("PutFile: %v", err)
+	}
+	if err := driver.MakeDir("/new"); err != ErrReadOnly {
+		t.Errorf("MakeDir: %v", err)
+	}
+	if err := driver.DeleteFile("/readme.txt"); err != ErrReadOnly {
+		t.Errorf("DeleteFile: %v", err)
+	}
+	if _, _, err := driver.GetFile("/docs", 0); err == nil {
+		t.Error("GetFile of a directory")
+	}
+}
+
+func TestFSDriverGetFile(t *testing.T) {
+	fsys := fstest.MapFS{"readme.txt": {Data: []byte("hello world")}}
+	for _, driver := range []Driver{NewFSDriver(fsys), NewFSDriver(unseekableFS{fsys})} {
+		for _, c := range []struct {
+			offset int64
+			data   string
+		}{{0, "hello world"}, {6, "world"}, {20, ""}} {
+			size, reader, err := driver.GetFile("/readme.txt", c.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil || string(data) != c.data || size != int64(len(c.data)) {
+				t.Errorf("offset %d: got %q of %d bytes, %v", c.offset, data, size, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"context"
+	"github.com/lucas-clemente/quic-go"
+	"strings"
+)
+
+// ErrorCodeTransferAborted is the QUIC application error code data streams
+// are reset with, if the client aborts the transfer with ABOR. It matches
+// the FTP reply code 426.
+const ErrorCodeTransferAborted quic.ErrorCode = 426
+
+// telnetAbortPrefix are the Telnet IP and Synch sequences some clients send
+// in front of ABOR (RFC 959, section 4.1.3).
+const telnetAbortPrefix = "\xff\xf4\xff\xf2"
+
+// isAbort reports whether line is an ABOR command.
+func isAbort(line string) bool {
+	line = strings.TrimLeft(line, telnetAbortPrefix)
+	return strings.ToUpper(strings.TrimSpace(line)) == "ABOR"
+}
+
+// beginTransfer returns the context of a new transfer, which is canceled
+// by ABOR and when the control stream ends. cancelStream is called on abort
+// as well, to interrupt reads or writes blocked on the data stream. The
+// returned function has to be called when the transfer is finished.
+func (subConn *SubConn) beginTransfer(cancelStream func()) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(subConn.ctx)
+	subConn.transferMutex.Lock()
+	subConn.transferCancel = func() {
+		cancel()
+		cancelStream()
+	}
+	subConn.transferMutex.Unlock()
+	return ctx, func() {
+		subConn.transferMutex.Lock()
+		subConn.transferCancel = nil
+		subConn.transferMutex.Unlock()
+		cancel()
+	}
+}
+
+// abortTransfer cancels the running transfer, if there is one. It is called
+// by the goroutine reading the control stream as soon as ABOR arrives,
+// while the transfer still blocks the execution of further commands.
+func (subConn *SubConn) abortTransfer() {
+	subConn.transferMutex.Lock()
+	defer subConn.transferMutex.Unlock()
+	if subConn.transferCancel != nil {
+		subConn.transferCancel()
+		subConn.transferCancel = nil
+	}
+}
+
+// commandAbor responds to the ABOR FTP command. The transfer itself is
+// already canceled when the command is read, it replies 426, so only the
+// confirmation is left to send.
+type commandAbor struct{}
+
+func (cmd commandAbor) IsExtend() bool {
+	return false
+}
+
+func (cmd commandAbor) RequireParam() bool {
+	return false
+}
+
+func (cmd commandAbor) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandAbor) Execute(subConn *SubConn, param string) {
+	subConn.writeMessage(226, "Abort successful")
+}
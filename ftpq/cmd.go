@@ -5,10 +5,16 @@
 package ftpq
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	server "github.com/attenberger/ftps_qftp-server"
 	"github.com/lucas-clemente/quic-go"
+	"io"
 	"log"
+	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -25,30 +31,40 @@ type commandMap map[string]Command
 
 var (
 	commands = commandMap{
+		"ABOR":  commandAbor{},
 		"ALLO":  commandAllo{},
 		"APPE":  commandAppe{},
 		"CDUP":  commandCdup{},
 		"CWD":   commandCwd{},
 		"DELE":  commandDele{},
 		"FEAT":  commandFeat{},
+		"HASH":  commandHash{},
 		"HELLO": commandHello{},
+		"HELP":  commandHelp{},
 		"LIST":  commandList{},
 		"NLST":  commandNlst{},
 		"MDTM":  commandMdtm{},
+		"MFMT":  commandMfmt{},
 		"MKD":   commandMkd{},
+		"MLSD":  commandMlsd{},
+		"MLST":  commandMlst{},
 		"MODE":  commandMode{},
 		"NOOP":  commandNoop{},
 		"OPTS":  commandOpts{},
 		"PASS":  commandPass{},
 		"PWD":   commandPwd{},
 		"QUIT":  commandQuit{},
+		"REIN":  commandRein{},
 		"RETR":  commandRetr{},
 		"REST":  commandRest{},
 		"RNFR":  commandRnfr{},
 		"RNTO":  commandRnto{},
 		"RMD":   commandRmd{},
+		"SITE":  commandSite{},
 		"SIZE":  commandSize{},
+		"STAT":  commandStat{},
 		"STOR":  commandStor{},
+		"STOU":  commandStou{},
 		"STRU":  commandStru{},
 		"SYST":  commandSyst{},
 		"TYPE":  commandType{},
@@ -60,6 +76,34 @@ var (
 	}
 )
 
+// transferCommands are limited by
+// ServerOpts.MaxConcurrentTransfersPerSession.
+var transferCommands = map[string]bool{
+	"APPE": true,
+	"RETR": true,
+	"STOR": true,
+	"STOU": true,
+}
+
+// busyCommands are refused while the server is overloaded, see
+// ServerOpts.BusyDataStreamThreshold.
+var busyCommands = map[string]bool{
+	"APPE": true,
+	"DELE": true,
+	"HASH": true,
+	"LIST": true,
+	"MFMT": true,
+	"MKD":  true,
+	"MLSD": true,
+	"NLST": true,
+	"RETR": true,
+	"RMD":  true,
+	"RNTO": true,
+	"STOR": true,
+	"STOU": true,
+	"XRMD": true,
+}
+
 // commandAllo responds to the ALLO FTP command.
 //
 // This is essentially a ping from the client so we just respond with an
@@ -82,6 +126,8 @@ func (cmd commandAllo) Execute(subConn *SubConn, param string) {
 	subConn.writeMessage(202, "Obsolete")
 }
 
+// commandAppe responds to the APPE FTP command. It works like STOR, but
+// appends the data to the file if it already exists.
 type commandAppe struct{}
 
 func (cmd commandAppe) IsExtend() bool {
@@ -89,7 +135,7 @@ func (cmd commandAppe) IsExtend() bool {
 }
 
 func (cmd commandAppe) RequireParam() bool {
-	return false
+	return true
 }
 
 func (cmd commandAppe) RequireAuth() bool {
@@ -97,8 +143,7 @@ func (cmd commandAppe) RequireAuth() bool {
 }
 
 func (cmd commandAppe) Execute(subConn *SubConn, param string) {
-	subConn.appendData = true
-	subConn.writeMessage(202, "Obsolete")
+	subConn.storeFile(param, true)
 }
 
 type commandOpts struct{}
@@ -117,19 +162,41 @@ func (cmd commandOpts) RequireAuth() bool {
 
 func (cmd commandOpts) Execute(subConn *SubConn, param string) {
 	parts := strings.Fields(param)
-	if len(parts) != 2 {
+	if len(parts) == 0 {
 		subConn.writeMessage(550, "Unknow params")
 		return
 	}
-	if strings.ToUpper(parts[0]) != "UTF8" {
+	switch strings.ToUpper(parts[0]) {
+	case "UTF8":
+		if len(parts) != 2 {
+			subConn.writeMessage(550, "Unknow params")
+		} else if strings.ToUpper(parts[1]) == "ON" {
+			subConn.writeMessage(200, "UTF8 mode enabled")
+		} else {
+			subConn.writeMessage(550, "Unsupported non-utf8 mode")
+		}
+	case "MLST":
+		var facts []string
+		if len(parts) == 2 {
+			facts = parseMlstFacts(parts[1])
+		}
+		subConn.mlstFacts = facts
+		reply := "MLST OPTS "
+		for _, fact := range facts {
+			reply += fact + ";"
+		}
+		subConn.writeMessage(200, strings.TrimSpace(reply))
+	case "HASH":
+		if len(parts) == 1 {
+			subConn.writeMessage(200, subConn.hashAlgorithm)
+		} else if algorithm, ok := findHashAlgorithm(parts[1]); ok {
+			subConn.hashAlgorithm = algorithm.name
+			subConn.writeMessage(200, algorithm.name)
+		} else {
+			subConn.writeMessage(501, "Unknown algorithm, current selection not changed")
+		}
+	default:
 		subConn.writeMessage(550, "Unknow params")
-		return
-	}
-
-	if strings.ToUpper(parts[1]) == "ON" {
-		subConn.writeMessage(200, "UTF8 mode enabled")
-	} else {
-		subConn.writeMessage(550, "Unsupported non-utf8 mode")
 	}
 }
 
@@ -148,20 +215,39 @@ func (cmd commandFeat) RequireAuth() bool {
 }
 
 var (
-	feats    = "Extensions supported:\n%s"
-	featCmds = " UTF8\n"
+	feats = "Features:\n%sEnd"
 )
 
-func init() {
-	for k, v := range commands {
+// featCmds returns the static FEAT lines, UTF8 and the extended commands
+// of cmds.
+func featCmds(cmds commandMap) string {
+	var extended []string
+	for k, v := range cmds {
 		if v.IsExtend() {
-			featCmds = featCmds + " " + k + "\n"
+			extended = append(extended, k)
 		}
 	}
+	sort.Strings(extended)
+	features := " UTF8\n"
+	for _, k := range extended {
+		features = features + " " + k + "\n"
+	}
+	return features
 }
 
 func (cmd commandFeat) Execute(subConn *SubConn, param string) {
-	subConn.writeMessageMultiline(211, subConn.connection.server.feats)
+	features := subConn.connection.server.featCmds
+	cmds := subConn.connection.server.commands
+	if _, ok := cmds["HASH"]; ok {
+		features += " " + hashFeat(subConn.hashAlgorithm) + "\n"
+	}
+	if _, ok := cmds["MLST"]; ok {
+		features += " " + mlstFeat(subConn.mlstFacts) + "\n"
+	}
+	if _, ok := cmds["SITE"]; ok && len(subConn.connection.server.siteCommands) > 0 {
+		features += " " + siteFeat(subConn.connection.server.siteCommands) + "\n"
+	}
+	subConn.writeMessageMultiline(211, fmt.Sprintf(feats, features))
 }
 
 // cmdCdup responds to the CDUP FTP command.
@@ -187,7 +273,7 @@ func (cmd commandCdup) Execute(subConn *SubConn, param string) {
 }
 
 // commandCwd responds to the CWD FTP command. It allows the client to change the
-// current working directory.
+// current working directory. A trailing slash in the path is accepted.
 type commandCwd struct{}
 
 func (cmd commandCwd) IsExtend() bool {
@@ -209,7 +295,7 @@ func (cmd commandCwd) Execute(subConn *SubConn, param string) {
 		subConn.namePrefix = path
 		subConn.writeMessage(250, "Directory changed to "+path)
 	} else {
-		subConn.writeMessage(550, fmt.Sprint("Directory change to ", path, " failed: ", err))
+		subConn.writeError(550, fmt.Sprint("Directory change to ", path, " failed: ", err), err)
 	}
 }
 
@@ -235,7 +321,7 @@ func (cmd commandDele) Execute(subConn *SubConn, param string) {
 	if err == nil {
 		subConn.writeMessage(250, "File deleted")
 	} else {
-		subConn.writeMessage(550, fmt.Sprint("File delete failed: ", err))
+		subConn.writeError(550, fmt.Sprint("File delete failed: ", err), err)
 	}
 }
 
@@ -276,37 +362,156 @@ func (cmd commandList) RequireAuth() bool {
 }
 
 func (cmd commandList) Execute(subConn *SubConn, param string) {
+	if !subConn.allowListing() {
+		return
+	}
+	streamID, hasStreamID, param := subConn.splitListStreamID(param)
 	path := subConn.buildPath(parseListParam(param))
-	info, err := subConn.driver.Stat(path)
+	info, parentInfo, err := subConn.statListing(path)
 	if err != nil {
-		subConn.writeMessage(550, err.Error())
+		subConn.writeError(550, err.Error(), err)
 		return
 	}
 
 	if info == nil {
-		subConn.logger.Printf(subConn.sessionID+":"+strconv.FormatUint(uint64(subConn.controlStream.StreamID()), 10), "%s: no such file or directory.\n", path)
+		subConn.log(levelWarn, fmt.Sprintf("%s: no such file or directory.\n", path), "path", path)
 		return
 	}
 	var files []server.FileInfo
 	if info.IsDir() {
-		err = subConn.driver.ListDir(path, func(f server.FileInfo) error {
+		if subConn.connection.server.IncludeDotEntries {
+			files = dotEntries(info, parentInfo)
+		}
+		err = subConn.listDir(path, func(f server.FileInfo) error {
 			files = append(files, f)
 			return nil
 		})
 		if err != nil {
-			subConn.writeMessage(550, err.Error())
+			subConn.writeError(550, err.Error(), err)
 			return
 		}
 	} else {
 		files = append(files, info)
 	}
-	stream, err := subConn.connection.getNewSendDataStream()
+	stream, err := subConn.openListStream(streamID, hasStreamID)
 	if err != nil {
 		subConn.writeMessage(425, "Can't open data stream.")
 		return
 	}
-	subConn.writeMessage(150, fmt.Sprintf("%d Opening ASCII mode data connection for file list", stream.StreamID()))
-	subConn.sendOutofbandData(server.ListFormatter(files).Detailed(), stream)
+	if _, err := subConn.writeMessage(150, fmt.Sprintf("%d Opening ASCII mode data connection for file list", stream.StreamID())); err != nil {
+		stream.Close()
+		return
+	}
+	subConn.sendListing(subConn.listFormatter(files).Detailed(), stream)
+}
+
+// dotEntries returns the "." and ".." entries for a directory whose FileInfo
+// is info. The ".." entry is left out if parentInfo is nil.
+func dotEntries(info server.FileInfo, parentInfo server.FileInfo) []server.FileInfo {
+	files := []server.FileInfo{server.RenameFileInfo(info, ".")}
+	if parentInfo != nil {
+		files = append(files, server.RenameFileInfo(parentInfo, ".."))
+	}
+	return files
+}
+
+// allowListing reports whether another listing is within the
+// MaxListsPerMinute of the server and, if so, counts it. Otherwise the
+// client is told to slow down.
+func (subConn *SubConn) allowListing() bool {
+	max := subConn.connection.server.MaxListsPerMinute
+	if max <= 0 {
+		return true
+	}
+	now := time.Now()
+	recent := subConn.listTimes[:0]
+	for _, listTime := range subConn.listTimes {
+		if now.Sub(listTime) < time.Minute {
+			recent = append(recent, listTime)
+		}
+	}
+	subConn.listTimes = recent
+	if len(recent) >= max {
+		subConn.writeMessage(450, "Too many listings, slow down")
+		return false
+	}
+	subConn.listTimes = append(recent, now)
+	return true
+}
+
+// statListing returns the FileInfo of the path to list and, if dot entries
+// are included, of its parent directory. Both are fetched in one batch. The
+// parent FileInfo is nil, if it can not be fetched.
+func (subConn *SubConn) statListing(dir string) (info server.FileInfo, parentInfo server.FileInfo, err error) {
+	if !subConn.connection.server.IncludeDotEntries {
+		info, err = statContext(subConn.ctx, subConn.driver, dir)
+		return info, nil, err
+	}
+	infos, err := statBatch(subConn.driver, []string{dir, path.Dir(dir)})
+	if err != nil {
+		// The ".." entry is left out, if the parent directory can not be
+		// read. Whether the directory itself can be listed is up to its Stat.
+		info, err = statContext(subConn.ctx, subConn.driver, dir)
+		return info, nil, err
+	}
+	if infos[0] == nil {
+		return nil, nil, os.ErrNotExist
+	}
+	return infos[0], infos[1], nil
+}
+
+// statBatch returns the FileInfos of paths with the drivers StatBatch or,
+// if it does not implement server.BatchStatDriver, with one Stat per path.
+// Paths that do not exist get a nil FileInfo.
+func statBatch(driver server.Driver, paths []string) ([]server.FileInfo, error) {
+	if batchDriver, ok := unwrapDriver(driver).(server.BatchStatDriver); ok {
+		for _, filePath := range paths {
+			if err := checkPath(driver, filePath); err != nil {
+				return nil, err
+			}
+		}
+		infos, err := batchDriver.StatBatch(paths)
+		if err == nil && len(infos) != len(paths) {
+			err = errors.New("Driver returned wrong number of file infos")
+		}
+		return infos, err
+	}
+	infos := make([]server.FileInfo, len(paths))
+	for i, filePath := range paths {
+		info, err := driver.Stat(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		infos[i] = info
+	}
+	return infos, nil
+}
+
+// splitListStreamID separates the ID of a bidirectional stream opened by
+// the client from the parameter of LIST and NLST, like "4 -l /dir". It is
+// only looked for with the ClientListStreams option.
+func (subConn *SubConn) splitListStreamID(param string) (quic.StreamID, bool, string) {
+	if !subConn.connection.server.ClientListStreams {
+		return 0, false, param
+	}
+	params := strings.SplitN(param, " ", 2)
+	streamID, ok := parseClientBidiStreamID(params[0])
+	if !ok {
+		return 0, false, param
+	}
+	if len(params) == 1 {
+		return streamID, true, ""
+	}
+	return streamID, true, strings.TrimSpace(params[1])
+}
+
+// openListStream returns the stream for the output of LIST and NLST, the
+// stream opened by the client if hasStreamID is set, otherwise a new one.
+func (subConn *SubConn) openListStream(streamID quic.StreamID, hasStreamID bool) (quic.SendStream, error) {
+	if hasStreamID {
+		return subConn.connection.getClientSendDataStream(streamID)
+	}
+	return subConn.connection.getNewSendDataStream()
 }
 
 func parseListParam(param string) (path string) {
@@ -326,6 +531,20 @@ func parseListParam(param string) (path string) {
 	return path
 }
 
+// hasListFlag reports whether one of the leading options of a LIST or NLST
+// parameter, like "-la", contains the flag.
+func hasListFlag(param string, flag rune) bool {
+	for _, field := range strings.Fields(param) {
+		if !strings.HasPrefix(field, "-") {
+			break
+		}
+		if strings.ContainsRune(field[1:], flag) {
+			return true
+		}
+	}
+	return false
+}
+
 // commandNlst responds to the NLST FTP command. It allows the client to
 // retreive a list of filenames in the current directory.
 type commandNlst struct{}
@@ -343,10 +562,14 @@ func (cmd commandNlst) RequireAuth() bool {
 }
 
 func (cmd commandNlst) Execute(subConn *SubConn, param string) {
+	if !subConn.allowListing() {
+		return
+	}
+	streamID, hasStreamID, param := subConn.splitListStreamID(param)
 	path := subConn.buildPath(parseListParam(param))
-	info, err := subConn.driver.Stat(path)
+	info, err := statContext(subConn.ctx, subConn.driver, path)
 	if err != nil {
-		subConn.writeMessage(550, err.Error())
+		subConn.writeError(550, err.Error(), err)
 		return
 	}
 	if !info.IsDir() {
@@ -355,25 +578,34 @@ func (cmd commandNlst) Execute(subConn *SubConn, param string) {
 	}
 
 	var files []server.FileInfo
-	err = subConn.driver.ListDir(path, func(f server.FileInfo) error {
+	err = subConn.listDir(path, func(f server.FileInfo) error {
 		files = append(files, f)
 		return nil
 	})
 	if err != nil {
-		subConn.writeMessage(550, err.Error())
+		subConn.writeError(550, err.Error(), err)
 		return
 	}
-	stream, err := subConn.connection.getNewSendDataStream()
+	stream, err := subConn.openListStream(streamID, hasStreamID)
 	if err != nil {
 		subConn.writeMessage(425, "Can't open data stream.")
 		return
 	}
-	subConn.writeMessage(150, fmt.Sprintf("%d Opening ASCII mode data connection for file list", stream.StreamID()))
-	subConn.sendOutofbandData(server.ListFormatter(files).Short(), stream)
+	if _, err := subConn.writeMessage(150, fmt.Sprintf("%d Opening ASCII mode data connection for file list", stream.StreamID())); err != nil {
+		stream.Close()
+		return
+	}
+	if hasListFlag(param, 'l') {
+		subConn.sendListing(subConn.listFormatter(files).Detailed(), stream)
+	} else {
+		subConn.sendListing(subConn.listFormatter(files).Short(), stream)
+	}
 }
 
 // commandMdtm responds to the MDTM FTP command. It allows the client to
-// retreive the last modified time of a file.
+// retreive the last modified time of a file. With a timestamp in front of
+// the path, like "MDTM 20180102030405 file", it sets the time instead, if
+// the driver implements server.ModTimeDriver.
 type commandMdtm struct{}
 
 func (cmd commandMdtm) IsExtend() bool {
@@ -389,6 +621,15 @@ func (cmd commandMdtm) RequireAuth() bool {
 }
 
 func (cmd commandMdtm) Execute(subConn *SubConn, param string) {
+	if params := strings.SplitN(param, " ", 2); len(params) == 2 {
+		if modTime, ok := parseModTime(params[0]); ok {
+			path := subConn.buildPath(params[1])
+			if subConn.setModTime(path, modTime) {
+				subConn.writeMessage(213, "Modification time set to "+params[0])
+			}
+			return
+		}
+	}
 	path := subConn.buildPath(param)
 	stat, err := subConn.driver.Stat(path)
 	if err == nil {
@@ -398,6 +639,187 @@ func (cmd commandMdtm) Execute(subConn *SubConn, param string) {
 	}
 }
 
+// parseModTime parses a timestamp of MDTM and MFMT in the format
+// YYYYMMDDHHMMSS, which is always UTC.
+func parseModTime(timestamp string) (time.Time, bool) {
+	if len(timestamp) != 14 || strings.Trim(timestamp, "0123456789") != "" {
+		return time.Time{}, false
+	}
+	modTime, err := time.ParseInLocation("20060102150405", timestamp, time.UTC)
+	return modTime, err == nil
+}
+
+// setModTime sets the modification time of path with the driver. It
+// reports false after sending an error response.
+func (subConn *SubConn) setModTime(path string, modTime time.Time) bool {
+	modTimeDriver, ok := unwrapDriver(subConn.driver).(server.ModTimeDriver)
+	if !ok {
+		subConn.writeMessage(502, "Setting the modification time is not supported")
+		return false
+	}
+	err := checkPath(subConn.driver, path)
+	if err == nil {
+		err = modTimeDriver.SetModTime(path, modTime)
+	}
+	if err != nil {
+		subConn.writeError(550, fmt.Sprint("Could not set modification time: ", err), err)
+		return false
+	}
+	return true
+}
+
+// commandMfmt responds to the MFMT FTP command
+// (draft-somers-ftp-mfxx). It sets the last modified time of a file, like
+// "MFMT 20180102030405 file".
+type commandMfmt struct{}
+
+func (cmd commandMfmt) IsExtend() bool {
+	return true
+}
+
+func (cmd commandMfmt) RequireParam() bool {
+	return true
+}
+
+func (cmd commandMfmt) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMfmt) Execute(subConn *SubConn, param string) {
+	params := strings.SplitN(param, " ", 2)
+	if len(params) != 2 {
+		subConn.writeMessage(501, "Timestamp and path seperated by a blank needed.")
+		return
+	}
+	modTime, ok := parseModTime(params[0])
+	if !ok {
+		subConn.writeMessage(501, "Timestamp not in the format YYYYMMDDHHMMSS")
+		return
+	}
+	if subConn.setModTime(subConn.buildPath(params[1]), modTime) {
+		subConn.writeMessage(213, "Modify="+params[0]+"; "+params[1])
+	}
+}
+
+// commandMlsd responds to the MLSD FTP command. It allows the client to
+// retreive a machine readable listing of a directory (RFC 3659).
+type commandMlsd struct{}
+
+func (cmd commandMlsd) IsExtend() bool {
+	return false
+}
+
+func (cmd commandMlsd) RequireParam() bool {
+	return false
+}
+
+func (cmd commandMlsd) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMlsd) Execute(subConn *SubConn, param string) {
+	if !subConn.allowListing() {
+		return
+	}
+	path := subConn.buildPath(param)
+	info, parentInfo, err := subConn.statListing(path)
+	if err != nil {
+		subConn.writeError(550, err.Error(), err)
+		return
+	}
+	if !info.IsDir() {
+		subConn.writeMessage(501, param+" is not a directory")
+		return
+	}
+
+	var files []server.FileInfo
+	if subConn.connection.server.IncludeDotEntries {
+		files = dotEntries(info, parentInfo)
+	}
+	err = subConn.listDir(path, func(f server.FileInfo) error {
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		subConn.writeError(550, err.Error(), err)
+		return
+	}
+	stream, err := subConn.connection.getNewSendDataStream()
+	if err != nil {
+		subConn.writeMessage(425, "Can't open data stream.")
+		return
+	}
+	if _, err := subConn.writeMessage(150, fmt.Sprintf("%d Opening ASCII mode data connection for file list", stream.StreamID())); err != nil {
+		stream.Close()
+		return
+	}
+	subConn.sendListing(subConn.listFormatter(files).MachineSelected(subConn.mlstFacts), stream)
+}
+
+// defaultMlstFacts are the facts sent by MLSD and MLST until the client
+// selects others with OPTS MLST.
+var defaultMlstFacts = []string{"type", "size", "modify"}
+
+// parseMlstFacts returns the supported facts of a list like "type;size;"
+// in lower case. Unknown facts are dropped.
+func parseMlstFacts(list string) []string {
+	facts := []string{}
+	for _, fact := range strings.Split(list, ";") {
+		fact = strings.ToLower(fact)
+		for _, name := range server.MachineFactNames {
+			if fact == name {
+				facts = append(facts, fact)
+				break
+			}
+		}
+	}
+	return facts
+}
+
+// mlstFeat returns the FEAT line of MLST listing all supported facts, the
+// selected ones marked with an asterisk.
+func mlstFeat(selected []string) string {
+	line := "MLST "
+	for _, name := range server.MachineFactNames {
+		line += name
+		for _, fact := range selected {
+			if fact == name {
+				line += "*"
+				break
+			}
+		}
+		line += ";"
+	}
+	return line
+}
+
+// commandMlst responds to the MLST FTP command. It sends the facts of a
+// single file or directory on the control stream (RFC 3659).
+type commandMlst struct{}
+
+func (cmd commandMlst) IsExtend() bool {
+	return false
+}
+
+func (cmd commandMlst) RequireParam() bool {
+	return false
+}
+
+func (cmd commandMlst) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMlst) Execute(subConn *SubConn, param string) {
+	path := subConn.buildPath(param)
+	info, err := subConn.driver.Stat(path)
+	if err != nil {
+		subConn.writeError(550, fmt.Sprint("File not available: ", err), err)
+		return
+	}
+	facts := server.SelectedMachineFacts(info, subConn.mlstFacts)
+	subConn.writeMessageMultiline(250, "Listing "+path+"\n "+facts+" "+path+"\nEnd")
+}
+
 // commandMkd responds to the MKD FTP command. It allows the client to create
 // a new directory
 type commandMkd struct{}
@@ -418,9 +840,10 @@ func (cmd commandMkd) Execute(subConn *SubConn, param string) {
 	path := subConn.buildPath(param)
 	err := subConn.driver.MakeDir(path)
 	if err == nil {
-		subConn.writeMessage(257, "Directory created")
+		subConn.applyUmask(path, 0777)
+		subConn.writeMessage(257, quotePath(path)+" created")
 	} else {
-		subConn.writeMessage(550, fmt.Sprint("Action not taken: ", err))
+		subConn.writeError(550, fmt.Sprint("Action not taken: ", err), err)
 	}
 }
 
@@ -475,7 +898,8 @@ func (cmd commandNoop) Execute(subConn *SubConn, param string) {
 }
 
 // commandPass respond to the PASS FTP command by asking the driver if the
-// supplied username and password are valid
+// supplied username and password are valid. Users start in the directory
+// returned by a server.HomeDirAuth, if the Auth implements it.
 type commandPass struct{}
 
 func (cmd commandPass) IsExtend() bool {
@@ -491,7 +915,10 @@ func (cmd commandPass) RequireAuth() bool {
 }
 
 func (cmd commandPass) Execute(subConn *SubConn, param string) {
+	start := time.Now()
 	ok, err := subConn.connection.server.Auth.CheckPasswd(subConn.reqUser, param)
+	subConn.padAuthResponse(start)
+	subConn.observeAuth(subConn.reqUser, ok && err == nil)
 	if err != nil {
 		subConn.writeMessage(550, "Checking password error")
 		return
@@ -500,6 +927,12 @@ func (cmd commandPass) Execute(subConn *SubConn, param string) {
 	if ok {
 		subConn.user = subConn.reqUser
 		subConn.reqUser = ""
+		if homeDirAuth, ok := subConn.connection.server.Auth.(server.HomeDirAuth); ok {
+			if home := homeDirAuth.HomeDir(subConn.user); home != "" {
+				subConn.namePrefix = path.Clean("/" + home)
+			}
+		}
+		subConn.emitEvent(EventLogin, "", "")
 		subConn.writeMessage(230, "Password ok, continue")
 	} else {
 		subConn.writeMessage(530, "Incorrect password, not logged in")
@@ -524,7 +957,13 @@ func (cmd commandPwd) RequireAuth() bool {
 }
 
 func (cmd commandPwd) Execute(subConn *SubConn, param string) {
-	subConn.writeMessage(257, "\""+subConn.namePrefix+"\" is the current directory")
+	subConn.writeMessage(257, quotePath(subConn.namePrefix)+" is the current directory")
+}
+
+// quotePath encloses a path in double quotes for a 257 reply. Quotes within
+// the path are doubled (RFC 959, appendix II).
+func quotePath(path string) string {
+	return "\"" + strings.Replace(path, "\"", "\"\"", -1) + "\""
 }
 
 // CommandQuit responds to the QUIT FTP command. The client has requested the
@@ -545,8 +984,10 @@ func (cmd commandQuit) RequireAuth() bool {
 
 func (cmd commandQuit) Execute(subConn *SubConn, param string) {
 	subConn.writeMessage(221, "Goodbye")
+	// readLines is still reading the control stream to get EOF, which
+	// clears the quic-go stream number flow control. The deadline lets it
+	// give up, if the client does not close its side right away.
 	subConn.controlStream.SetReadDeadline(time.Now())
-	subConn.controlReader.ReadLine() // get EOF to clear quic-go streamnumberflowcontrol
 	subConn.Close()
 	subConn.connection.ReportSubConnFinsihed()
 }
@@ -568,12 +1009,27 @@ func (cmd commandRetr) RequireAuth() bool {
 }
 
 func (cmd commandRetr) Execute(subConn *SubConn, param string) {
+	if isDirectoryPath(param) {
+		subConn.writeMessage(550, "Is a directory")
+		return
+	}
 	path := subConn.buildPath(param)
 	defer func() {
 		subConn.lastFilePos = 0
 		subConn.appendData = false
 	}()
-	bytes, data, err := subConn.driver.GetFile(path, subConn.lastFilePos)
+	// ABOR is able to cancel opening the file already.
+	ctx, endOpen := subConn.beginTransfer(func() {})
+	bytes, data, err := subConn.openForDownload(ctx, path)
+	aborted := ctx.Err() != nil
+	endOpen()
+	if aborted {
+		if err == nil {
+			data.Close()
+		}
+		subConn.writeMessage(426, "Transfer aborted")
+		return
+	}
 	if err == nil {
 		defer data.Close()
 		stream, err := subConn.connection.getNewSendDataStream()
@@ -581,16 +1037,79 @@ func (cmd commandRetr) Execute(subConn *SubConn, param string) {
 			subConn.writeMessage(425, "Can't open data stream.")
 			return
 		}
-		subConn.writeMessage(150, fmt.Sprintf("%d Data transfer starting %v bytes", stream.StreamID(), bytes))
+		message := fmt.Sprintf("%d Data transfer starting %v bytes", stream.StreamID(), bytes)
+		if bytes == server.SizeUnknown {
+			message = fmt.Sprintf("%d Data transfer starting", stream.StreamID())
+		}
+		if _, err := subConn.writeMessage(150, message); err != nil {
+			stream.Close()
+			return
+		}
+		if interval := subConn.connection.server.ProgressInterval; interval > 0 {
+			stream = &progressWriter{SendStream: stream, subConn: subConn, total: bytes, interval: interval, next: interval}
+		}
 		err = subConn.sendOutofBandDataWriter(data, stream)
-		if err != nil {
-			subConn.writeMessage(551, "Error reading file")
+		if err == context.Canceled {
+			subConn.writeMessage(426, "Transfer aborted")
+		} else if err != nil {
+			subConn.writeError(551, "Error reading file", err)
 		}
 	} else {
-		subConn.writeMessage(551, "File not available")
+		subConn.writeError(551, "File not available", err)
 	}
 }
 
+// openForDownload opens path at lastFilePos and returns the number of bytes
+// left to send or server.SizeUnknown. A driver implementing
+// server.DownloadDriver is asked only once for both, without ctx.
+func (subConn *SubConn) openForDownload(ctx context.Context, path string) (int64, io.ReadCloser, error) {
+	downloadDriver, ok := unwrapDriver(subConn.driver).(server.DownloadDriver)
+	if !ok {
+		return getFileContext(ctx, subConn.driver, path, subConn.lastFilePos)
+	}
+	if err := checkPath(subConn.driver, path); err != nil {
+		return 0, nil, err
+	}
+	info, data, err := downloadDriver.OpenForDownload(path, subConn.lastFilePos)
+	if err != nil {
+		return 0, nil, err
+	}
+	if info == nil {
+		return server.SizeUnknown, data, nil
+	}
+	if info.IsDir() {
+		data.Close()
+		return 0, nil, errors.New("Not a file")
+	}
+	bytes := info.Size() - subConn.lastFilePos
+	if bytes < 0 {
+		bytes = 0
+	}
+	return bytes, data, nil
+}
+
+// commandRein responds to the REIN FTP command. It logs the user out and
+// resets the session like a new control stream, so that another user can
+// log in on it.
+type commandRein struct{}
+
+func (cmd commandRein) IsExtend() bool {
+	return false
+}
+
+func (cmd commandRein) RequireParam() bool {
+	return false
+}
+
+func (cmd commandRein) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandRein) Execute(subConn *SubConn, param string) {
+	subConn.resetSession()
+	subConn.writeMessage(220, "Service ready for new user")
+}
+
 type commandRest struct{}
 
 func (cmd commandRest) IsExtend() bool {
@@ -613,7 +1132,8 @@ func (cmd commandRest) Execute(subConn *SubConn, param string) {
 		return
 	}
 
-	subConn.appendData = true
+	// STOR after REST 0 rewrites the file like without REST.
+	subConn.appendData = subConn.lastFilePos > 0
 
 	subConn.writeMessage(350, fmt.Sprint("Start transfer from ", subConn.lastFilePos))
 }
@@ -656,16 +1176,35 @@ func (cmd commandRnto) RequireAuth() bool {
 }
 
 func (cmd commandRnto) Execute(subConn *SubConn, param string) {
-	toPath := subConn.buildPath(param)
-	err := subConn.driver.Rename(subConn.renameFrom, toPath)
-	defer func() {
-		subConn.renameFrom = ""
-	}()
+	fromPath := subConn.renameFrom
+	subConn.renameFrom = ""
+	if fromPath == "" {
+		subConn.writeMessage(503, "Bad sequence of commands, send RNFR first")
+		return
+	}
 
-	if err == nil {
+	toPath := subConn.buildPath(param)
+	if subConn.connection.server.RestrictRenameToSameDir && path.Dir(fromPath) != path.Dir(toPath) {
+		subConn.writeMessage(550, "Moving files to another directory is not allowed")
+		return
+	}
+	err := subConn.driver.Rename(fromPath, toPath)
+	switch {
+	case err == nil:
 		subConn.writeMessage(250, "File renamed")
-	} else {
-		subConn.writeMessage(550, fmt.Sprint("Action not taken: ", err))
+	case os.IsExist(err):
+		subConn.writeError(550, "Target already exists, source left unchanged", err)
+	case os.IsNotExist(err):
+		// The driver does not tell which of both paths is missing.
+		if _, statErr := subConn.driver.Stat(fromPath); statErr == nil {
+			subConn.writeError(550, "Target directory does not exist, source left unchanged", err)
+		} else {
+			subConn.writeError(550, "Source does not exist", err)
+		}
+	case os.IsPermission(err):
+		subConn.writeError(550, "Permission denied, source left unchanged", err)
+	default:
+		subConn.writeError(550, fmt.Sprint("Action not taken: ", err), err)
 	}
 }
 
@@ -685,13 +1224,25 @@ func (cmd commandRmd) RequireAuth() bool {
 	return true
 }
 
+// errDirNotEmpty stops ListDir as soon as the first entry is found.
+var errDirNotEmpty = errors.New("Directory not empty")
+
 func (cmd commandRmd) Execute(subConn *SubConn, param string) {
 	path := subConn.buildPath(param)
+	if subConn.connection.server.CheckDirEmptyOnRmd {
+		err := subConn.driver.ListDir(path, func(f server.FileInfo) error {
+			return errDirNotEmpty
+		})
+		if err == errDirNotEmpty {
+			subConn.writeMessage(550, errDirNotEmpty.Error())
+			return
+		}
+	}
 	err := subConn.driver.DeleteDir(path)
 	if err == nil {
 		subConn.writeMessage(250, "Directory deleted")
 	} else {
-		subConn.writeMessage(550, fmt.Sprint("Directory delete failed: ", err))
+		subConn.writeError(550, fmt.Sprint("Directory delete failed: ", err), err)
 	}
 }
 
@@ -718,12 +1269,83 @@ func (cmd commandSize) Execute(subConn *SubConn, param string) {
 		log.Printf("Size: error(%s)", err)
 		subConn.writeMessage(450, fmt.Sprint("path", path, "not found"))
 	} else {
-		subConn.writeMessage(213, strconv.Itoa(int(stat.Size())))
+		subConn.writeMessage(213, strconv.FormatInt(stat.Size(), 10))
 	}
 }
 
+// hasDeniedExtension reports whether the file name ends with one of the
+// extensions. Trailing dots and blanks are ignored as some file systems
+// drop them.
+func hasDeniedExtension(filePath string, extensions []string) bool {
+	name := strings.ToLower(strings.TrimRight(path.Base(filePath), ". "))
+	for _, extension := range extensions {
+		extension = strings.ToLower(strings.TrimLeft(extension, "."))
+		if extension != "" && strings.HasSuffix(name, "."+extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandStat responds to the STAT FTP command. Without a parameter it
+// returns the status of the session, with a path a listing of it like LIST,
+// but on the control stream, so it works without a data stream.
+type commandStat struct{}
+
+func (cmd commandStat) IsExtend() bool {
+	return false
+}
+
+func (cmd commandStat) RequireParam() bool {
+	return false
+}
+
+func (cmd commandStat) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandStat) Execute(subConn *SubConn, param string) {
+	if param == "" {
+		transferType := "BINARY"
+		if subConn.asciiType {
+			transferType = "ASCII"
+		}
+		subConn.writeMessageMultiline(211, subConn.connection.server.Name+" status:\n"+
+			" Connected from "+subConn.connection.session.RemoteAddr().String()+"\n"+
+			" Logged in as "+subConn.user+"\n"+
+			" TYPE: "+transferType+", MODE: STREAM, STRU: FILE\n"+
+			"End of status")
+		return
+	}
+	path := subConn.buildPath(parseListParam(param))
+	info, parentInfo, err := subConn.statListing(path)
+	if err != nil {
+		subConn.writeError(550, err.Error(), err)
+		return
+	}
+	files := []server.FileInfo{info}
+	if info.IsDir() {
+		files = nil
+		if subConn.connection.server.IncludeDotEntries {
+			files = dotEntries(info, parentInfo)
+		}
+		err = subConn.listDir(path, func(f server.FileInfo) error {
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			subConn.writeError(550, err.Error(), err)
+			return
+		}
+	}
+	// Every line of the listing starts with the file mode, so it can not be
+	// mistaken for the end of the reply.
+	listing := strings.Replace(string(subConn.listFormatter(files).Detailed()), "\r\n", "\n", -1)
+	subConn.writeMessageMultiline(213, "Status of "+path+":\n"+listing+"End of status")
+}
+
 // commandStor responds to the STOR FTP command. It allows the user to upload a
-// new file.
+// new file. After REST the upload continues the file at the given offset.
 type commandStor struct{}
 
 func (cmd commandStor) IsExtend() bool {
@@ -739,34 +1361,208 @@ func (cmd commandStor) RequireAuth() bool {
 }
 
 func (cmd commandStor) Execute(subConn *SubConn, param string) {
+	subConn.storeFile(param, subConn.appendData)
+}
+
+// storeFile receives the data stream and path given in param of STOR and
+// APPE and passes them to the driver.
+func (subConn *SubConn) storeFile(param string, appendData bool) {
 	params := strings.SplitN(param, " ", 2)
 	if len(params) != 2 {
 		subConn.writeMessage(501, "Stream ID and path seperated by a blank needed.")
+		return
 	}
-	streamIDUint64, err := strconv.ParseInt(params[0], 10, 64)
-	if err != nil || streamIDUint64 < 0 || streamIDUint64%4 != 2 {
+	streamID, ok := parseClientStreamID(params[0])
+	if !ok {
 		subConn.writeMessage(501, "Stream ID has not a valid value for a unidirectional stream from the client.")
+		return
 	}
-	streamID := quic.StreamID(streamIDUint64)
-	subConn.writeMessage(150, "Data transfer starting")
-	stream, err := subConn.connection.getReceiveDataStream(streamID)
+	if isDirectoryPath(params[1]) {
+		subConn.writeMessage(550, "Is a directory")
+		return
+	}
+	targetPath := subConn.buildPath(params[1])
+	// Two uploads to the same path would interleave their data.
+	if !subConn.connection.server.reserveName(targetPath) {
+		subConn.writeMessage(450, "File is being uploaded")
+		return
+	}
+	defer subConn.connection.server.releaseName(targetPath)
+	subConn.receiveFile(streamID, targetPath, appendData, "Data transfer starting", "")
+}
+
+// isDirectoryPath reports whether the path given by the client ends with a
+// slash and so names a directory. buildPath removes the slash, therefore
+// commands working on files have to check the parameter before.
+func isDirectoryPath(param string) bool {
+	return strings.HasSuffix(param, "/")
+}
+
+// commandStou responds to the STOU FTP command. It stores the file like
+// STOR, but under a name not used yet in the current directory, which is
+// announced with "150 FILE: name" and again with "226 FILE: name" after the
+// upload (RFC 1123). The parameter is the stream ID and optionally the name
+// to derive the unique name from.
+type commandStou struct{}
+
+func (cmd commandStou) IsExtend() bool {
+	return false
+}
+
+func (cmd commandStou) RequireParam() bool {
+	return true
+}
+
+func (cmd commandStou) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandStou) Execute(subConn *SubConn, param string) {
+	params := strings.SplitN(param, " ", 2)
+	streamID, ok := parseClientStreamID(params[0])
+	if !ok {
+		subConn.writeMessage(501, "Stream ID has not a valid value for a unidirectional stream from the client.")
+		return
+	}
+	base := "file"
+	if len(params) == 2 && path.Base(params[1]) != "/" {
+		base = path.Base(params[1])
+	}
+	targetPath, err := subConn.reserveUniqueName(subConn.namePrefix, base)
 	if err != nil {
-		subConn.writeMessage(425, "Can't open data stream.")
+		subConn.writeError(550, err.Error(), err)
+		return
 	}
+	defer subConn.connection.server.releaseName(targetPath)
+	fileMessage := "FILE: " + path.Base(targetPath)
+	subConn.receiveFile(streamID, targetPath, false, fileMessage, fileMessage)
+}
 
-	targetPath := subConn.buildPath(params[1])
+// parseClientStreamID parses the ID of a unidirectional stream opened by
+// the client.
+func parseClientStreamID(param string) (quic.StreamID, bool) {
+	streamID, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || streamID < 0 || streamID%4 != 2 {
+		return 0, false
+	}
+	return quic.StreamID(streamID), true
+}
+
+// parseClientBidiStreamID parses the ID of a bidirectional stream opened by
+// the client.
+func parseClientBidiStreamID(param string) (quic.StreamID, bool) {
+	streamID, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || streamID < 0 || streamID%4 != 0 {
+		return 0, false
+	}
+	return quic.StreamID(streamID), true
+}
 
+// receiveFile stores the data of the stream streamID at targetPath. The
+// transfer is announced to the client with a 150 reply with message, its
+// success with a 226 reply with doneMessage or the number of bytes received.
+func (subConn *SubConn) receiveFile(streamID quic.StreamID, targetPath string, appendData bool, message string, doneMessage string) {
+	offset := subConn.lastFilePos
 	defer func() {
 		subConn.appendData = false
+		subConn.lastFilePos = 0
 	}()
+	if hasDeniedExtension(targetPath, subConn.connection.server.DeniedExtensions) {
+		subConn.writeMessage(553, "File type not allowed")
+		return
+	}
+	if subConn.connection.server.CheckParentDirOnStor {
+		info, err := subConn.driver.Stat(path.Dir(targetPath))
+		if err != nil || !info.IsDir() {
+			subConn.writeMessage(550, "No such directory")
+			return
+		}
+	}
+	if _, err := subConn.writeMessage(150, message); err != nil {
+		return
+	}
+	stream, err := subConn.connection.getReceiveDataStream(streamID)
+	if err != nil {
+		subConn.writeMessage(425, "Can't open data stream.")
+		return
+	}
+	defer subConn.connection.server.releaseDataStream()
 
-	bytes, err := subConn.driver.PutFile(targetPath, stream, subConn.appendData)
-	if err == nil {
-		msg := "OK, received " + strconv.Itoa(int(bytes)) + " bytes"
+	ctx, endTransfer := subConn.beginTransfer(func() {
+		stream.CancelRead(ErrorCodeTransferAborted)
+	})
+	defer endTransfer()
+	// The stream is passed on unwrapped, unless the rate is limited, so a
+	// driver copying into a file can make use of the files io.ReaderFrom
+	// implementation.
+	var data io.Reader = stream
+	if rate := subConn.connection.server.UploadRateLimit; rate > 0 {
+		data = &rateLimitedReader{Reader: stream, limiter: newRateLimiter(rate)}
+	}
+	var bytes int64
+	start := time.Now()
+	if appendData && offset > 0 {
+		bytes, err = putFileFrom(ctx, subConn.driver, targetPath, data, offset)
+	} else {
+		bytes, err = putFileContext(ctx, subConn.driver, targetPath, data, appendData)
+	}
+	subConn.transferredBytes += bytes
+	subConn.observeTransfer(server.TransferUpload, bytes, start)
+	if ctx.Err() != nil {
+		subConn.writeMessage(426, "Transfer aborted")
+	} else if err == nil {
+		subConn.lastUploadPath = targetPath
+		if !appendData {
+			subConn.applyUmask(targetPath, 0666)
+		}
+		msg := doneMessage
+		if msg == "" {
+			msg = "OK, received " + strconv.Itoa(int(bytes)) + " bytes"
+		}
 		subConn.writeMessage(226, msg)
+	} else if err == server.ErrQuotaExceeded {
+		subConn.writeErrorCategory(ErrorQuotaExceeded, 552, subConn.quotaExceededMessage(targetPath))
+	} else if err == errOffsetMismatch {
+		subConn.writeMessage(554, err.Error())
 	} else {
-		subConn.writeMessage(450, fmt.Sprint("error during transfer: ", err))
+		subConn.writeError(450, fmt.Sprint("error during transfer: ", err), err)
+	}
+}
+
+var errOffsetMismatch = errors.New("Restart offset does not match the size of the file")
+
+// putFileFrom writes data to filePath from offset on with the drivers
+// PutFileFrom or, if it does not implement server.ResumeDriver, appends it
+// with PutFile if the file has exactly offset bytes. ctx is passed on to
+// the methods of a server.ContextDriver, PutFileFrom has none.
+func putFileFrom(ctx context.Context, driver server.Driver, filePath string, data io.Reader, offset int64) (int64, error) {
+	if resumeDriver, ok := unwrapDriver(driver).(server.ResumeDriver); ok {
+		if err := checkPath(driver, filePath); err != nil {
+			return 0, err
+		}
+		return resumeDriver.PutFileFrom(filePath, data, offset)
+	}
+	info, err := statContext(ctx, driver, filePath)
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != offset {
+		return 0, errOffsetMismatch
+	}
+	return putFileContext(ctx, driver, filePath, data, true)
+}
+
+// quotaExceededMessage fills the remaining space for an upload to filePath
+// into the QuotaExceededMessage. If the driver does not report it, the
+// placeholder is replaced by "unknown".
+func (subConn *SubConn) quotaExceededMessage(filePath string) string {
+	remaining := "unknown"
+	if quotaDriver, ok := unwrapDriver(subConn.driver).(server.QuotaDriver); ok && checkPath(subConn.driver, filePath) == nil {
+		if available, err := quotaDriver.AvailableSpace(filePath); err == nil {
+			remaining = strconv.FormatInt(available, 10)
+		}
 	}
+	return strings.Replace(subConn.connection.server.QuotaExceededMessage, "{remaining}", remaining, -1)
 }
 
 // commandStru responds to the STRU FTP command.
@@ -845,15 +1641,22 @@ func (cmd commandType) RequireAuth() bool {
 
 func (cmd commandType) Execute(subConn *SubConn, param string) {
 	if strings.ToUpper(param) == "A" {
+		subConn.asciiType = true
 		subConn.writeMessage(200, "Type set to ASCII")
 	} else if strings.ToUpper(param) == "I" {
+		subConn.asciiType = false
 		subConn.writeMessage(200, "Type set to binary")
 	} else {
 		subConn.writeMessage(500, "Invalid type")
 	}
 }
 
-// commandUser responds to the USER FTP command by asking for the password
+// commandUser responds to the USER FTP command by asking for the password.
+//
+// A second USER before PASS replaces the requested user name, the password
+// is then checked for the new one. USER after a successful login logs the
+// user out and resets the session like a new control stream, before the
+// password of the new user is asked for, see REIN.
 type commandUser struct{}
 
 func (cmd commandUser) IsExtend() bool {
@@ -869,6 +1672,10 @@ func (cmd commandUser) RequireAuth() bool {
 }
 
 func (cmd commandUser) Execute(subConn *SubConn, param string) {
+	subConn.padAuthResponse(time.Now())
+	if subConn.IsLogin() {
+		subConn.resetSession()
+	}
 	subConn.reqUser = param
 	subConn.writeMessage(331, "User name ok, password required")
 }
@@ -0,0 +1,1325 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"bytes"
+	server "github.com/attenberger/ftps_qftp-server"
+	"github.com/lucas-clemente/quic-go"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type readOnlyMemDriver struct {
+	*memDriver
+}
+
+func (d readOnlyMemDriver) Rename(from string, to string) error {
+	return &os.PathError{Op: "rename", Path: from, Err: os.ErrPermission}
+}
+
+func TestRnto(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/a", "a")
+	driver.addFile("/b", "b")
+	subConn, control, _ := newTestSubConn(driver, nil)
+
+	cases := []struct {
+		from     string
+		to       string
+		response string
+	}{
+		{"a", "b", "550 Target already exists, source left unchanged"},
+		{"missing", "c", "550 Source does not exist"},
+		{"a", "c", "250 File renamed"},
+	}
+	for _, c := range cases {
+		subConn.receiveLine("RNFR " + c.from + "\r\n")
+		subConn.receiveLine("RNTO " + c.to + "\r\n")
+		if response := lastResponse(control); response != c.response {
+			t.Errorf("rename %s to %s: got %q, want %q", c.from, c.to, response, c.response)
+		}
+		if subConn.renameFrom != "" {
+			t.Errorf("rename %s to %s: renameFrom not cleared", c.from, c.to)
+		}
+	}
+	if _, ok := driver.content("/a"); ok {
+		t.Error("/a still exists after rename")
+	}
+
+	subConn.receiveLine("RNTO d\r\n")
+	if response := lastResponse(control); response != "503 Bad sequence of commands, send RNFR first" {
+		t.Errorf("RNTO without RNFR: got %q", response)
+	}
+}
+
+func TestRntoPermissionDenied(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/a", "a")
+	subConn, control, _ := newTestSubConn(readOnlyMemDriver{driver}, nil)
+	subConn.receiveLine("RNFR a\r\n")
+	subConn.receiveLine("RNTO b\r\n")
+	if response := lastResponse(control); response != "550 Permission denied, source left unchanged" {
+		t.Errorf("got %q", response)
+	}
+	if _, ok := driver.content("/a"); !ok {
+		t.Error("source was removed")
+	}
+}
+
+// noDirsMemDriver behaves as if the target directory of every rename was
+// missing.
+type noDirsMemDriver struct {
+	*memDriver
+}
+
+func (d noDirsMemDriver) Rename(from string, to string) error {
+	return &os.PathError{Op: "rename", Path: to, Err: os.ErrNotExist}
+}
+
+func TestRntoMissingTargetDir(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/a", "a")
+	subConn, control, _ := newTestSubConn(noDirsMemDriver{driver}, nil)
+	subConn.receiveLine("RNFR a\r\n")
+	subConn.receiveLine("RNTO missing/b\r\n")
+	if response := lastResponse(control); response != "550 Target directory does not exist, source left unchanged" {
+		t.Errorf("got %q", response)
+	}
+}
+
+func TestRntoRestrictToSameDir(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/a", "a")
+	subConn, control, _ := newTestSubConn(driver, &ServerOpts{RestrictRenameToSameDir: true})
+
+	subConn.receiveLine("RNFR /dir/a\r\n")
+	subConn.receiveLine("RNTO /b\r\n")
+	if response := lastResponse(control); response != "550 Moving files to another directory is not allowed" {
+		t.Errorf("cross directory rename: got %q", response)
+	}
+
+	subConn.receiveLine("RNFR /dir/a\r\n")
+	subConn.receiveLine("RNTO /dir/b\r\n")
+	if response := lastResponse(control); response != "250 File renamed" {
+		t.Errorf("same directory rename: got %q", response)
+	}
+}
+
+func TestMkdQuotedPath(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), nil)
+	subConn.receiveLine("MKD /new dir\r\n")
+	if response := lastResponse(control); response != "257 \"/new dir\" created" {
+		t.Errorf("MKD: got %q", response)
+	}
+	subConn.receiveLine("MKD say \"hi\"\r\n")
+	if response := lastResponse(control); response != "257 \"/say \"\"hi\"\"\" created" {
+		t.Errorf("MKD with quotes: got %q", response)
+	}
+	subConn.receiveLine("CWD say \"hi\"\r\n")
+	subConn.receiveLine("PWD\r\n")
+	if response := lastResponse(control); response != "257 \"/say \"\"hi\"\"\" is the current directory" {
+		t.Errorf("PWD with quotes: got %q", response)
+	}
+}
+
+func TestQuotePath(t *testing.T) {
+	cases := map[string]string{
+		"/":          `"/"`,
+		"/dir":       `"/dir"`,
+		`/a"b`:       `"/a""b"`,
+		`/"quoted"/`: `"/""quoted""/"`,
+	}
+	for path, expected := range cases {
+		if quoted := quotePath(path); quoted != expected {
+			t.Errorf("%s: got %s, want %s", path, quoted, expected)
+		}
+	}
+}
+
+func TestRmdCheckDirEmpty(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/empty")
+	driver.addDir("/full")
+	driver.addFile("/full/file", "data")
+	subConn, control, _ := newTestSubConn(driver, &ServerOpts{CheckDirEmptyOnRmd: true})
+
+	subConn.receiveLine("RMD /full\r\n")
+	if response := lastResponse(control); response != "550 Directory not empty" {
+		t.Errorf("RMD of non-empty directory: got %q", response)
+	}
+	subConn.receiveLine("RMD /empty\r\n")
+	if response := lastResponse(control); response != "250 Directory deleted" {
+		t.Errorf("RMD of empty directory: got %q", response)
+	}
+}
+
+func TestListIncludeDotEntries(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/file", "data")
+	driver.files["/"].modTime = time.Date(2018, 1, 2, 3, 4, 0, 0, time.UTC)
+	driver.files["/dir"].modTime = time.Date(2018, 5, 6, 7, 8, 0, 0, time.UTC)
+	subConn, control, session := newTestSubConn(driver, &ServerOpts{IncludeDotEntries: true})
+
+	subConn.receiveLine("LIST /dir\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "226 ") {
+		t.Fatalf("LIST: got %q", response)
+	}
+	lines := strings.Split(strings.TrimSuffix(session.sendStreams[0].String(), "\r\n"), "\r\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 entries, got %q", lines)
+	}
+	if !strings.HasPrefix(lines[0], "drwxr-xr-x") || !strings.HasSuffix(lines[0], " May  6 07:08 .") {
+		t.Errorf("unexpected . entry %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "drwxr-xr-x") || !strings.HasSuffix(lines[1], " Jan  2 03:04 ..") {
+		t.Errorf("unexpected .. entry %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], " file") {
+		t.Errorf("unexpected file entry %q", lines[2])
+	}
+}
+
+// parentDeniedMemDriver refuses to Stat the root directory.
+type parentDeniedMemDriver struct {
+	*memDriver
+}
+
+func (d parentDeniedMemDriver) Stat(filePath string) (server.FileInfo, error) {
+	if filePath == "/" {
+		return nil, os.ErrPermission
+	}
+	return d.memDriver.Stat(filePath)
+}
+
+func TestListDotEntriesParentDenied(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/file", "data")
+	subConn, control, session := newTestSubConn(parentDeniedMemDriver{driver}, &ServerOpts{IncludeDotEntries: true})
+
+	subConn.receiveLine("LIST /dir\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "226 ") {
+		t.Fatalf("LIST: got %q", response)
+	}
+	lines := strings.Split(strings.TrimSuffix(session.sendStreams[0].String(), "\r\n"), "\r\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " .") || !strings.HasSuffix(lines[1], " file") {
+		t.Errorf("expected . and file, got %q", lines)
+	}
+}
+
+func TestNlstLongFlag(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/file", "data")
+	subConn, _, session := newTestSubConn(driver, nil)
+	subConn.namePrefix = "/dir"
+
+	cases := []struct {
+		line     string
+		detailed bool
+	}{
+		{"NLST\r\n", false},
+		{"NLST -l\r\n", true},
+		{"NLST -l /dir\r\n", true},
+		{"NLST /dir\r\n", false},
+	}
+	for i, c := range cases {
+		subConn.receiveLine(c.line)
+		listing := session.sendStreams[i].String()
+		if c.detailed && !strings.HasPrefix(listing, "-rw-r--r-- 1 owner group ") {
+			t.Errorf("%q: expected detailed listing, got %q", c.line, listing)
+		}
+		if !c.detailed && listing != "file\r\n" {
+			t.Errorf("%q: expected short listing, got %q", c.line, listing)
+		}
+	}
+}
+
+func TestMlsd(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/file", "data")
+	subConn, control, session := newTestSubConn(driver, &ServerOpts{IncludeDotEntries: true})
+
+	subConn.receiveLine("MLSD /dir/file\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "501 ") {
+		t.Errorf("MLSD of a file: got %q", response)
+	}
+	subConn.receiveLine("MLSD /dir\r\n")
+	expected := "type=cdir;size=0;modify=00010101000000; .\r\n" +
+		"type=pdir;size=0;modify=00010101000000; ..\r\n" +
+		"type=file;size=4;modify=00010101000000; file\r\n"
+	if listing := session.sendStreams[0].String(); listing != expected {
+		t.Errorf("got %q, want %q", listing, expected)
+	}
+}
+
+func TestHasDeniedExtension(t *testing.T) {
+	denied := []string{"exe", ".BAT", "tar.gz"}
+	cases := map[string]bool{
+		"/setup.exe":     true,
+		"/SETUP.EXE":     true,
+		"/run.bat":       true,
+		"/setup.exe. ":   true,
+		"/backup.tar.gz": true,
+		"/backup.gz":     false,
+		"/exe":           false,
+		"/notes.txt":     false,
+		"/dir.exe/a.txt": false,
+	}
+	for filePath, expected := range cases {
+		if result := hasDeniedExtension(filePath, denied); result != expected {
+			t.Errorf("hasDeniedExtension(%q) = %v, want %v", filePath, result, expected)
+		}
+	}
+}
+
+func TestStorDeniedExtensions(t *testing.T) {
+	driver := newMemDriver()
+	subConn, control, session := newTestSubConn(driver, &ServerOpts{DeniedExtensions: []string{"exe"}})
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("data")}}
+
+	subConn.receiveLine("STOR 2 virus.EXE\r\n")
+	if response := lastResponse(control); response != "553 File type not allowed" {
+		t.Errorf("STOR of denied extension: got %q", response)
+	}
+	subConn.receiveLine("STOR 2 notes.txt\r\n")
+	if response := lastResponse(control); response != "226 OK, received 4 bytes" {
+		t.Errorf("STOR of allowed extension: got %q", response)
+	}
+	if content, _ := driver.content("/notes.txt"); content != "data" {
+		t.Errorf("stored %q", content)
+	}
+}
+
+func TestFeat(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), nil)
+	subConn.receiveLine("FEAT\r\n")
+	expected := "211-Features:\r\n" +
+		" UTF8\r\n" +
+		" MFMT\r\n" +
+		" HASH SHA-256*;SHA-1;CRC32;MD5\r\n" +
+		" MLST type*;size*;modify*;create;unique;\r\n" +
+		" SITE CHMOD;DU;IDLE;INFO;MKDCD;NOW;RUPLOAD;SYNC;UMASK\r\n" +
+		"211 End\r\n"
+	if result := control.String(); result != expected {
+		t.Errorf("got %q, want %q", result, expected)
+	}
+}
+
+func TestZeroByteTransfers(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/empty", "")
+	subConn, control, session := newTestSubConn(driver, nil)
+
+	subConn.receiveLine("RETR /empty\r\n")
+	lines := responses(control)
+	if len(lines) != 2 || lines[0] != "150 3 Data transfer starting 0 bytes" || lines[1] != "226 Closing data stream, sent 0 bytes" {
+		t.Errorf("RETR: got %q", lines)
+	}
+	if stream := session.sendStreams[0]; !stream.closed || stream.String() != "" {
+		t.Errorf("RETR: data stream closed %v, got %q", stream.closed, stream.String())
+	}
+
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("")}}
+	subConn.receiveLine("STOR 2 uploaded\r\n")
+	if response := lastResponse(control); response != "226 OK, received 0 bytes" {
+		t.Errorf("STOR: got %q", response)
+	}
+	if content, ok := driver.content("/uploaded"); !ok || content != "" {
+		t.Errorf("STOR: stored %q, %v", content, ok)
+	}
+	if len(subConn.connection.dataReceiveStreams) != 0 {
+		t.Error("STOR: received stream still registered")
+	}
+}
+
+// slowAuth takes longer to check the password of existing users, like a
+// password hash would.
+type slowAuth struct {
+	server.SimpleAuth
+}
+
+func (a slowAuth) CheckPasswd(name, pass string) (bool, error) {
+	if name == a.Name {
+		time.Sleep(20 * time.Millisecond)
+	}
+	return a.SimpleAuth.CheckPasswd(name, pass)
+}
+
+func TestUserTwiceBeforePass(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), nil)
+	subConn.user = ""
+	for _, line := range []string{"USER nobody", "USER admin"} {
+		subConn.receiveLine(line + "\r\n")
+		if response := lastResponse(control); response != "331 User name ok, password required" {
+			t.Errorf("%s: got %q", line, response)
+		}
+	}
+	subConn.receiveLine("PASS secret\r\n")
+	if response := lastResponse(control); response != "230 Password ok, continue" || subConn.LoginUser() != "admin" {
+		t.Errorf("PASS: got %q as %q", response, subConn.LoginUser())
+	}
+}
+
+func TestUserAfterLogin(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	subConn, control, _ := newTestSubConn(driver, nil)
+	subConn.receiveLine("CWD /dir\r\n")
+	subConn.receiveLine("TYPE A\r\n")
+	subConn.receiveLine("REST 10\r\n")
+
+	subConn.receiveLine("USER nobody\r\n")
+	if response := lastResponse(control); response != "331 User name ok, password required" {
+		t.Errorf("USER after login: got %q", response)
+	}
+	if subConn.IsLogin() || subConn.CurrentDir() != "/" || subConn.asciiType || subConn.lastFilePos != 0 {
+		t.Errorf("session not reset: user %q in %s", subConn.LoginUser(), subConn.CurrentDir())
+	}
+	subConn.receiveLine("PWD\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "530 ") {
+		t.Errorf("PWD after USER: got %q", response)
+	}
+	subConn.receiveLine("PASS secret\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "530 ") || subConn.IsLogin() {
+		t.Errorf("PASS of admin for nobody: got %q", response)
+	}
+}
+
+func TestHomeDir(t *testing.T) {
+	auth := &server.SimpleAuth{Name: "admin", Password: "secret", Home: "home/admin/"}
+	subConn, control, _ := newTestSubConn(newMemDriver(), &ServerOpts{Auth: auth})
+	subConn.receiveLine("USER admin\r\n")
+	subConn.receiveLine("PASS secret\r\n")
+	subConn.receiveLine("PWD\r\n")
+	if response := lastResponse(control); response != `257 "/home/admin" is the current directory` {
+		t.Errorf("got %q", response)
+	}
+
+	auth.Home = ""
+	subConn.receiveLine("USER admin\r\n")
+	subConn.receiveLine("PASS secret\r\n")
+	subConn.receiveLine("PWD\r\n")
+	if response := lastResponse(control); response != `257 "/" is the current directory` {
+		t.Errorf("without home: got %q", response)
+	}
+}
+
+func TestRein(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/file", "data")
+	subConn, control, _ := newTestSubConn(driver, &ServerOpts{IdleTimeout: time.Minute, MaxProtocolErrors: 5})
+	subConn.receiveLine("CWD /dir\r\n")
+	subConn.receiveLine("RNFR /file\r\n")
+	subConn.receiveLine("REST 2\r\n")
+	subConn.receiveLine("SITE IDLE 10\r\n")
+	if timeout := subConn.getIdleTimeout(); timeout != 10*time.Second {
+		t.Errorf("SITE IDLE 10: idle timeout %v", timeout)
+	}
+	subConn.protocolErrors = 3
+
+	subConn.receiveLine("REIN\r\n")
+	if response := lastResponse(control); response != "220 Service ready for new user" {
+		t.Errorf("REIN: got %q", response)
+	}
+	if subConn.IsLogin() || subConn.reqUser != "" || subConn.CurrentDir() != "/" ||
+		subConn.renameFrom != "" || subConn.lastFilePos != 0 || subConn.appendData {
+		t.Errorf("session not reset: user %q in %s", subConn.LoginUser(), subConn.CurrentDir())
+	}
+	if timeout := subConn.getIdleTimeout(); timeout != time.Minute || subConn.protocolErrors != 0 {
+		t.Errorf("REIN: idle timeout %v, %d protocol errors", timeout, subConn.protocolErrors)
+	}
+	for _, line := range []string{"PWD", "RNTO /renamed", "RETR /file"} {
+		subConn.receiveLine(line + "\r\n")
+		if response := lastResponse(control); response != "530 not logged in" {
+			t.Errorf("%s after REIN: got %q", line, response)
+		}
+	}
+	subConn.receiveLine("USER admin\r\n")
+	subConn.receiveLine("PASS secret\r\n")
+	subConn.receiveLine("PWD\r\n")
+	if response := lastResponse(control); response != "257 \"/\" is the current directory" {
+		t.Errorf("PWD after new login: got %q", response)
+	}
+}
+
+func TestAuthResponseTime(t *testing.T) {
+	const responseTime = 80 * time.Millisecond
+	auth := slowAuth{server.SimpleAuth{Name: "admin", Password: "secret"}}
+	subConn, control, _ := newTestSubConn(newMemDriver(), &ServerOpts{Auth: auth, AuthResponseTime: responseTime})
+
+	for _, user := range []string{"admin", "nobody"} {
+		for _, line := range []string{"USER " + user + "\r\n", "PASS wrong\r\n"} {
+			start := time.Now()
+			subConn.receiveLine(line)
+			elapsed := time.Since(start)
+			if elapsed < responseTime || elapsed > responseTime+40*time.Millisecond {
+				t.Errorf("%q took %v, want about %v", line, elapsed, responseTime)
+			}
+		}
+		if response := lastResponse(control); response != "530 Incorrect password, not logged in" {
+			t.Errorf("PASS for %s: got %q", user, response)
+		}
+	}
+}
+
+func TestStorSamePathConcurrently(t *testing.T) {
+	driver := newMemDriver()
+	first, firstControl, session := newTestSubConn(driver, nil)
+	secondControl := &fakeStream{id: 4}
+	second := first.connection.newSubConn(secondControl, driver)
+	second.user = "admin"
+	data, client := io.Pipe()
+	session.receiveStreams = []*fakeStream{{id: 2, reader: data}, {id: 6, reader: strings.NewReader("other")}}
+
+	done := make(chan struct{})
+	go func() {
+		first.receiveLine("STOR 2 /file\r\n")
+		close(done)
+	}()
+	// returns once the driver of the first upload reads
+	client.Write([]byte("first"))
+	second.receiveLine("STOR 6 /file\r\n")
+	if response := lastResponse(secondControl); response != "450 File is being uploaded" {
+		t.Errorf("second STOR: got %q", response)
+	}
+	second.receiveLine("APPE 6 /file\r\n")
+	if response := lastResponse(secondControl); response != "450 File is being uploaded" {
+		t.Errorf("APPE during STOR: got %q", response)
+	}
+	client.Close()
+	<-done
+	if response := lastResponse(firstControl); response != "226 OK, received 5 bytes" {
+		t.Errorf("first STOR: got %q", response)
+	}
+
+	second.receiveLine("STOR 6 /file\r\n")
+	if response := lastResponse(secondControl); response != "226 OK, received 5 bytes" {
+		t.Errorf("STOR after the first finished: got %q", response)
+	}
+	if content, _ := driver.content("/file"); content != "other" {
+		t.Errorf("stored %q", content)
+	}
+}
+
+type resumeMemDriver struct {
+	*memDriver
+}
+
+func (d resumeMemDriver) PutFileFrom(filePath string, data io.Reader, offset int64) (int64, error) {
+	content, err := ioutil.ReadAll(data)
+	if err != nil {
+		return 0, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	f := d.files[filePath]
+	f.data = append(f.data[:offset], content...)
+	return int64(len(content)), nil
+}
+
+func TestStorRest(t *testing.T) {
+	driver := resumeMemDriver{newMemDriver()}
+	driver.addFile("/file", "0123XXXXXX")
+	subConn, control, session := newTestSubConn(driver, nil)
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("4567")}, {id: 6, reader: strings.NewReader("new")}}
+
+	subConn.receiveLine("REST 4\r\n")
+	subConn.receiveLine("STOR 2 /file\r\n")
+	if response := lastResponse(control); response != "226 OK, received 4 bytes" {
+		t.Errorf("STOR after REST: got %q", response)
+	}
+	if content, _ := driver.content("/file"); content != "01234567" {
+		t.Errorf("stored %q", content)
+	}
+	if subConn.lastFilePos != 0 || subConn.appendData {
+		t.Errorf("offset %d not reset", subConn.lastFilePos)
+	}
+	subConn.receiveLine("STOR 6 /file\r\n")
+	if content, _ := driver.content("/file"); content != "new" {
+		t.Errorf("STOR without REST stored %q", content)
+	}
+}
+
+func TestStorRestZero(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/file", "old content")
+	subConn, control, session := newTestSubConn(driver, nil)
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("new")}}
+
+	subConn.receiveLine("REST 0\r\n")
+	subConn.receiveLine("STOR 2 /file\r\n")
+	if response := lastResponse(control); response != "226 OK, received 3 bytes" {
+		t.Errorf("STOR after REST 0: got %q", response)
+	}
+	if content, _ := driver.content("/file"); content != "new" {
+		t.Errorf("stored %q", content)
+	}
+}
+
+func TestStorRestAppendFallback(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/file", "0123")
+	subConn, control, session := newTestSubConn(driver, nil)
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("4567")}, {id: 6, reader: strings.NewReader("89")}}
+
+	subConn.receiveLine("REST 2\r\n")
+	subConn.receiveLine("STOR 2 /file\r\n")
+	if response := lastResponse(control); response != "554 Restart offset does not match the size of the file" {
+		t.Errorf("STOR after REST within the file: got %q", response)
+	}
+	subConn.receiveLine("REST 4\r\n")
+	subConn.receiveLine("STOR 6 /file\r\n")
+	if content, _ := driver.content("/file"); content != "012389" {
+		t.Errorf("stored %q", content)
+	}
+}
+
+func TestStorCheckParentDir(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/file", "data")
+	subConn, control, session := newTestSubConn(driver, &ServerOpts{CheckParentDirOnStor: true})
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("data")}}
+
+	for _, target := range []string{"/missing/a", "/file/a"} {
+		subConn.receiveLine("STOR 2 " + target + "\r\n")
+		if response := lastResponse(control); response != "550 No such directory" {
+			t.Errorf("STOR %s: got %q", target, response)
+		}
+	}
+	if len(session.receiveStreams) != 1 {
+		t.Error("data stream was accepted for a refused upload")
+	}
+	subConn.receiveLine("STOR 2 /dir/a\r\n")
+	if response := lastResponse(control); response != "226 OK, received 4 bytes" {
+		t.Errorf("STOR /dir/a: got %q", response)
+	}
+}
+
+func TestRetrProgress(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/large", strings.Repeat("x", 1000000))
+	subConn, control, session := newTestSubConn(driver, &ServerOpts{ProgressInterval: 300000})
+
+	subConn.receiveLine("RETR /large\r\n")
+	expected := []string{
+		"150 3 Data transfer starting 1000000 bytes",
+		"150 Transferred 300000 of 1000000 bytes",
+		"150 Transferred 600000 of 1000000 bytes",
+		"150 Transferred 900000 of 1000000 bytes",
+		"226 Closing data stream, sent 1000000 bytes",
+	}
+	if lines := responses(control); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got %q, want %q", lines, expected)
+	}
+	if stream := session.sendStreams[0]; len(stream.String()) != 1000000 || !stream.closed {
+		t.Errorf("sent %d bytes, closed %v", len(stream.String()), stream.closed)
+	}
+}
+
+// downloadMemDriver counts the calls made to fetch a file.
+type downloadMemDriver struct {
+	*memDriver
+	stats     int
+	gets      int
+	downloads int
+}
+
+func (d *downloadMemDriver) Stat(filePath string) (server.FileInfo, error) {
+	d.stats++
+	return d.memDriver.Stat(filePath)
+}
+
+func (d *downloadMemDriver) GetFile(filePath string, offset int64) (int64, io.ReadCloser, error) {
+	d.gets++
+	return d.memDriver.GetFile(filePath, offset)
+}
+
+func (d *downloadMemDriver) OpenForDownload(filePath string, offset int64) (server.FileInfo, io.ReadCloser, error) {
+	d.downloads++
+	info, err := d.memDriver.Stat(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, data, err := d.memDriver.GetFile(filePath, offset)
+	return info, data, err
+}
+
+func TestRetrOpenForDownload(t *testing.T) {
+	driver := &downloadMemDriver{memDriver: newMemDriver()}
+	driver.addFile("/file", "0123456789")
+	subConn, control, session := newTestSubConn(driver, nil)
+
+	subConn.receiveLine("REST 4\r\n")
+	subConn.receiveLine("RETR /file\r\n")
+	lines := responses(control)
+	if lines[1] != "150 3 Data transfer starting 6 bytes" || lines[2] != "226 Closing data stream, sent 6 bytes" {
+		t.Errorf("got %q", lines)
+	}
+	if data := session.sendStreams[0].String(); data != "456789" {
+		t.Errorf("sent %q", data)
+	}
+	if driver.downloads != 1 || driver.stats != 0 || driver.gets != 0 {
+		t.Errorf("%d OpenForDownload, %d Stat, %d GetFile calls", driver.downloads, driver.stats, driver.gets)
+	}
+}
+
+func TestRetrResumedByteCount(t *testing.T) {
+	for _, cumulative := range []bool{false, true} {
+		driver := newMemDriver()
+		driver.addFile("/file", "0123456789")
+		subConn, control, session := newTestSubConn(driver, &ServerOpts{ReportCumulativeBytes: cumulative})
+
+		subConn.receiveLine("REST 4\r\n")
+		subConn.receiveLine("RETR /file\r\n")
+		expected := "226 Closing data stream, sent 6 bytes"
+		if cumulative {
+			expected = "226 Closing data stream, sent 10 bytes"
+		}
+		if response := lastResponse(control); response != expected {
+			t.Errorf("cumulative %v: got %q, want %q", cumulative, response, expected)
+		}
+		if data := session.sendStreams[0].String(); data != "456789" {
+			t.Errorf("cumulative %v: sent %q", cumulative, data)
+		}
+	}
+}
+
+// statCountingMemDriver counts the calls to Stat.
+type statCountingMemDriver struct {
+	*memDriver
+	stats int
+}
+
+func (d *statCountingMemDriver) Stat(filePath string) (server.FileInfo, error) {
+	d.stats++
+	return d.memDriver.Stat(filePath)
+}
+
+// batchMemDriver additionally implements server.BatchStatDriver.
+type batchMemDriver struct {
+	statCountingMemDriver
+	batches int
+}
+
+func (d *batchMemDriver) StatBatch(paths []string) ([]server.FileInfo, error) {
+	d.batches++
+	infos := make([]server.FileInfo, len(paths))
+	for i, filePath := range paths {
+		if info, err := d.memDriver.Stat(filePath); err == nil {
+			infos[i] = info
+		}
+	}
+	return infos, nil
+}
+
+func TestListStatBatch(t *testing.T) {
+	newDriver := func() *memDriver {
+		driver := newMemDriver()
+		driver.addDir("/dir")
+		driver.addFile("/dir/file", "data")
+		return driver
+	}
+	perEntry := &statCountingMemDriver{memDriver: newDriver()}
+	batch := &batchMemDriver{statCountingMemDriver: statCountingMemDriver{memDriver: newDriver()}}
+
+	var listings []string
+	for _, driver := range []server.Driver{perEntry, batch} {
+		subConn, control, session := newTestSubConn(driver, &ServerOpts{IncludeDotEntries: true})
+		subConn.receiveLine("MLSD /dir\r\n")
+		subConn.receiveLine("MLSD /missing\r\n")
+		if response := lastResponse(control); !strings.HasPrefix(response, "550 ") {
+			t.Errorf("MLSD /missing: got %q", response)
+		}
+		listings = append(listings, session.sendStreams[0].String())
+	}
+	if listings[0] != listings[1] || !strings.Contains(listings[0], " ..\r\n") {
+		t.Errorf("listings differ: %q and %q", listings[0], listings[1])
+	}
+	if perEntry.stats != 4 {
+		t.Errorf("%d Stat calls without batch support", perEntry.stats)
+	}
+	if batch.stats != 0 || batch.batches != 2 {
+		t.Errorf("%d Stat and %d StatBatch calls with batch support", batch.stats, batch.batches)
+	}
+}
+
+// quotaMemDriver refuses uploads larger than its quota.
+type quotaMemDriver struct {
+	*memDriver
+	quota int64
+}
+
+func (d quotaMemDriver) PutFile(filePath string, data io.Reader, appendData bool) (int64, error) {
+	content, _ := ioutil.ReadAll(data)
+	if int64(len(content)) > d.quota {
+		return 0, server.ErrQuotaExceeded
+	}
+	return d.memDriver.PutFile(filePath, bytes.NewReader(content), appendData)
+}
+
+func (d quotaMemDriver) AvailableSpace(filePath string) (int64, error) {
+	return d.quota, nil
+}
+
+// fullMemDriver refuses all uploads without reporting the available space.
+type fullMemDriver struct {
+	*memDriver
+}
+
+func (d fullMemDriver) PutFile(filePath string, data io.Reader, appendData bool) (int64, error) {
+	return 0, server.ErrQuotaExceeded
+}
+
+func TestStorQuotaExceeded(t *testing.T) {
+	cases := []struct {
+		driver   server.Driver
+		message  string
+		response string
+	}{
+		{quotaMemDriver{newMemDriver(), 3}, "", "552 Quota exceeded"},
+		{quotaMemDriver{newMemDriver(), 3}, "Quota exceeded, {remaining} bytes left", "552 Quota exceeded, 3 bytes left"},
+		{fullMemDriver{newMemDriver()}, "Quota exceeded, {remaining} bytes left", "552 Quota exceeded, unknown bytes left"},
+	}
+	for _, c := range cases {
+		subConn, control, session := newTestSubConn(c.driver, &ServerOpts{QuotaExceededMessage: c.message})
+		session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("data")}}
+		subConn.receiveLine("STOR 2 file\r\n")
+		if response := lastResponse(control); !strings.HasPrefix(response, c.response) {
+			t.Errorf("got %q, want %q", response, c.response)
+		}
+	}
+}
+
+func TestTransferAbortedOnBrokenControlStream(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/file", "data")
+	for _, line := range []string{"RETR /file\r\n", "LIST /\r\n", "NLST /\r\n", "MLSD /\r\n", "STOR 2 /new\r\n"} {
+		subConn, control, session := newTestSubConn(driver, &ServerOpts{MaxTotalDataStreams: 1})
+		session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("data")}}
+		control.failWrites = true
+		subConn.receiveLine(line)
+
+		for _, stream := range session.sendStreams {
+			if !stream.closed || stream.String() != "" {
+				t.Errorf("%q: data stream closed %v, sent %q", line, stream.closed, stream.String())
+			}
+		}
+		if len(session.receiveStreams) != 1 {
+			t.Errorf("%q: data stream accepted", line)
+		}
+		if len(subConn.connection.server.dataStreamSlots) != 0 {
+			t.Errorf("%q: data stream slot not released", line)
+		}
+	}
+	if _, ok := driver.content("/new"); ok {
+		t.Error("upload stored")
+	}
+}
+
+func TestAppe(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/existing", "Hello, ")
+	subConn, control, session := newTestSubConn(driver, nil)
+	session.receiveStreams = []*fakeStream{
+		{id: 2, reader: strings.NewReader("world")},
+		{id: 6, reader: strings.NewReader("new")},
+	}
+
+	subConn.receiveLine("APPE 2 /existing\r\n")
+	lines := responses(control)
+	if len(lines) != 2 || lines[0] != "150 Data transfer starting" || lines[1] != "226 OK, received 5 bytes" {
+		t.Errorf("APPE to existing file: got %q", lines)
+	}
+	subConn.receiveLine("APPE 6 /new\r\n")
+	if response := lastResponse(control); response != "226 OK, received 3 bytes" {
+		t.Errorf("APPE to new file: got %q", response)
+	}
+	if content, _ := driver.content("/existing"); content != "Hello, world" {
+		t.Errorf("appended %q", content)
+	}
+	if content, _ := driver.content("/new"); content != "new" {
+		t.Errorf("created %q", content)
+	}
+}
+
+func TestAppeDisabled(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/existing", "Hello, ")
+	subConn, control, session := newTestSubConn(driver, nil)
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("world")}}
+	subConn.connection.server.DisableCommand("APPE")
+
+	subConn.receiveLine("APPE 2 /existing\r\n")
+	if response := lastResponse(control); response != "502 Command not found" {
+		t.Errorf("disabled APPE: got %q", response)
+	}
+	if content, _ := driver.content("/existing"); content != "Hello, " {
+		t.Errorf("appended %q", content)
+	}
+}
+
+// largeFileInfo reports a size above the 32-bit range.
+type largeFileInfo struct {
+	server.FileInfo
+}
+
+func (f largeFileInfo) Size() int64 {
+	return 3<<30 + 7
+}
+
+type largeFileMemDriver struct {
+	*memDriver
+}
+
+func (d largeFileMemDriver) Stat(filePath string) (server.FileInfo, error) {
+	info, err := d.memDriver.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return largeFileInfo{info}, nil
+}
+
+func TestSizeLargeFile(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/large", "")
+	subConn, control, _ := newTestSubConn(largeFileMemDriver{driver}, nil)
+	subConn.receiveLine("SIZE /large\r\n")
+	if response := lastResponse(control); response != "213 3221225479" {
+		t.Errorf("got %q", response)
+	}
+}
+
+func TestMlst(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/file", "data")
+	driver.files["/dir"].modTime = time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	subConn, control, session := newTestSubConn(driver, nil)
+	subConn.namePrefix = "/dir"
+
+	subConn.receiveLine("MLST file\r\n")
+	subConn.receiveLine("MLST /dir\r\n")
+	expected := "250-Listing /dir/file\r\n" +
+		" type=file;size=4;modify=00010101000000; /dir/file\r\n" +
+		"250 End\r\n" +
+		"250-Listing /dir\r\n" +
+		" type=dir;size=0;modify=20180102030405; /dir\r\n" +
+		"250 End\r\n"
+	if result := control.String(); result != expected {
+		t.Errorf("got %q, want %q", result, expected)
+	}
+	subConn.receiveLine("MLST /missing\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "550 ") {
+		t.Errorf("MLST /missing: got %q", response)
+	}
+	if len(session.sendStreams) != 0 {
+		t.Error("MLST opened a data stream")
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/file", "data")
+	subConn, control, session := newTestSubConn(driver, nil)
+
+	subConn.receiveLine("CWD /dir/\r\n")
+	if response := lastResponse(control); response != "250 Directory changed to /dir" {
+		t.Errorf("CWD /dir/: got %q", response)
+	}
+	for _, line := range []string{"RETR /dir/\r\n", "RETR file/\r\n", "STOR 2 /dir/\r\n", "STOR 2 new/\r\n"} {
+		subConn.receiveLine(line)
+		if response := lastResponse(control); response != "550 Is a directory" {
+			t.Errorf("%q: got %q", line, response)
+		}
+	}
+	if len(session.sendStreams) != 0 {
+		t.Error("data stream opened for a trailing-slash path")
+	}
+	if _, err := driver.Stat("/dir/new"); err == nil {
+		t.Error("STOR new/ created a file")
+	}
+}
+
+func TestOptsMlst(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/file", "data")
+	subConn, control, session := newTestSubConn(driver, nil)
+
+	subConn.receiveLine("OPTS MLST Size;perm;type;\r\n")
+	if response := lastResponse(control); response != "200 MLST OPTS size;type;" {
+		t.Errorf("OPTS MLST: got %q", response)
+	}
+	subConn.receiveLine("FEAT\r\n")
+	if lines := responses(control); !strings.Contains(strings.Join(lines, "\n"), "\n MLST type*;size*;modify;create;unique;\n") {
+		t.Errorf("FEAT: got %q", lines)
+	}
+	subConn.receiveLine("MLST /dir/file\r\n")
+	if lines := responses(control); lines[len(lines)-2] != " type=file;size=4; /dir/file" {
+		t.Errorf("MLST: got %q", lines)
+	}
+	subConn.receiveLine("MLSD /dir\r\n")
+	if listing := session.sendStreams[0].String(); listing != "type=file;size=4; file\r\n" {
+		t.Errorf("MLSD: got %q", listing)
+	}
+	subConn.receiveLine("OPTS MLST\r\n")
+	if response := lastResponse(control); response != "200 MLST OPTS" {
+		t.Errorf("OPTS MLST without facts: got %q", response)
+	}
+	subConn.receiveLine("MLST /dir/file\r\n")
+	if lines := responses(control); lines[len(lines)-2] != "  /dir/file" {
+		t.Errorf("MLST without facts: got %q", lines)
+	}
+}
+
+func TestListClientStream(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/file", "data")
+	subConn, control, session := newTestSubConn(driver, &ServerOpts{ClientListStreams: true})
+	listStream := &fakeStream{id: 4}
+	subConn.connection.newSubConn(listStream, driver)
+
+	subConn.receiveLine("NLST 4 /dir\r\n")
+	if response := lastResponse(control); response != "226 Closing data stream, sent 6 bytes" {
+		t.Errorf("NLST 4 /dir: got %q", response)
+	}
+	if listing := listStream.String(); listing != "file\r\n" || !listStream.closed {
+		t.Errorf("client stream: got %q, closed %v", listing, listStream.closed)
+	}
+	if len(session.sendStreams) != 0 {
+		t.Error("server opened a stream for NLST with stream ID")
+	}
+	subConn.receiveLine("LIST 4 /dir\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "425 ") {
+		t.Errorf("LIST on a used stream: got %q", response)
+	}
+	subConn.receiveLine("LIST /dir\r\n")
+	if len(session.sendStreams) != 1 || !strings.HasSuffix(session.sendStreams[0].String(), " file\r\n") {
+		t.Error("LIST without stream ID did not use a server stream")
+	}
+}
+
+func TestListClientStreamServed(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/file", "data")
+	var hookMutex sync.Mutex
+	var hooked []*SubConn
+	subConn, _, session := newTestSubConn(driver, &ServerOpts{
+		ClientListStreams: true,
+		LegalBanner:       "Notice",
+		IdleTimeout:       50 * time.Millisecond,
+		OnNewSubConn: func(subConn *SubConn) {
+			hookMutex.Lock()
+			defer hookMutex.Unlock()
+			hooked = append(hooked, subConn)
+		},
+	})
+	conn := subConn.connection
+	serve := func(id quic.StreamID) (*deadlineStream, *SubConn, chan struct{}) {
+		stream := &deadlineStream{fakeStream: &fakeStream{id: id}, lines: make(chan string)}
+		streamSubConn := conn.newSubConn(stream, driver)
+		conn.runningSubConn++
+		served := make(chan struct{})
+		go func() {
+			streamSubConn.Serve()
+			close(served)
+		}()
+		return stream, streamSubConn, served
+	}
+	conn.runningSubConn = 1
+	listStream, _, listServed := serve(4)
+	control, controlSubConn, controlServed := serve(8)
+
+	control.lines <- "NOOP\r\n"
+	subConn.receiveLine("NLST 4 /dir\r\n")
+	select {
+	case <-listServed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream still read as control stream after NLST")
+	}
+	select {
+	case <-controlServed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("control stream not closed after the idle timeout")
+	}
+	if listing := listStream.String(); listing != "file\r\n" || !listStream.closed {
+		t.Errorf("client stream: got %q, closed %v", listing, listStream.closed)
+	}
+	expected := []string{"220 Notice", "200 OK", "421 Idle timeout, closing control stream"}
+	if lines := responses(control.fakeStream); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("control stream: got %q", lines)
+	}
+	hookMutex.Lock()
+	if len(hooked) != 1 || hooked[0] != controlSubConn {
+		t.Errorf("OnNewSubConn called for %v", hooked)
+	}
+	hookMutex.Unlock()
+	if conn.runningSubConn != 1 || session.closed {
+		t.Errorf("%d SubConns running after the listing", conn.runningSubConn)
+	}
+}
+
+func TestListClientStreamDisabled(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/4")
+	driver.addFile("/4/file", "data")
+	subConn, _, session := newTestSubConn(driver, nil)
+	listStream := &fakeStream{id: 4}
+	subConn.connection.newSubConn(listStream, driver)
+
+	subConn.receiveLine("NLST 4\r\n")
+	if len(session.sendStreams) != 1 || session.sendStreams[0].String() != "file\r\n" {
+		t.Error("NLST 4 did not list the directory 4")
+	}
+	if listStream.String() != "" {
+		t.Error("stream ID used without ClientListStreams")
+	}
+}
+
+func TestStat(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/file", "data")
+	subConn, control, session := newTestSubConn(driver, &ServerOpts{Name: "Test Server"})
+
+	subConn.receiveLine("TYPE A\r\n")
+	subConn.receiveLine("STAT\r\n")
+	expected := []string{
+		"211-Test Server status:",
+		" Connected from 192.0.2.1:4242",
+		" Logged in as admin",
+		" TYPE: ASCII, MODE: STREAM, STRU: FILE",
+		"211 End of status",
+	}
+	if lines := responses(control)[1:]; strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("STAT: got %q", lines)
+	}
+
+	for _, filePath := range []string{"/dir", "/dir/file"} {
+		control.written.Reset()
+		subConn.receiveLine("STAT " + filePath + "\r\n")
+		lines := responses(control)
+		if len(lines) != 3 || lines[0] != "213-Status of "+filePath+":" || !strings.HasSuffix(lines[1], " file") || lines[2] != "213 End of status" {
+			t.Errorf("STAT %s: got %q", filePath, lines)
+		}
+	}
+	subConn.receiveLine("STAT /missing\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "550 ") {
+		t.Errorf("STAT /missing: got %q", response)
+	}
+	if len(session.sendStreams) != 0 {
+		t.Error("STAT opened a data stream")
+	}
+
+	subConn.user = ""
+	subConn.receiveLine("STAT\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "530 ") {
+		t.Errorf("STAT without login: got %q", response)
+	}
+}
+
+// endlessReader returns zeros forever, like a file too large to be sent
+// before the test aborts it.
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+type endlessMemDriver struct {
+	*memDriver
+}
+
+func (d endlessMemDriver) GetFile(filePath string, offset int64) (int64, io.ReadCloser, error) {
+	return 1 << 40, ioutil.NopCloser(endlessReader{}), nil
+}
+
+func TestAbor(t *testing.T) {
+	driver := endlessMemDriver{newMemDriver()}
+	driver.addFile("/large", "")
+	subConn, control, session := newTestSubConn(driver, nil)
+	commands, client := io.Pipe()
+	control.reader = commands
+	served := make(chan struct{})
+	go func() {
+		subConn.Serve()
+		close(served)
+	}()
+
+	client.Write([]byte("RETR /large\r\n"))
+	for !strings.HasPrefix(lastResponse(control), "150 ") {
+		time.Sleep(time.Millisecond)
+	}
+	client.Write([]byte("\xff\xf4\xff\xf2ABOR\r\n"))
+	client.Close()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RETR was not aborted")
+	}
+
+	lines := responses(control)
+	if len(lines) < 2 || lines[len(lines)-2] != "426 Transfer aborted" || lines[len(lines)-1] != "226 Abort successful" {
+		t.Errorf("got %q", lines)
+	}
+	stream := session.sendStreams[0]
+	if stream.cancelCode != ErrorCodeTransferAborted || stream.String() == "" {
+		t.Errorf("data stream reset with %d after %d bytes", stream.cancelCode, len(stream.String()))
+	}
+	if atomic.LoadInt32(&subConn.connection.server.openDataStreams) != 0 {
+		t.Error("data stream slot not released")
+	}
+}
+
+// streamingMemDriver generates the content of every file while it is read,
+// so the size is not known in advance.
+type streamingMemDriver struct {
+	*memDriver
+}
+
+func (d streamingMemDriver) GetFile(filePath string, offset int64) (int64, io.ReadCloser, error) {
+	return server.SizeUnknown, ioutil.NopCloser(strings.NewReader("report of " + filePath)), nil
+}
+
+// streamingDownloadMemDriver opens files without knowing their size.
+type streamingDownloadMemDriver struct {
+	streamingMemDriver
+}
+
+func (d streamingDownloadMemDriver) OpenForDownload(filePath string, offset int64) (server.FileInfo, io.ReadCloser, error) {
+	_, data, err := d.GetFile(filePath, offset)
+	return nil, data, err
+}
+
+func TestRetrUnknownSize(t *testing.T) {
+	drivers := []server.Driver{
+		streamingMemDriver{newMemDriver()},
+		streamingDownloadMemDriver{streamingMemDriver{newMemDriver()}},
+	}
+	for _, driver := range drivers {
+		subConn, control, session := newTestSubConn(driver, &ServerOpts{ProgressInterval: 8})
+		subConn.receiveLine("RETR /report\r\n")
+		expected := []string{
+			"150 3 Data transfer starting",
+			"150 Transferred 8 bytes",
+			"150 Transferred 16 bytes",
+			"226 Closing data stream, sent 17 bytes",
+		}
+		if lines := responses(control); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("%T: got %q", driver, lines)
+		}
+		if data := session.sendStreams[0].String(); data != "report of /report" {
+			t.Errorf("%T: sent %q", driver, data)
+		}
+	}
+}
+
+// modTimeMemDriver is a memDriver able to set modification times.
+type modTimeMemDriver struct {
+	*memDriver
+}
+
+func (d modTimeMemDriver) SetModTime(filePath string, modTime time.Time) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	f, ok := d.files[filePath]
+	if !ok {
+		return os.ErrNotExist
+	}
+	f.modTime = modTime
+	return nil
+}
+
+func TestMdtmSet(t *testing.T) {
+	driver := modTimeMemDriver{newMemDriver()}
+	driver.addFile("/file", "data")
+	driver.addFile("/20180102030405", "data")
+	subConn, control, _ := newTestSubConn(driver, nil)
+
+	subConn.receiveLine("MDTM 20180102030405 file\r\n")
+	if response := lastResponse(control); response != "213 Modification time set to 20180102030405" {
+		t.Errorf("MDTM with timestamp: got %q", response)
+	}
+	subConn.receiveLine("MDTM file\r\n")
+	if response := lastResponse(control); response != "213 20180102030405" {
+		t.Errorf("MDTM after setting the time: got %q", response)
+	}
+	subConn.receiveLine("MDTM 20180102030405\r\n")
+	if response := lastResponse(control); response != "213 00010101000000" {
+		t.Errorf("MDTM of a file named like a timestamp: got %q", response)
+	}
+	subConn.receiveLine("MDTM 20180102030405 missing\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "550 ") {
+		t.Errorf("MDTM with timestamp of a missing file: got %q", response)
+	}
+
+	subConn, control, _ = newTestSubConn(newMemDriver(), nil)
+	subConn.receiveLine("MDTM 20180102030405 file\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "502 ") {
+		t.Errorf("MDTM with timestamp without driver support: got %q", response)
+	}
+}
+
+func TestMfmt(t *testing.T) {
+	driver := modTimeMemDriver{newMemDriver()}
+	driver.addFile("/a file", "data")
+	subConn, control, _ := newTestSubConn(driver, nil)
+
+	subConn.receiveLine("MFMT 20180102030405 a file\r\n")
+	if response := lastResponse(control); response != "213 Modify=20180102030405; a file" {
+		t.Errorf("MFMT: got %q", response)
+	}
+	if info, _ := driver.Stat("/a file"); !info.ModTime().Equal(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("modification time %v", info.ModTime())
+	}
+	for _, line := range []string{"MFMT 2018010203040 a file\r\n", "MFMT 20181302030405 a file\r\n", "MFMT 2018-01-02T03:04 a file\r\n", "MFMT 20180102030405\r\n"} {
+		subConn.receiveLine(line)
+		if response := lastResponse(control); !strings.HasPrefix(response, "501 ") {
+			t.Errorf("%q: got %q", line, response)
+		}
+	}
+}
+
+func TestMaxListsPerMinute(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), &ServerOpts{MaxListsPerMinute: 2})
+	for _, line := range []string{"LIST /", "NLST /"} {
+		subConn.receiveLine(line + "\r\n")
+		if response := lastResponse(control); !strings.HasPrefix(response, "226 ") {
+			t.Errorf("%s: got %q", line, response)
+		}
+	}
+	subConn.receiveLine("MLSD /\r\n")
+	if response := lastResponse(control); response != "450 Too many listings, slow down" {
+		t.Errorf("third listing: got %q", response)
+	}
+
+	// a minute later
+	for i := range subConn.listTimes {
+		subConn.listTimes[i] = subConn.listTimes[i].Add(-time.Minute)
+	}
+	subConn.receiveLine("LIST /\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "226 ") {
+		t.Errorf("after a minute: got %q", response)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"errors"
+	server "github.com/attenberger/ftps_qftp-server"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	errOutsideRoot        = errors.New("Path outside of root")
+	errRealPathNotSupport = errors.New("Driver can not resolve paths")
+	// returned by Serve for ConfineToRoot without a server.RealPathDriver
+	errConfineNeedsRealPath = errors.New("ConfineToRoot needs a driver implementing RealPathDriver")
+)
+
+// confinedDriver checks every path with the drivers RealPath before passing
+// it on, so that symlinks can not lead outside of the root of the driver.
+// It is used for all drivers if the ConfineToRoot option is set. It only
+// implements the methods of server.Driver, the server uses the optional
+// interfaces of the driver it wraps after checking the paths with
+// checkPath, see unwrapDriver.
+type confinedDriver struct {
+	server.Driver
+}
+
+// Unwrap returns the driver d confines.
+func (d confinedDriver) Unwrap() server.Driver {
+	return d.Driver
+}
+
+// unwrapDriver returns the driver whose optional interfaces the server
+// uses: the one a confinedDriver wraps or driver itself. Their methods do
+// not check the paths, so they have to be checked with checkPath first.
+func unwrapDriver(driver server.Driver) server.Driver {
+	if confined, ok := driver.(confinedDriver); ok {
+		return confined.Unwrap()
+	}
+	return driver
+}
+
+// checkPath returns an error, if driver is a confinedDriver and filePath is
+// outside of its root.
+func checkPath(driver server.Driver, filePath string) error {
+	if confined, ok := driver.(confinedDriver); ok {
+		return confined.check(filePath)
+	}
+	return nil
+}
+
+// checkRealPath creates a driver to find out whether the drivers of factory
+// can resolve paths, as ConfineToRoot needs. A failing factory is left to
+// the sessions to report.
+func checkRealPath(factory server.DriverFactory) error {
+	driver, err := factory.NewDriver()
+	if err != nil {
+		return nil
+	}
+	if _, ok := driver.(server.RealPathDriver); !ok {
+		return errConfineNeedsRealPath
+	}
+	return nil
+}
+
+// check resolves filePath or, if it does not exist yet, its closest existing
+// parent and returns an error if that is outside of the root.
+func (d confinedDriver) check(filePath string) error {
+	realPathDriver, ok := d.Driver.(server.RealPathDriver)
+	if !ok {
+		return errRealPathNotSupport
+	}
+	for {
+		realPath, err := realPathDriver.RealPath(filePath)
+		if err == nil {
+			if realPath == ".." || strings.HasPrefix(realPath, "../") || path.IsAbs(realPath) {
+				return errOutsideRoot
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) || filePath == "/" {
+			return err
+		}
+		filePath = path.Dir(filePath)
+	}
+}
+
+func (d confinedDriver) Stat(filePath string) (server.FileInfo, error) {
+	if err := d.check(filePath); err != nil {
+		return nil, err
+	}
+	return d.Driver.Stat(filePath)
+}
+
+func (d confinedDriver) ChangeDir(filePath string) error {
+	if err := d.check(filePath); err != nil {
+		return err
+	}
+	return d.Driver.ChangeDir(filePath)
+}
+
+func (d confinedDriver) ListDir(filePath string, callback func(server.FileInfo) error) error {
+	if err := d.check(filePath); err != nil {
+		return err
+	}
+	return d.Driver.ListDir(filePath, callback)
+}
+
+func (d confinedDriver) DeleteDir(filePath string) error {
+	if err := d.check(filePath); err != nil {
+		return err
+	}
+	return d.Driver.DeleteDir(filePath)
+}
+
+func (d confinedDriver) DeleteFile(filePath string) error {
+	if err := d.check(filePath); err != nil {
+		return err
+	}
+	return d.Driver.DeleteFile(filePath)
+}
+
+func (d confinedDriver) Rename(fromPath string, toPath string) error {
+	if err := d.check(fromPath); err != nil {
+		return err
+	}
+	if err := d.check(toPath); err != nil {
+		return err
+	}
+	return d.Driver.Rename(fromPath, toPath)
+}
+
+func (d confinedDriver) MakeDir(filePath string) error {
+	if err := d.check(filePath); err != nil {
+		return err
+	}
+	return d.Driver.MakeDir(filePath)
+}
+
+func (d confinedDriver) GetFile(filePath string, offset int64) (int64, io.ReadCloser, error) {
+	if err := d.check(filePath); err != nil {
+		return 0, nil, err
+	}
+	return d.Driver.GetFile(filePath, offset)
+}
+
+func (d confinedDriver) PutFile(filePath string, data io.Reader, appendData bool) (int64, error) {
+	if err := d.check(filePath); err != nil {
+		return 0, err
+	}
+	return d.Driver.PutFile(filePath, data, appendData)
+}
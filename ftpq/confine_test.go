@@ -0,0 +1,210 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	server "github.com/attenberger/ftps_qftp-server"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// symlinkMemDriver resolves the paths of a memDriver with symlinks. The
+// targets of the links are relative to the root.
+type symlinkMemDriver struct {
+	*memDriver
+	links map[string]string
+}
+
+func (d symlinkMemDriver) RealPath(filePath string) (string, error) {
+	for link, target := range d.links {
+		if filePath == link || strings.HasPrefix(filePath, link+"/") {
+			return path.Join(target, strings.TrimPrefix(filePath, link)), nil
+		}
+	}
+	if _, err := d.memDriver.Stat(filePath); err != nil {
+		return "", err
+	}
+	if filePath == "/" {
+		return ".", nil
+	}
+	return strings.TrimPrefix(filePath, "/"), nil
+}
+
+func TestConfineToRoot(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/file", "data")
+	// the memDriver has the files of the link targets under the link name
+	driver.addDir("/escape")
+	driver.addFile("/escape/secret", "secret")
+	driver.addDir("/inside")
+	driver.addFile("/inside/file", "data")
+	links := map[string]string{"/escape": "../outside", "/inside": "dir"}
+	subConn, control, session := newTestSubConn(symlinkMemDriver{driver, links}, &ServerOpts{ConfineToRoot: true})
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("data")}, {id: 6, reader: strings.NewReader("data")}}
+
+	refused := map[string]string{
+		"RETR /escape/secret\r\n": "551 ",
+		"LIST /escape\r\n":        "550 ",
+		"CWD /escape\r\n":         "550 ",
+		"MKD /escape/new\r\n":     "550 ",
+		"STOR 2 /escape/new\r\n":  "450 ",
+	}
+	for line, code := range refused {
+		subConn.receiveLine(line)
+		if response := lastResponse(control); !strings.HasPrefix(response, code) {
+			t.Errorf("%q: got %q", line, response)
+		}
+	}
+	if _, ok := driver.content("/escape/new"); ok {
+		t.Error("file created outside of the root")
+	}
+
+	allowed := map[string]string{
+		"RETR /dir/file\r\n":    "226 ",
+		"RETR /inside/file\r\n": "226 ",
+		"CWD /inside\r\n":       "250 ",
+		"MKD /dir/new\r\n":      "257 ",
+		"STOR 6 /dir/up\r\n":    "226 ",
+	}
+	for line, code := range allowed {
+		subConn.receiveLine(line)
+		if response := lastResponse(control); !strings.HasPrefix(response, code) {
+			t.Errorf("%q: got %q", line, response)
+		}
+	}
+}
+
+func TestConfineToRootDisabled(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/escape")
+	driver.addFile("/escape/secret", "secret")
+	links := map[string]string{"/escape": "../outside"}
+	subConn, control, _ := newTestSubConn(symlinkMemDriver{driver, links}, nil)
+	subConn.receiveLine("RETR /escape/secret\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "226 ") {
+		t.Errorf("got %q", response)
+	}
+	if _, ok := subConn.driver.(confinedDriver); ok {
+		t.Error("driver confined without ConfineToRoot")
+	}
+}
+
+func TestConfineToRootUnsupported(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/file", "data")
+	subConn, control, _ := newTestSubConn(driver, &ServerOpts{ConfineToRoot: true})
+	subConn.receiveLine("RETR /file\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "551 ") {
+		t.Errorf("got %q", response)
+	}
+	if _, err := subConn.driver.Stat("/file"); err != errRealPathNotSupport {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := subConn.driver.Stat("/missing"); os.IsNotExist(err) {
+		t.Error("existence of a file revealed")
+	}
+}
+
+// symlinkFactory creates symlinkMemDrivers without links.
+type symlinkFactory struct{}
+
+func (f symlinkFactory) NewDriver() (server.Driver, error) {
+	return symlinkMemDriver{newMemDriver(), nil}, nil
+}
+
+func TestConfineToRootServeUnsupported(t *testing.T) {
+	s := NewServer(&ServerOpts{Factory: memFactory{}, Logger: &server.DiscardLogger{}, ConfineToRoot: true})
+	listener := &fakeListener{}
+	if err := s.Serve(listener); err != errConfineNeedsRealPath {
+		t.Errorf("got %v", err)
+	}
+	if listener.accepts != 0 {
+		t.Error("sessions accepted")
+	}
+
+	s = NewServer(&ServerOpts{Factory: symlinkFactory{}, Logger: &server.DiscardLogger{}, ConfineToRoot: true})
+	if err := s.Serve(&fakeListener{}); err == errConfineNeedsRealPath {
+		t.Error("refused a driver resolving paths")
+	}
+}
+
+// optionalMemDriver implements the optional interfaces, whose paths have to
+// be checked before a confinedDriver uses them, and resolves symlinks like a
+// symlinkMemDriver.
+type optionalMemDriver struct {
+	*syncMemDriver
+	links map[string]string
+}
+
+func (d optionalMemDriver) RealPath(filePath string) (string, error) {
+	return symlinkMemDriver{d.memDriver, d.links}.RealPath(filePath)
+}
+
+func (d optionalMemDriver) OpenForDownload(filePath string, offset int64) (server.FileInfo, io.ReadCloser, error) {
+	info, err := d.Stat(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, data, err := d.GetFile(filePath, offset)
+	return info, data, err
+}
+
+func (d optionalMemDriver) SetModTime(filePath string, modTime time.Time) error {
+	return modTimeMemDriver{d.memDriver}.SetModTime(filePath, modTime)
+}
+
+func (d optionalMemDriver) Chmod(filePath string, mode os.FileMode) error {
+	_, err := d.Stat(filePath)
+	return err
+}
+
+func TestConfineToRootOptional(t *testing.T) {
+	files := newMemDriver()
+	files.addDir("/dir")
+	files.addFile("/dir/file", "data")
+	files.addDir("/escape")
+	files.addFile("/escape/secret", "secret")
+	driver := optionalMemDriver{&syncMemDriver{memDriver: files}, map[string]string{"/escape": "../outside"}}
+	subConn, control, _ := newTestSubConn(driver, &ServerOpts{ConfineToRoot: true})
+	cases := []struct {
+		line string
+		code string
+	}{
+		{"MFMT 20200102030405 /escape/secret", "550 "},
+		{"SITE CHMOD 600 /escape/secret", "550 "},
+		{"SITE SYNC /escape/secret", "550 "},
+		{"RETR /escape/secret", "551 "},
+		{"MFMT 20200102030405 /dir/file", "213 "},
+		{"SITE CHMOD 600 /dir/file", "200 "},
+		{"SITE SYNC /dir/file", "200 "},
+		{"RETR /dir/file", "226 "},
+	}
+	for _, c := range cases {
+		subConn.receiveLine(c.line + "\r\n")
+		if response := lastResponse(control); !strings.HasPrefix(response, c.code) {
+			t.Errorf("%s: got %q", c.line, response)
+		}
+	}
+	if len(driver.synced) != 1 || driver.synced[0] != "/dir/file" {
+		t.Errorf("synced %v", driver.synced)
+	}
+}
+
+func TestConfineToRootUnsupportedOptional(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/file", "data")
+	subConn, control, _ := newTestSubConn(symlinkMemDriver{driver, nil}, &ServerOpts{ConfineToRoot: true})
+	for _, line := range []string{"MFMT 20200102030405 /file", "SITE CHMOD 600 /file", "SITE UMASK 022"} {
+		subConn.receiveLine(line + "\r\n")
+		if response := lastResponse(control); !strings.HasPrefix(response, "502 ") {
+			t.Errorf("%s: got %q", line, response)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package ftpq
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
@@ -15,6 +16,7 @@ import (
 	"github.com/lucas-clemente/quic-go"
 	"io"
 	"sync"
+	"time"
 )
 
 const (
@@ -33,6 +35,12 @@ type Conn struct {
 	server             *Server
 	sessionID          string
 	runningSubConn     int
+	// streams opened by the client without a command sent on them yet,
+	// which can be used for listings with ClientListStreams
+	idleStreams map[quic.StreamID]*SubConn
+	// one element per running transfer if MaxConcurrentTransfersPerSession
+	// is set
+	transferSlots chan struct{}
 }
 
 func (conn *Conn) PublicIp() string {
@@ -46,6 +54,27 @@ func (conn *Conn) passiveListenIP() string {
 	return conn.session.LocalAddr().String()
 }
 
+// acquireTransfer reserves a slot for a transfer of the session. It returns
+// false if MaxConcurrentTransfersPerSession transfers are already running.
+func (conn *Conn) acquireTransfer() bool {
+	if conn.transferSlots == nil {
+		return true
+	}
+	select {
+	case conn.transferSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseTransfer frees a slot reserved by acquireTransfer.
+func (conn *Conn) releaseTransfer() {
+	if conn.transferSlots != nil {
+		<-conn.transferSlots
+	}
+}
+
 // returns a random 20 char string that can be used as a unique session ID
 func newSessionID() string {
 	hash := sha256.New()
@@ -69,11 +98,28 @@ func (conn *Conn) newSubConn(quicStream quic.Stream, driver server.Driver) *SubC
 	subC.controlReader = bufio.NewReader(quicStream)
 	subC.controlWriter = bufio.NewWriter(quicStream)
 	subC.namePrefix = "/"
-	subC.logger = &server.StdLogger{}
+	subC.logger = conn.logger
 	subC.sessionID = conn.sessionID
 	subC.driver = driver
+	subC.ctx, subC.cancel = context.WithCancel(context.Background())
+	if conn.server.ConfineToRoot {
+		subC.driver = confinedDriver{driver}
+	}
+	if conn.server.ClientListStreams {
+		conn.structAccessMutex.Lock()
+		conn.idleStreams[quicStream.StreamID()] = subC
+		conn.structAccessMutex.Unlock()
+	}
+	subC.hashAlgorithm = defaultHashAlgorithm
+	subC.mlstFacts = defaultMlstFacts
+	subC.idleTimeout = int64(conn.server.IdleTimeout)
 
 	//driver.Init(c)
+	// With ClientListStreams the stream might still be taken as data
+	// stream, Serve calls OnNewSubConn with the first command then.
+	if conn.server.OnNewSubConn != nil && !conn.server.ClientListStreams {
+		conn.server.OnNewSubConn(subC)
+	}
 	return subC
 }
 
@@ -83,19 +129,25 @@ func (conn *Conn) newSubConn(quicStream quic.Stream, driver server.Driver) *SubC
 // goroutine, so use this channel to be notified when the connection can be
 // cleaned up.
 func (conn *Conn) Serve() {
-	conn.logger.Print(conn.sessionID, "Connection Established")
+	logEntry(conn.logger, levelInfo, conn.sessionID, "Connection Established",
+		"session", conn.sessionID, "remote", conn.session.RemoteAddr().String())
 
 	for {
 		driver, err := conn.factory.NewDriver()
 		if err != nil {
-			conn.logger.Printf(conn.sessionID, "Error creating driver, aborting client connection: %v", err)
+			logEntry(conn.logger, levelError, conn.sessionID, fmt.Sprintf("Error creating driver, aborting client connection: %v", err),
+				"session", conn.sessionID, "error", err)
 			conn.Close()
 			return
 		}
 
 		controlStream, err := conn.session.AcceptStream()
-		if err != nil && err.Error() != "NO_ERROR" {
-			conn.logger.Print(conn.sessionID, fmt.Sprint("Error while accepting control stream, aborting client connection:", err))
+		if err != nil {
+			// NO_ERROR is the session closed regularly by either side.
+			if err.Error() != "NO_ERROR" {
+				logEntry(conn.logger, levelWarn, conn.sessionID, fmt.Sprint("Error while accepting control stream, aborting client connection:", err),
+					"session", conn.sessionID, "error", err)
+			}
 			conn.Close()
 			return
 		}
@@ -118,45 +170,115 @@ func (conn *Conn) Close() {
 // It is used to close the connection after all subconnections are closed.
 func (conn *Conn) ReportSubConnFinsihed() {
 	conn.structAccessMutex.Lock()
+	defer conn.structAccessMutex.Unlock()
 	conn.runningSubConn--
 	if conn.runningSubConn == 0 {
 		conn.Close()
-		conn.logger.Print(conn.sessionID, "Connection Terminated")
-		return
+		logEntry(conn.logger, levelInfo, conn.sessionID, "Connection Terminated", "session", conn.sessionID)
 	}
-	conn.structAccessMutex.Unlock()
 }
 
+var errTooManyDataStreams = errors.New("Too many open data streams")
+
 // Accepts datastreams and returns the stream with the wanted ID.
+// The caller has to call server.releaseDataStream after the transfer if no
+// error is returned.
 func (conn *Conn) getReceiveDataStream(streamID quic.StreamID) (quic.ReceiveStream, error) {
 	conn.structAccessMutex.Lock()
 	defer conn.structAccessMutex.Unlock()
+	if !conn.server.acquireDataStream() {
+		return nil, errTooManyDataStreams
+	}
 	stream, available := conn.dataReceiveStreams[streamID]
 	if available {
+		delete(conn.dataReceiveStreams, streamID)
 		return stream, nil
 	} else {
 		for {
 			stream, err := conn.session.AcceptUniStream()
 			if err != nil {
+				conn.server.releaseDataStream()
 				return nil, err
 			}
+			if stream.StreamID() == streamID {
+				return stream, nil
+			}
 			conn.dataReceiveStreams[stream.StreamID()] = stream
 			if stream.StreamID() > streamID {
+				conn.server.releaseDataStream()
 				return nil, errors.New("Could not get wanted stream.")
-			} else if stream.StreamID() == streamID {
-				return stream, nil
 			}
 		}
 	}
 }
 
-// Opens a new datastream.
+// Opens a new datastream. The slot reserved for it is released when the
+// stream is closed.
 func (conn *Conn) getNewSendDataStream() (quic.SendStream, error) {
 	conn.structAccessMutex.Lock()
 	defer conn.structAccessMutex.Unlock()
+	if !conn.server.acquireDataStream() {
+		return nil, errTooManyDataStreams
+	}
 	stream, err := conn.session.OpenUniStreamSync()
 	if err != nil {
+		conn.server.releaseDataStream()
 		return nil, err
 	}
-	return stream, nil
+	return &dataSendStream{SendStream: stream, server: conn.server}, nil
+}
+
+// getClientSendDataStream returns the stream with the given ID opened by
+// the client, if no command has been sent on it, to send data over it. The
+// stream is no longer used as control stream afterwards, its SubConn stops
+// reading commands and is not counted as running any more. The slot
+// reserved for it is released when the stream is closed.
+func (conn *Conn) getClientSendDataStream(streamID quic.StreamID) (quic.SendStream, error) {
+	conn.structAccessMutex.Lock()
+	defer conn.structAccessMutex.Unlock()
+	subConn, available := conn.idleStreams[streamID]
+	if !available {
+		return nil, errors.New("Could not get wanted stream.")
+	}
+	if !conn.server.acquireDataStream() {
+		return nil, errTooManyDataStreams
+	}
+	delete(conn.idleStreams, streamID)
+	subConn.claimed = true
+	// Ends a read of readLines, which stops when it sees claimed.
+	subConn.controlStream.SetReadDeadline(time.Now())
+	// The SubConn listing over the stream is still running, so the
+	// session stays open.
+	conn.runningSubConn--
+	return &dataSendStream{SendStream: subConn.controlStream, server: conn.server}, nil
+}
+
+// useControlStream is called before a command received on the control
+// stream of subConn is executed or a reply is sent without command. It
+// reports false if the stream has been taken as data stream.
+func (conn *Conn) useControlStream(subConn *SubConn) bool {
+	conn.structAccessMutex.Lock()
+	defer conn.structAccessMutex.Unlock()
+	delete(conn.idleStreams, subConn.controlStream.StreamID())
+	return !subConn.claimed
+}
+
+// isClaimed reports whether the control stream of subConn has been taken as
+// data stream.
+func (conn *Conn) isClaimed(subConn *SubConn) bool {
+	conn.structAccessMutex.Lock()
+	defer conn.structAccessMutex.Unlock()
+	return subConn.claimed
+}
+
+// dataSendStream releases its data stream slot when it is closed.
+type dataSendStream struct {
+	quic.SendStream
+	server *Server
+	once   sync.Once
+}
+
+func (stream *dataSendStream) Close() error {
+	stream.once.Do(stream.server.releaseDataStream)
+	return stream.SendStream.Close()
 }
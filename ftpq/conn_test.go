@@ -0,0 +1,108 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMaxTotalDataStreams(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/file", "data")
+	subConn, control, _ := newTestSubConn(driver, &ServerOpts{MaxTotalDataStreams: 2})
+	conn := subConn.connection
+
+	first, err := conn.getNewSendDataStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.getNewSendDataStream(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.getNewSendDataStream(); err != errTooManyDataStreams {
+		t.Fatalf("expected errTooManyDataStreams, got %v", err)
+	}
+
+	subConn.receiveLine("RETR /file\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "425 ") {
+		t.Errorf("RETR beyond the limit: got %q", response)
+	}
+
+	first.Close()
+	first.Close()
+	subConn.receiveLine("RETR /file\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "226 ") {
+		t.Errorf("RETR after a stream was closed: got %q", response)
+	}
+	if len(conn.server.dataStreamSlots) != 1 {
+		t.Errorf("%d slots in use after the transfer, want 1", len(conn.server.dataStreamSlots))
+	}
+}
+
+// blockingMemDriver blocks GetFile until release is closed.
+type blockingMemDriver struct {
+	*memDriver
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d blockingMemDriver) GetFile(filePath string, offset int64) (int64, io.ReadCloser, error) {
+	d.started <- struct{}{}
+	<-d.release
+	return d.memDriver.GetFile(filePath, offset)
+}
+
+func TestMaxConcurrentTransfersPerSession(t *testing.T) {
+	driver := blockingMemDriver{newMemDriver(), make(chan struct{}), make(chan struct{})}
+	driver.addFile("/file", "data")
+	first, firstControl, _ := newTestSubConn(driver, &ServerOpts{MaxConcurrentTransfersPerSession: 1})
+	secondControl := &fakeStream{id: 4}
+	second := first.connection.newSubConn(secondControl, driver)
+	second.user = "admin"
+
+	done := make(chan struct{})
+	go func() {
+		first.receiveLine("RETR /file\r\n")
+		close(done)
+	}()
+	<-driver.started
+	second.receiveLine("RETR /file\r\n")
+	if response := lastResponse(secondControl); response != "425 Too many concurrent transfers" {
+		t.Errorf("second RETR: got %q", response)
+	}
+	second.receiveLine("PWD\r\n")
+	if response := lastResponse(secondControl); !strings.HasPrefix(response, "257 ") {
+		t.Errorf("PWD during a transfer: got %q", response)
+	}
+	close(driver.release)
+	<-done
+	if response := lastResponse(firstControl); !strings.HasPrefix(response, "226 ") {
+		t.Errorf("first RETR: got %q", response)
+	}
+
+	go func() { <-driver.started }()
+	second.receiveLine("RETR /file\r\n")
+	if response := lastResponse(secondControl); !strings.HasPrefix(response, "226 ") {
+		t.Errorf("RETR after the first finished: got %q", response)
+	}
+}
+
+func TestOnNewSubConn(t *testing.T) {
+	var hooked []*SubConn
+	subConn, _, _ := newTestSubConn(newMemDriver(), &ServerOpts{
+		OnNewSubConn: func(subConn *SubConn) {
+			hooked = append(hooked, subConn)
+		},
+	})
+	second := subConn.connection.newSubConn(&fakeStream{id: 4}, newMemDriver())
+	if len(hooked) != 2 || hooked[0] != subConn || hooked[1] != second {
+		t.Fatalf("hook called for %v", hooked)
+	}
+	if second.ControlStreamID() != 4 || second.SessionID() != subConn.connection.sessionID || second.LoginUser() != "" {
+		t.Errorf("unexpected getter results %d %q %q", second.ControlStreamID(), second.SessionID(), second.LoginUser())
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"context"
+	server "github.com/attenberger/ftps_qftp-server"
+	"io"
+)
+
+// statContext calls StatContext of the driver or, if it does not implement
+// server.ContextDriver, Stat. The helpers of this file use the driver a
+// confinedDriver wraps after checking the path, see unwrapDriver.
+func statContext(ctx context.Context, driver server.Driver, path string) (server.FileInfo, error) {
+	if contextDriver, ok := unwrapDriver(driver).(server.ContextDriver); ok {
+		if err := checkPath(driver, path); err != nil {
+			return nil, err
+		}
+		return contextDriver.StatContext(ctx, path)
+	}
+	return driver.Stat(path)
+}
+
+// listDirContext calls ListDirContext of the driver or, if it does not
+// implement server.ContextDriver, ListDir.
+func listDirContext(ctx context.Context, driver server.Driver, path string, callback func(server.FileInfo) error) error {
+	if contextDriver, ok := unwrapDriver(driver).(server.ContextDriver); ok {
+		if err := checkPath(driver, path); err != nil {
+			return err
+		}
+		return contextDriver.ListDirContext(ctx, path, callback)
+	}
+	return driver.ListDir(path, callback)
+}
+
+// getFileContext calls GetFileContext of the driver or, if it does not
+// implement server.ContextDriver, GetFile.
+func getFileContext(ctx context.Context, driver server.Driver, path string, offset int64) (int64, io.ReadCloser, error) {
+	if contextDriver, ok := unwrapDriver(driver).(server.ContextDriver); ok {
+		if err := checkPath(driver, path); err != nil {
+			return 0, nil, err
+		}
+		return contextDriver.GetFileContext(ctx, path, offset)
+	}
+	return driver.GetFile(path, offset)
+}
+
+// putFileContext calls PutFileContext of the driver or, if it does not
+// implement server.ContextDriver, PutFile.
+func putFileContext(ctx context.Context, driver server.Driver, path string, data io.Reader, appendData bool) (int64, error) {
+	if contextDriver, ok := unwrapDriver(driver).(server.ContextDriver); ok {
+		if err := checkPath(driver, path); err != nil {
+			return 0, err
+		}
+		return contextDriver.PutFileContext(ctx, path, data, appendData)
+	}
+	return driver.PutFile(path, data, appendData)
+}
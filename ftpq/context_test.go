@@ -0,0 +1,139 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"context"
+	server "github.com/attenberger/ftps_qftp-server"
+	"io"
+	"strings"
+	"testing"
+)
+
+// contextMemDriver blocks PutFileContext until its context is canceled and
+// counts the calls of the other context methods.
+type contextMemDriver struct {
+	*memDriver
+	started chan struct{}
+	calls   int
+}
+
+func (d *contextMemDriver) StatContext(ctx context.Context, filePath string) (server.FileInfo, error) {
+	d.calls++
+	return d.memDriver.Stat(filePath)
+}
+
+func (d *contextMemDriver) ListDirContext(ctx context.Context, dir string, callback func(server.FileInfo) error) error {
+	d.calls++
+	return d.memDriver.ListDir(dir, callback)
+}
+
+func (d *contextMemDriver) GetFileContext(ctx context.Context, filePath string, offset int64) (int64, io.ReadCloser, error) {
+	d.calls++
+	return d.memDriver.GetFile(filePath, offset)
+}
+
+func (d *contextMemDriver) PutFileContext(ctx context.Context, filePath string, data io.Reader, appendData bool) (int64, error) {
+	close(d.started)
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestContextDriver(t *testing.T) {
+	driver := &contextMemDriver{memDriver: newMemDriver(), started: make(chan struct{})}
+	driver.addFile("/file", "data")
+	subConn, control, _ := newTestSubConn(driver, nil)
+	subConn.receiveLine("LIST /\r\n")
+	subConn.receiveLine("RETR /file\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "226 ") {
+		t.Errorf("RETR: got %q", response)
+	}
+	if driver.calls != 3 {
+		t.Errorf("context methods called %d times, want 3", driver.calls)
+	}
+}
+
+func TestContextDriverCanceled(t *testing.T) {
+	driver := &contextMemDriver{memDriver: newMemDriver(), started: make(chan struct{})}
+	subConn, control, session := newTestSubConn(driver, nil)
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("data")}}
+	done := make(chan struct{})
+	client, clientEnd := io.Pipe()
+	control.reader = client
+	go func() {
+		subConn.Serve()
+		close(done)
+	}()
+	clientEnd.Write([]byte("STOR 2 /file\r\n"))
+	<-driver.started
+	// The client goes away while the driver is still busy.
+	clientEnd.Close()
+	<-done
+	if response := lastResponse(control); response != "426 Transfer aborted" {
+		t.Errorf("got %q", response)
+	}
+}
+
+// slowOpenMemDriver blocks GetFileContext until its context is canceled.
+type slowOpenMemDriver struct {
+	*contextMemDriver
+}
+
+func (d slowOpenMemDriver) GetFileContext(ctx context.Context, filePath string, offset int64) (int64, io.ReadCloser, error) {
+	close(d.started)
+	<-ctx.Done()
+	return 0, nil, ctx.Err()
+}
+
+func TestContextDriverAbortOpen(t *testing.T) {
+	driver := slowOpenMemDriver{&contextMemDriver{memDriver: newMemDriver(), started: make(chan struct{})}}
+	driver.addFile("/file", "data")
+	subConn, control, _ := newTestSubConn(driver, nil)
+	done := make(chan struct{})
+	go func() {
+		subConn.receiveLine("RETR /file\r\n")
+		close(done)
+	}()
+	<-driver.started
+	// like readLines on ABOR
+	subConn.abortTransfer()
+	<-done
+	if response := lastResponse(control); response != "426 Transfer aborted" {
+		t.Errorf("got %q", response)
+	}
+}
+
+// realPathContextMemDriver is a contextMemDriver for ConfineToRoot.
+type realPathContextMemDriver struct {
+	*contextMemDriver
+}
+
+func (d realPathContextMemDriver) RealPath(filePath string) (string, error) {
+	return symlinkMemDriver{memDriver: d.memDriver}.RealPath(filePath)
+}
+
+func TestContextDriverAbortRestart(t *testing.T) {
+	driver := realPathContextMemDriver{&contextMemDriver{memDriver: newMemDriver(), started: make(chan struct{})}}
+	driver.addFile("/file", "data")
+	// The confinedDriver passes the context on as well.
+	subConn, control, session := newTestSubConn(driver, &ServerOpts{ConfineToRoot: true})
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("more")}}
+	subConn.receiveLine("REST 4\r\n")
+	done := make(chan struct{})
+	go func() {
+		subConn.receiveLine("STOR 2 /file\r\n")
+		close(done)
+	}()
+	select {
+	case <-driver.started:
+	case <-done:
+		t.Fatalf("PutFileContext not called: %q", lastResponse(control))
+	}
+	subConn.abortTransfer()
+	<-done
+	if response := lastResponse(control); response != "426 Transfer aborted" {
+		t.Errorf("got %q", response)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	server "github.com/attenberger/ftps_qftp-server"
+	"os"
+)
+
+// ErrorCategory classifies the errors reported to clients, so that a
+// ServerOpts.ResponseCodeMapper can choose their response codes.
+type ErrorCategory int
+
+const (
+	// ErrorOther is any error not covered by another category.
+	ErrorOther ErrorCategory = iota
+	// ErrorNotFound is reported if a path does not exist.
+	ErrorNotFound
+	// ErrorPermission is reported if the driver denied the access.
+	ErrorPermission
+	// ErrorExists is reported if a path exists already.
+	ErrorExists
+	// ErrorQuotaExceeded is reported if an upload exceeded the quota.
+	ErrorQuotaExceeded
+)
+
+var errorCategoryNames = map[ErrorCategory]string{
+	ErrorOther:         "other",
+	ErrorNotFound:      "not found",
+	ErrorPermission:    "permission",
+	ErrorExists:        "exists",
+	ErrorQuotaExceeded: "quota exceeded",
+}
+
+func (c ErrorCategory) String() string {
+	if name, ok := errorCategoryNames[c]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// errorCategory returns the category of an error returned by a driver.
+func errorCategory(err error) ErrorCategory {
+	switch {
+	case err == server.ErrQuotaExceeded:
+		return ErrorQuotaExceeded
+	case os.IsNotExist(err):
+		return ErrorNotFound
+	case os.IsPermission(err):
+		return ErrorPermission
+	case os.IsExist(err):
+		return ErrorExists
+	}
+	return ErrorOther
+}
+
+// writeError reports err, which the driver returned for the current
+// command, with code and message, unless the ResponseCodeMapper of the
+// server chooses others for its category.
+func (subConn *SubConn) writeError(code int, message string, err error) (int, error) {
+	return subConn.writeErrorCategory(errorCategory(err), code, message)
+}
+
+// writeErrorCategory reports an error of category with code and message,
+// unless the ResponseCodeMapper of the server chooses others.
+func (subConn *SubConn) writeErrorCategory(category ErrorCategory, code int, message string) (int, error) {
+	if mapper := subConn.connection.server.ResponseCodeMapper; mapper != nil {
+		code, message = mapper(category, subConn.command, code, message)
+	}
+	return subConn.writeMessage(code, message)
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"errors"
+	server "github.com/attenberger/ftps_qftp-server"
+	"os"
+	"testing"
+)
+
+func TestErrorCategory(t *testing.T) {
+	cases := []struct {
+		err      error
+		category ErrorCategory
+	}{
+		{os.ErrNotExist, ErrorNotFound},
+		{&os.PathError{Op: "open", Path: "/file", Err: os.ErrPermission}, ErrorPermission},
+		{os.ErrExist, ErrorExists},
+		{server.ErrQuotaExceeded, ErrorQuotaExceeded},
+		{errors.New("disk on fire"), ErrorOther},
+	}
+	for _, c := range cases {
+		if category := errorCategory(c.err); category != c.category {
+			t.Errorf("%v: got %v, want %v", c.err, category, c.category)
+		}
+	}
+}
+
+func TestResponseCodeMapper(t *testing.T) {
+	mapper := func(category ErrorCategory, command string, code int, message string) (int, string) {
+		switch {
+		case category == ErrorNotFound && (command == "DELE" || command == "RETR"):
+			return 450, "No such file"
+		case category == ErrorExists && command == "RNTO":
+			return 553, "Name taken"
+		}
+		return code, message
+	}
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/a", "a")
+	driver.addFile("/b", "b")
+	subConn, control, _ := newTestSubConn(driver, &ServerOpts{ResponseCodeMapper: mapper})
+	cases := []struct {
+		line     string
+		response string
+	}{
+		{"DELE /missing", "450 No such file"},
+		{"CWD /missing", "550 Directory change to /missing failed: file does not exist"},
+		{"RETR /missing", "450 No such file"},
+		{"RNFR /a", "350 Requested file action pending further information."},
+		{"RNTO /b", "553 Name taken"},
+	}
+	for _, c := range cases {
+		subConn.receiveLine(c.line + "\r\n")
+		if response := lastResponse(control); response != c.response {
+			t.Errorf("%s: got %q, want %q", c.line, response, c.response)
+		}
+	}
+
+	subConn, control, _ = newTestSubConn(driver, nil)
+	subConn.receiveLine("DELE /missing\r\n")
+	if response := lastResponse(control); response != "550 File delete failed: file does not exist" {
+		t.Errorf("without mapper: got %q", response)
+	}
+}
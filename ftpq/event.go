@@ -0,0 +1,124 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"strings"
+	"time"
+)
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// EventConnect is sent when a session is accepted.
+	EventConnect EventType = iota
+	// EventLogin is sent when a user logged in with PASS.
+	EventLogin
+	// EventCommand is sent when a command was answered.
+	EventCommand
+	// EventTransfer is sent when APPE, RETR, STOR or STOU finished
+	// successfully, after the EventCommand of the command.
+	EventTransfer
+	// EventDisconnect is sent when a session ended.
+	EventDisconnect
+)
+
+var eventTypeNames = map[EventType]string{
+	EventConnect:    "connect",
+	EventLogin:      "login",
+	EventCommand:    "command",
+	EventTransfer:   "transfer",
+	EventDisconnect: "disconnect",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Event describes something that happened on the server, see
+// ServerOpts.Events.
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	SessionID  string
+	RemoteAddr string
+	// the control stream, 0 for EventConnect and EventDisconnect
+	StreamID quic.StreamID
+	User     string
+	// in upper case, only set for EventCommand and EventTransfer
+	Command string
+	// the parameter of Command, "****" for PASS
+	Param string
+	// the response code of Command
+	Code int
+	// bytes transferred over data streams by Command
+	Bytes int64
+}
+
+// emit sends event to the Events channel without blocking. It is dropped if
+// the channel is full.
+func (server *Server) emit(event Event) {
+	if server.Events == nil {
+		return
+	}
+	event.Time = time.Now()
+	select {
+	case server.Events <- event:
+	default:
+	}
+}
+
+// emitConnEvent sends an event of the given type about the session of conn.
+func (server *Server) emitConnEvent(eventType EventType, conn *Conn) {
+	if server.Events == nil {
+		return
+	}
+	server.emit(Event{
+		Type:       eventType,
+		SessionID:  conn.sessionID,
+		RemoteAddr: conn.session.RemoteAddr().String(),
+	})
+}
+
+// emitEvent sends an event of the given type about the control stream of
+// subConn. For EventCommand and EventTransfer it describes the command just
+// executed.
+func (subConn *SubConn) emitEvent(eventType EventType, command string, param string) {
+	if subConn.connection.server.Events == nil {
+		return
+	}
+	command = strings.ToUpper(command)
+	if command == "PASS" {
+		param = "****"
+	}
+	event := Event{
+		Type:       eventType,
+		SessionID:  subConn.sessionID,
+		RemoteAddr: subConn.connection.session.RemoteAddr().String(),
+		StreamID:   subConn.controlStream.StreamID(),
+		User:       subConn.user,
+	}
+	if eventType == EventCommand || eventType == EventTransfer {
+		event.Command = command
+		event.Param = param
+		event.Code = subConn.lastResponseCode
+		event.Bytes = subConn.transferredBytes
+	}
+	subConn.connection.server.emit(event)
+}
+
+// emitCommandEvents sends the EventCommand of an executed command and, if it
+// completed a transfer, its EventTransfer.
+func (subConn *SubConn) emitCommandEvents(command string, param string) {
+	subConn.emitEvent(EventCommand, command, param)
+	if transferCommands[strings.ToUpper(command)] && subConn.lastResponseCode == 226 {
+		subConn.emitEvent(EventTransfer, command, param)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	server "github.com/attenberger/ftps_qftp-server"
+	"github.com/lucas-clemente/quic-go"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receiveEvents returns the events in the channel.
+func receiveEvents(events chan Event) []Event {
+	var received []Event
+	for {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		default:
+			return received
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	events := make(chan Event, 10)
+	subConn, _, session := newTestSubConn(newMemDriver(), &ServerOpts{Events: events})
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("data")}}
+	subConn.receiveLine("USER admin\r\n")
+	subConn.receiveLine("PASS secret\r\n")
+	subConn.receiveLine("STOR 2 /file\r\n")
+
+	expected := []Event{
+		{Type: EventCommand, Command: "USER", Param: "admin", Code: 331},
+		{Type: EventLogin, User: "admin"},
+		{Type: EventCommand, User: "admin", Command: "PASS", Param: "****", Code: 230},
+		{Type: EventCommand, User: "admin", Command: "STOR", Param: "2 /file", Code: 226, Bytes: 4},
+		{Type: EventTransfer, User: "admin", Command: "STOR", Param: "2 /file", Code: 226, Bytes: 4},
+	}
+	received := receiveEvents(events)
+	if len(received) != len(expected) {
+		t.Fatalf("got %v", received)
+	}
+	for i, event := range received {
+		if event.Time.IsZero() || event.SessionID != subConn.sessionID {
+			t.Errorf("event %d: time %v, session %q", i, event.Time, event.SessionID)
+		}
+		event.Time = time.Time{}
+		event.SessionID = ""
+		event.RemoteAddr = ""
+		event.StreamID = 0
+		if event != expected[i] {
+			t.Errorf("event %d: got %+v, want %+v", i, event, expected[i])
+		}
+	}
+}
+
+func TestEventsDropped(t *testing.T) {
+	events := make(chan Event, 1)
+	subConn, control, _ := newTestSubConn(newMemDriver(), &ServerOpts{Events: events})
+	subConn.receiveLine("NOOP\r\n")
+	subConn.receiveLine("PWD\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "257 ") {
+		t.Errorf("got %q", response)
+	}
+	received := receiveEvents(events)
+	if len(received) != 1 || received[0].Command != "NOOP" {
+		t.Errorf("got %v", received)
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+	events := make(chan Event, 10)
+	s := NewServer(&ServerOpts{Factory: memFactory{}, Logger: &server.DiscardLogger{}, Events: events})
+	session := newIdleSession()
+	s.Serve(&fakeListener{sessions: []quic.Session{session}})
+	if event := <-events; event.Type != EventConnect {
+		t.Errorf("got %v", event.Type)
+	}
+	session.Close()
+	select {
+	case event := <-events:
+		if event.Type != EventDisconnect {
+			t.Errorf("got %v", event.Type)
+		}
+	case <-time.After(time.Second):
+		t.Error("no disconnect event")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	server "github.com/attenberger/ftps_qftp-server"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+const defaultHashAlgorithm = "SHA-256"
+
+// hashAlgorithm is a checksum algorithm of the HASH extension
+// (draft-bryan-ftpext-hash).
+type hashAlgorithm struct {
+	name string
+	new  func() hash.Hash
+}
+
+// hashAlgorithms are the supported checksum algorithms in the order they
+// are advertised in FEAT.
+var hashAlgorithms = []hashAlgorithm{
+	{"SHA-256", sha256.New},
+	{"SHA-1", sha1.New},
+	{"CRC32", func() hash.Hash { return crc32.NewIEEE() }},
+	{"MD5", md5.New},
+}
+
+// findHashAlgorithm looks up a supported algorithm ignoring case.
+func findHashAlgorithm(name string) (hashAlgorithm, bool) {
+	for _, algorithm := range hashAlgorithms {
+		if strings.EqualFold(algorithm.name, name) {
+			return algorithm, true
+		}
+	}
+	return hashAlgorithm{}, false
+}
+
+// hashFeat returns the FEAT line of the HASH extension listing all
+// supported algorithms, the selected one marked with an asterisk.
+func hashFeat(selected string) string {
+	names := make([]string, len(hashAlgorithms))
+	for i, algorithm := range hashAlgorithms {
+		names[i] = algorithm.name
+		if algorithm.name == selected {
+			names[i] += "*"
+		}
+	}
+	return "HASH " + strings.Join(names, ";")
+}
+
+// commandHash responds to the HASH FTP command. It returns the checksum of
+// a file computed with the algorithm selected with OPTS HASH, like
+// "213 SHA-256 0-42 9f86d0... file". The range is given as offset of the
+// first byte and offset after the last byte.
+type commandHash struct{}
+
+func (cmd commandHash) IsExtend() bool {
+	return false
+}
+
+func (cmd commandHash) RequireParam() bool {
+	return true
+}
+
+func (cmd commandHash) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandHash) Execute(subConn *SubConn, param string) {
+	path := subConn.buildPath(param)
+	info, err := subConn.driver.Stat(path)
+	if err != nil {
+		subConn.writeError(550, fmt.Sprint("File not available: ", err), err)
+		return
+	}
+	if info.IsDir() {
+		subConn.writeMessage(553, "Not a file")
+		return
+	}
+	var start, end int64 = 0, info.Size()
+	sum, err := checksum(subConn.driver, path, subConn.hashAlgorithm, start, end)
+	if err != nil {
+		subConn.writeError(550, fmt.Sprint("Could not compute checksum: ", err), err)
+		return
+	}
+	subConn.writeMessage(213, fmt.Sprintf("%s %d-%d %s %s", subConn.hashAlgorithm, start, end, hex.EncodeToString(sum), param))
+}
+
+// checksum computes the checksum of the range from start to end of a file
+// with the drivers Checksum or, if it does not implement
+// server.ChecksumDriver, by reading the range with GetFile.
+func checksum(driver server.Driver, path string, algorithmName string, start int64, end int64) ([]byte, error) {
+	if checksumDriver, ok := unwrapDriver(driver).(server.ChecksumDriver); ok {
+		if err := checkPath(driver, path); err != nil {
+			return nil, err
+		}
+		return checksumDriver.Checksum(path, algorithmName, start, end)
+	}
+	algorithm, ok := findHashAlgorithm(algorithmName)
+	if !ok {
+		return nil, fmt.Errorf("Unknown algorithm %s", algorithmName)
+	}
+	_, data, err := driver.GetFile(path, start)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	hash := algorithm.new()
+	if _, err := io.CopyN(hash, data, end-start); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
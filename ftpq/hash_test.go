@@ -0,0 +1,93 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestHashFeat(t *testing.T) {
+	if result := hashFeat(defaultHashAlgorithm); result != "HASH SHA-256*;SHA-1;CRC32;MD5" {
+		t.Errorf("got %q", result)
+	}
+	var names []string
+	for _, algorithm := range hashAlgorithms {
+		names = append(names, algorithm.name)
+	}
+	if result := hashFeat("MD5"); result != "HASH "+strings.Join(names[:len(names)-1], ";")+";MD5*" {
+		t.Errorf("got %q", result)
+	}
+}
+
+func TestOptsHash(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), nil)
+	cases := []struct {
+		line     string
+		response string
+	}{
+		{"OPTS HASH", "200 SHA-256"},
+		{"OPTS HASH md5", "200 MD5"},
+		{"OPTS HASH FOO", "501 Unknown algorithm, current selection not changed"},
+		{"OPTS HASH", "200 MD5"},
+		{"OPTS UTF8 ON", "200 UTF8 mode enabled"},
+	}
+	for _, c := range cases {
+		subConn.receiveLine(c.line + "\r\n")
+		if response := lastResponse(control); response != c.response {
+			t.Errorf("%s: got %q, want %q", c.line, response, c.response)
+		}
+	}
+}
+
+// checksumMemDriver returns a fixed checksum for every file.
+type checksumMemDriver struct {
+	*memDriver
+}
+
+func (d checksumMemDriver) Checksum(filePath string, algorithm string, start int64, end int64) ([]byte, error) {
+	if algorithm != "CRC32" || start != 0 || end != 4 {
+		return nil, errors.New("unexpected arguments")
+	}
+	return []byte{0xca, 0xfe}, nil
+}
+
+func TestHash(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/file", "data")
+	subConn, control, _ := newTestSubConn(driver, nil)
+	subConn.namePrefix = "/dir"
+
+	cases := []struct {
+		line     string
+		response string
+	}{
+		{"HASH file", "213 SHA-256 0-4 3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7 file"},
+		{"OPTS HASH MD5", "200 MD5"},
+		{"HASH /dir/file", "213 MD5 0-4 8d777f385d3dfec8815d20f7496026dc /dir/file"},
+		{"OPTS HASH CRC32", "200 CRC32"},
+		{"HASH file", "213 CRC32 0-4 adf3f363 file"},
+		{"HASH /dir", "553 Not a file"},
+	}
+	for _, c := range cases {
+		subConn.receiveLine(c.line + "\r\n")
+		if response := lastResponse(control); response != c.response {
+			t.Errorf("%s: got %q, want %q", c.line, response, c.response)
+		}
+	}
+	subConn.receiveLine("HASH missing\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "550 ") {
+		t.Errorf("HASH missing: got %q", response)
+	}
+
+	subConn, control, _ = newTestSubConn(checksumMemDriver{driver}, nil)
+	subConn.receiveLine("OPTS HASH CRC32\r\n")
+	subConn.receiveLine("HASH /dir/file\r\n")
+	if response := lastResponse(control); response != "213 CRC32 0-4 cafe /dir/file" {
+		t.Errorf("HASH with driver support: got %q", response)
+	}
+}
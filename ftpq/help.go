@@ -0,0 +1,104 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	server "github.com/attenberger/ftps_qftp-server"
+	"strings"
+)
+
+// helpColumns is the number of command names per line of the HELP listing.
+const helpColumns = 8
+
+// Helper can be implemented by a Command to describe itself in the response
+// to HELP <command>. Commands without it are looked up in helpTexts.
+type Helper interface {
+	Help() string
+}
+
+// helpTexts describes the built-in commands for HELP <command>.
+var helpTexts = map[string]string{
+	"ABOR":  "ABOR: abort the running transfer",
+	"ALLO":  "ALLO <size>: allocate storage (ignored)",
+	"APPE":  "APPE <stream-id> <path>: append to a file",
+	"CDUP":  "CDUP: change to the parent directory",
+	"CWD":   "CWD <path>: change the working directory",
+	"DELE":  "DELE <path>: delete a file",
+	"FEAT":  "FEAT: list the supported extensions",
+	"HASH":  "HASH <path>: return the checksum of a file",
+	"HELLO": "HELLO: return the greeting message",
+	"HELP":  "HELP [<command>]: list the commands or describe one",
+	"LIST":  "LIST [<stream-id>] [<path>]: list a directory",
+	"MDTM":  "MDTM [<time>] <path>: return or set the modification time",
+	"MFMT":  "MFMT <time> <path>: set the modification time",
+	"MKD":   "MKD <path>: make a directory",
+	"MLSD":  "MLSD [<path>]: list a directory in machine format",
+	"MLST":  "MLST [<path>]: return the facts of a file",
+	"MODE":  "MODE <mode>: set the transfer mode (only S)",
+	"NLST":  "NLST [<stream-id>] [<path>]: list the names in a directory",
+	"NOOP":  "NOOP: do nothing",
+	"OPTS":  "OPTS <command> <options>: set options of a command",
+	"PASS":  "PASS <password>: send the password",
+	"PWD":   "PWD: return the working directory",
+	"QUIT":  "QUIT: close the control stream",
+	"REIN":  "REIN: log out and reset the session",
+	"REST":  "REST <offset>: restart the next transfer at an offset",
+	"RETR":  "RETR <path>: download a file",
+	"RMD":   "RMD <path>: remove a directory",
+	"RNFR":  "RNFR <path>: select a file to rename",
+	"RNTO":  "RNTO <path>: rename the selected file",
+	"SITE":  "SITE <command> [<params>]: run a site specific command",
+	"SIZE":  "SIZE <path>: return the size of a file",
+	"STAT":  "STAT [<path>]: return the session status or list a path",
+	"STOR":  "STOR <stream-id> <path>: upload a file",
+	"STOU":  "STOU <stream-id>: upload a file under a unique name",
+	"STRU":  "STRU <structure>: set the file structure (only F)",
+	"SYST":  "SYST: return the system type",
+	"TYPE":  "TYPE <type>: set the transfer type (A or I)",
+	"USER":  "USER <name>: send the user name",
+	"XCUP":  "XCUP: change to the parent directory",
+	"XCWD":  "XCWD <path>: change the working directory",
+	"XPWD":  "XPWD: return the working directory",
+	"XRMD":  "XRMD <path>: remove a directory",
+}
+
+// commandHelp responds to the HELP FTP command. Without a parameter it lists
+// the names of all commands of the server, with one it describes the given
+// command.
+type commandHelp struct{}
+
+func (cmd commandHelp) IsExtend() bool {
+	return false
+}
+
+func (cmd commandHelp) RequireParam() bool {
+	return false
+}
+
+func (cmd commandHelp) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandHelp) Execute(subConn *SubConn, param string) {
+	s := subConn.connection.server
+	if param == "" {
+		subConn.writeMessageMultiline(214, "The following commands are recognized.\n"+
+			server.FormatHelpColumns(s.Commands(), helpColumns)+"Help OK.")
+		return
+	}
+	name := strings.ToUpper(param)
+	cmdObj := s.commands[name]
+	if cmdObj == nil {
+		subConn.writeMessage(502, "Unknown command "+name)
+		return
+	}
+	if helper, ok := cmdObj.(Helper); ok {
+		subConn.writeMessage(214, helper.Help())
+	} else if text, ok := helpTexts[name]; ok {
+		subConn.writeMessage(214, text)
+	} else {
+		subConn.writeMessage(214, name+": no description available")
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"strings"
+	"testing"
+)
+
+type helpfulCommand struct {
+	reportCommand
+}
+
+func (cmd helpfulCommand) Help() string {
+	return "XREP: send a report"
+}
+
+func TestHelp(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), nil)
+	subConn.receiveLine("HELP\r\n")
+	lines := responses(control)
+	if lines[0] != "214-The following commands are recognized." || lines[len(lines)-1] != "214 Help OK." {
+		t.Fatalf("got %q", lines)
+	}
+	if lines[1] != " ABOR  ALLO  APPE  CDUP  CWD   DELE  FEAT  HASH" {
+		t.Errorf("first line of names %q", lines[1])
+	}
+	var names []string
+	for _, line := range lines[1 : len(lines)-1] {
+		names = append(names, strings.Fields(line)...)
+	}
+	if len(names) != len(commands) {
+		t.Errorf("listed %v", names)
+	}
+
+	cases := []struct {
+		line     string
+		response string
+	}{
+		{"HELP retr", "214 RETR <path>: download a file"},
+		{"HELP XREP", "214 XREP: send a report"},
+		{"HELP XNOP", "214 XNOP: no description available"},
+		{"HELP FOO", "502 Unknown command FOO"},
+	}
+	subConn.connection.server.RegisterCommand("XREP", helpfulCommand{})
+	subConn.connection.server.RegisterCommand("XNOP", reportCommand{})
+	for _, c := range cases {
+		subConn.receiveLine(c.line + "\r\n")
+		if response := lastResponse(control); response != c.response {
+			t.Errorf("%s: got %q, want %q", c.line, response, c.response)
+		}
+	}
+}
+
+func TestHelpTexts(t *testing.T) {
+	for name := range commands {
+		if _, ok := helpTexts[name]; !ok {
+			t.Errorf("no help text for %s", name)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	server "github.com/attenberger/ftps_qftp-server"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logLevel selects the method of a server.LeveledLogger an entry is passed
+// to.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logEntry logs text under logID. A server.LeveledLogger receives it at
+// level with the key-value pairs as fields, other loggers with Print.
+func logEntry(logger server.Logger, level logLevel, logID string, text string, keysAndValues ...interface{}) {
+	leveled, ok := logger.(server.LeveledLogger)
+	if !ok {
+		logger.Print(logID, text)
+		return
+	}
+	switch level {
+	case levelDebug:
+		leveled.Debug(text, keysAndValues...)
+	case levelInfo:
+		leveled.Info(text, keysAndValues...)
+	case levelWarn:
+		leveled.Warn(text, keysAndValues...)
+	default:
+		leveled.Error(text, keysAndValues...)
+	}
+}
+
+// logID identifies the control stream of subConn in log entries.
+func (subConn *SubConn) logID() string {
+	return subConn.sessionID + ":" + strconv.FormatUint(uint64(subConn.controlStream.StreamID()), 10)
+}
+
+// log logs text like logEntry, with the session and the control stream as
+// fields in front of the key-value pairs.
+func (subConn *SubConn) log(level logLevel, text string, keysAndValues ...interface{}) {
+	fields := append([]interface{}{"session", subConn.sessionID, "stream", subConn.controlStream.StreamID()}, keysAndValues...)
+	logEntry(subConn.logger, level, subConn.logID(), text, fields...)
+}
+
+// logCommand logs a command received, with PrintCommand unless the logger
+// is a server.LeveledLogger.
+func (subConn *SubConn) logCommand(command string, param string) {
+	if _, ok := subConn.logger.(server.LeveledLogger); !ok {
+		subConn.logger.PrintCommand(subConn.logID(), command, param)
+		return
+	}
+	if strings.ToUpper(command) == "PASS" {
+		param = "****"
+	}
+	subConn.log(levelDebug, "Command received", "command", command, "param", param)
+}
+
+// logResponse logs a response sent, with PrintResponse unless the logger is
+// a server.LeveledLogger.
+func (subConn *SubConn) logResponse(code int, message string) {
+	if _, ok := subConn.logger.(server.LeveledLogger); !ok {
+		subConn.logger.PrintResponse(subConn.logID(), code, message)
+		return
+	}
+	subConn.log(levelDebug, "Response sent", "code", code, "message", message)
+}
+
+// logCommandDone logs the time an executed command took. Only a
+// server.LeveledLogger receives it.
+func (subConn *SubConn) logCommandDone(command string, duration time.Duration) {
+	if _, ok := subConn.logger.(server.LeveledLogger); ok {
+		subConn.log(levelInfo, "Command executed", "command", strings.ToUpper(command),
+			"code", subConn.lastResponseCode, "duration", duration)
+	}
+}
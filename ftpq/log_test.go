@@ -0,0 +1,94 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"fmt"
+	server "github.com/attenberger/ftps_qftp-server"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// leveledLogger records the entries it receives with their level.
+type leveledLogger struct {
+	server.DiscardLogger
+	entries []string
+	fields  [][]interface{}
+}
+
+func (l *leveledLogger) record(level string, msg string, keysAndValues []interface{}) {
+	l.entries = append(l.entries, level+" "+msg)
+	l.fields = append(l.fields, keysAndValues)
+}
+
+func (l *leveledLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.record("debug", msg, keysAndValues)
+}
+
+func (l *leveledLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.record("info", msg, keysAndValues)
+}
+
+func (l *leveledLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.record("warn", msg, keysAndValues)
+}
+
+func (l *leveledLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.record("error", msg, keysAndValues)
+}
+
+// plainLogger records the commands and responses it receives.
+type plainLogger struct {
+	server.DiscardLogger
+	lines []string
+}
+
+func (l *plainLogger) PrintCommand(sessionId string, command string, params string) {
+	l.lines = append(l.lines, fmt.Sprintf("%s > %s %s", sessionId, command, params))
+}
+
+func (l *plainLogger) PrintResponse(sessionId string, code int, message string) {
+	l.lines = append(l.lines, fmt.Sprintf("%s < %d %s", sessionId, code, message))
+}
+
+func TestLeveledLogger(t *testing.T) {
+	logger := &leveledLogger{}
+	subConn, _, _ := newTestSubConn(newMemDriver(), &ServerOpts{Logger: logger})
+	subConn.receiveLine("NOOP\r\n")
+
+	expected := []string{"debug Command received", "debug Response sent", "info Command executed"}
+	if !reflect.DeepEqual(logger.entries, expected) {
+		t.Fatalf("got %q", logger.entries)
+	}
+	stream := subConn.controlStream.StreamID()
+	if fields := logger.fields[0]; !reflect.DeepEqual(fields, []interface{}{"session", subConn.sessionID, "stream", stream, "command", "NOOP", "param", ""}) {
+		t.Errorf("command fields %v", fields)
+	}
+	if fields := logger.fields[1]; !reflect.DeepEqual(fields[4:], []interface{}{"code", 200, "message", "OK"}) {
+		t.Errorf("response fields %v", fields)
+	}
+	if fields := logger.fields[2]; len(fields) != 10 || fields[6] != "code" || fields[7] != 200 || fields[8] != "duration" {
+		t.Errorf("executed fields %v", fields)
+	} else if _, ok := fields[9].(time.Duration); !ok {
+		t.Errorf("duration %v", fields[9])
+	}
+
+	logger.fields = nil
+	subConn.receiveLine("PASS secret\r\n")
+	if fields := logger.fields[0]; fields[7] != "****" {
+		t.Errorf("password logged: %v", fields)
+	}
+}
+
+func TestPlainLogger(t *testing.T) {
+	logger := &plainLogger{}
+	subConn, _, _ := newTestSubConn(newMemDriver(), &ServerOpts{Logger: logger})
+	subConn.receiveLine("NOOP\r\n")
+	expected := []string{subConn.logID() + " > NOOP ", subConn.logID() + " < 200 OK"}
+	if !reflect.DeepEqual(logger.lines, expected) {
+		t.Errorf("got %q", logger.lines)
+	}
+}
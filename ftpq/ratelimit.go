@@ -0,0 +1,94 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"io"
+	"time"
+)
+
+// rateLimitWindow is the time over which a rateLimiter smooths bursts. Up
+// to the bytes of one window can be transferred at once.
+const rateLimitWindow = 100 * time.Millisecond
+
+// rateLimiter is a token bucket, which allows rate bytes per second.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter for rate bytes per second, whose
+// bucket starts full.
+func newRateLimiter(rate int64) *rateLimiter {
+	burst := float64(rate) * rateLimitWindow.Seconds()
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// limit returns n or the size of the bucket, if that is smaller.
+func (l *rateLimiter) limit(n int) int {
+	if float64(n) > l.burst {
+		return int(l.burst)
+	}
+	return n
+}
+
+// wait blocks until n bytes, at most the size of the bucket, may be
+// transferred and takes them from the bucket.
+func (l *rateLimiter) wait(n int) {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	l.last = now
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+		time.Sleep(wait)
+		l.tokens = 0
+		l.last = l.last.Add(wait)
+	}
+}
+
+// rateLimitedStream limits the data written to a data stream to the rate of
+// its limiter, see ServerOpts.DownloadRateLimit.
+type rateLimitedStream struct {
+	quic.SendStream
+	limiter *rateLimiter
+}
+
+func (s *rateLimitedStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:s.limiter.limit(len(p))]
+		s.limiter.wait(len(chunk))
+		n, err := s.SendStream.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// rateLimitedReader limits the data read from a data stream to the rate of
+// its limiter, see ServerOpts.UploadRateLimit.
+type rateLimitedReader struct {
+	io.Reader
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p[:r.limiter.limit(len(p))])
+	r.limiter.wait(n)
+	return n, err
+}
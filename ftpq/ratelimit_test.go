@@ -0,0 +1,86 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkDuration fails if elapsed is not about expected.
+func checkDuration(t *testing.T, name string, elapsed time.Duration, expected time.Duration) {
+	if elapsed < expected-20*time.Millisecond || elapsed > expected+150*time.Millisecond {
+		t.Errorf("%s took %v, want about %v", name, elapsed, expected)
+	}
+}
+
+func TestRateLimitedStream(t *testing.T) {
+	stream := &fakeStream{}
+	limited := &rateLimitedStream{SendStream: stream, limiter: newRateLimiter(100000)}
+	payload := bytes.Repeat([]byte("x"), 30000)
+	start := time.Now()
+	// the first 10000 bytes fill the bucket of 100ms, the rest takes 200ms
+	if n, err := limited.Write(payload); n != len(payload) || err != nil {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+	checkDuration(t, "write", time.Since(start), 200*time.Millisecond)
+	if stream.String() != string(payload) {
+		t.Error("payload changed")
+	}
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	payload := strings.Repeat("x", 30000)
+	limited := &rateLimitedReader{Reader: strings.NewReader(payload), limiter: newRateLimiter(100000)}
+	start := time.Now()
+	data, err := ioutil.ReadAll(limited)
+	if err != nil || string(data) != payload {
+		t.Fatalf("read %d bytes: %v", len(data), err)
+	}
+	checkDuration(t, "read", time.Since(start), 200*time.Millisecond)
+}
+
+func TestDownloadRateLimit(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/file", strings.Repeat("x", 3000))
+	subConn, control, session := newTestSubConn(driver, &ServerOpts{DownloadRateLimit: 10000})
+	start := time.Now()
+	subConn.receiveLine("RETR /file\r\n")
+	checkDuration(t, "RETR", time.Since(start), 200*time.Millisecond)
+	if response := lastResponse(control); response != "226 Closing data stream, sent 3000 bytes" {
+		t.Errorf("got %q", response)
+	}
+	if len(session.sendStreams[0].String()) != 3000 {
+		t.Error("file not sent completely")
+	}
+}
+
+func TestUploadRateLimit(t *testing.T) {
+	driver := newMemDriver()
+	subConn, control, session := newTestSubConn(driver, &ServerOpts{UploadRateLimit: 10000})
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader(strings.Repeat("x", 3000))}}
+	start := time.Now()
+	subConn.receiveLine("STOR 2 /file\r\n")
+	checkDuration(t, "STOR", time.Since(start), 200*time.Millisecond)
+	if response := lastResponse(control); response != "226 OK, received 3000 bytes" {
+		t.Errorf("got %q", response)
+	}
+}
+
+func TestRuploadRateLimit(t *testing.T) {
+	subConn, control, session := newTestSubConn(newMemDriver(), &ServerOpts{UploadRateLimit: 10000})
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader(strings.Repeat("x", 3000))}}
+	subConn.receiveLine("SITE RUPLOAD START /file\r\n")
+	token := lastResponse(control)[4:]
+	start := time.Now()
+	subConn.receiveLine("SITE RUPLOAD CHUNK " + token + " 0 2\r\n")
+	checkDuration(t, "SITE RUPLOAD CHUNK", time.Since(start), 200*time.Millisecond)
+	if response := lastResponse(control); response != "226 OK, received 3000 bytes" {
+		t.Errorf("got %q", response)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	server "github.com/attenberger/ftps_qftp-server"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadTempPrefix starts the names of the temporary files of resumable
+// uploads. They are left out of listings.
+const uploadTempPrefix = ".rupload-"
+
+// uploadExpiryInterval is how often expired resumable uploads are removed.
+var uploadExpiryInterval = time.Minute
+
+// resumableUpload is an upload started with SITE RUPLOAD START. Its chunks
+// are appended to a temporary file next to the target, which is renamed to
+// the target on commit.
+type resumableUpload struct {
+	user       string
+	targetPath string
+	tempPath   string
+	// the driver of the session that started the upload, deletes the
+	// temporary file when the upload expires
+	driver server.Driver
+	// time of the last command for the upload, guarded by uploadsMutex
+	lastUsed time.Time
+	// set while a CHUNK or COMMIT runs, guarded by uploadsMutex
+	busy bool
+}
+
+// isUploadTempName reports whether name is the name of the temporary file
+// of a resumable upload.
+func isUploadTempName(name string) bool {
+	return strings.HasPrefix(name, uploadTempPrefix)
+}
+
+// newUploadToken returns 32 random hex characters identifying an upload.
+func newUploadToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// addUpload registers upload under token. Uploads are kept by the server,
+// so that a client can continue them in a new session. It returns false, if
+// MaxResumableUploads are open already.
+func (server *Server) addUpload(token string, upload *resumableUpload) bool {
+	server.uploadsMutex.Lock()
+	defer server.uploadsMutex.Unlock()
+	if server.uploads == nil {
+		server.uploads = make(map[string]*resumableUpload)
+	}
+	if len(server.uploads) >= server.MaxResumableUploads {
+		return false
+	}
+	upload.lastUsed = time.Now()
+	server.uploads[token] = upload
+	return true
+}
+
+// getUpload returns the upload of token, if it was started by user.
+func (server *Server) getUpload(token string, user string) *resumableUpload {
+	server.uploadsMutex.Lock()
+	defer server.uploadsMutex.Unlock()
+	upload := server.uploads[token]
+	if upload == nil || upload.user != user {
+		return nil
+	}
+	upload.lastUsed = time.Now()
+	return upload
+}
+
+// acquireUpload returns the upload of token like getUpload and marks it
+// busy, so that the chunks of an upload are written one at a time. busy is
+// true, if the upload exists but is used by another command. A successfully
+// acquired upload is handed back with releaseUpload.
+func (server *Server) acquireUpload(token string, user string) (upload *resumableUpload, busy bool) {
+	server.uploadsMutex.Lock()
+	defer server.uploadsMutex.Unlock()
+	upload = server.uploads[token]
+	if upload == nil || upload.user != user {
+		return nil, false
+	}
+	if upload.busy {
+		return nil, true
+	}
+	upload.busy = true
+	upload.lastUsed = time.Now()
+	return upload, false
+}
+
+func (server *Server) releaseUpload(upload *resumableUpload) {
+	server.uploadsMutex.Lock()
+	defer server.uploadsMutex.Unlock()
+	upload.busy = false
+	upload.lastUsed = time.Now()
+}
+
+func (server *Server) removeUpload(token string) {
+	server.uploadsMutex.Lock()
+	defer server.uploadsMutex.Unlock()
+	delete(server.uploads, token)
+}
+
+// expireUploads removes the uploads not used for ResumableUploadTTL before
+// now and deletes their temporary files.
+func (server *Server) expireUploads(now time.Time) {
+	var expired []*resumableUpload
+	server.uploadsMutex.Lock()
+	for token, upload := range server.uploads {
+		if !upload.busy && now.Sub(upload.lastUsed) >= server.ResumableUploadTTL {
+			expired = append(expired, upload)
+			delete(server.uploads, token)
+		}
+	}
+	server.uploadsMutex.Unlock()
+	for _, upload := range expired {
+		if err := upload.driver.DeleteFile(upload.tempPath); err != nil {
+			logEntry(server.logger, levelWarn, "", fmt.Sprintf("Deleting expired upload %s failed: %v", upload.tempPath, err), "error", err)
+		}
+	}
+}
+
+// expireUploadsPeriodically calls expireUploads every uploadExpiryInterval
+// until ctx is done.
+func (server *Server) expireUploadsPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(uploadExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			server.expireUploads(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// siteCommandRupload responds to the SITE RUPLOAD command for resumable
+// uploads:
+//
+//	SITE RUPLOAD START path                 starts an upload, returns the token
+//	SITE RUPLOAD CHUNK token offset stream  appends the data of the stream
+//	SITE RUPLOAD STATUS token               returns the offset of the next chunk
+//	SITE RUPLOAD COMMIT token               moves the data to the path
+//
+// Chunks have to be sent in order, the offset of each has to match the
+// number of bytes received so far. After an interrupted chunk the client
+// asks for the STATUS and continues from there. A CHUNK or COMMIT sent while
+// another one of the same upload runs is answered with 450. Uploads not
+// continued within ServerOpts.ResumableUploadTTL are dropped.
+type siteCommandRupload struct{}
+
+func (cmd siteCommandRupload) IsExtend() bool {
+	return false
+}
+
+func (cmd siteCommandRupload) RequireParam() bool {
+	return true
+}
+
+func (cmd siteCommandRupload) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteCommandRupload) Execute(subConn *SubConn, param string) {
+	params := strings.Fields(param)
+	action := strings.ToUpper(params[0])
+	if action == "START" && len(params) >= 2 {
+		subConn.startUpload(strings.TrimSpace(param[len(params[0]):]))
+		return
+	}
+	server := subConn.connection.server
+	switch {
+	case action == "CHUNK" && len(params) == 4:
+		if upload := subConn.acquireUpload(params[1]); upload != nil {
+			defer server.releaseUpload(upload)
+			subConn.receiveChunk(upload, params[2], params[3])
+		}
+	case action == "STATUS" && len(params) == 2:
+		if upload := server.getUpload(params[1], subConn.user); upload == nil {
+			subConn.writeMessage(550, "Unknown upload token")
+		} else if info, err := subConn.driver.Stat(upload.tempPath); err != nil {
+			subConn.writeError(550, fmt.Sprint("Upload not available: ", err), err)
+		} else {
+			subConn.writeMessage(213, strconv.FormatInt(info.Size(), 10))
+		}
+	case action == "COMMIT" && len(params) == 2:
+		upload := subConn.acquireUpload(params[1])
+		if upload == nil {
+			return
+		}
+		defer server.releaseUpload(upload)
+		if err := subConn.driver.Rename(upload.tempPath, upload.targetPath); err != nil {
+			subConn.writeError(550, fmt.Sprint("Commit failed: ", err), err)
+		} else {
+			server.removeUpload(params[1])
+			subConn.applyUmask(upload.targetPath, 0666)
+			subConn.lastUploadPath = upload.targetPath
+			subConn.writeMessage(250, "Upload committed to "+upload.targetPath)
+		}
+	default:
+		subConn.writeMessage(501, "Syntax: SITE RUPLOAD START path|CHUNK token offset stream|STATUS token|COMMIT token")
+	}
+}
+
+// acquireUpload acquires the upload of token for the user of the session.
+// If that fails the client is told why and nil is returned.
+func (subConn *SubConn) acquireUpload(token string) *resumableUpload {
+	upload, busy := subConn.connection.server.acquireUpload(token, subConn.user)
+	if busy {
+		subConn.writeMessage(450, "Upload busy with another command, retry later")
+	} else if upload == nil {
+		subConn.writeMessage(550, "Unknown upload token")
+	}
+	return upload
+}
+
+func (subConn *SubConn) startUpload(param string) {
+	targetPath := subConn.buildPath(param)
+	if hasDeniedExtension(targetPath, subConn.connection.server.DeniedExtensions) {
+		subConn.writeMessage(553, "File type not allowed")
+		return
+	}
+	token, err := newUploadToken()
+	if err != nil {
+		subConn.writeMessage(451, "Could not create upload token")
+		return
+	}
+	server := subConn.connection.server
+	server.expireUploads(time.Now())
+	upload := &resumableUpload{
+		user:       subConn.user,
+		targetPath: targetPath,
+		tempPath:   path.Join(path.Dir(targetPath), uploadTempPrefix+token),
+		driver:     subConn.driver,
+	}
+	if !server.addUpload(token, upload) {
+		subConn.writeMessage(450, "Too many open uploads, retry later")
+		return
+	}
+	if _, err := subConn.driver.PutFile(upload.tempPath, bytes.NewReader(nil), false); err != nil {
+		server.removeUpload(token)
+		subConn.writeError(550, fmt.Sprint("Could not start upload: ", err), err)
+		return
+	}
+	subConn.writeMessage(200, token)
+}
+
+func (subConn *SubConn) receiveChunk(upload *resumableUpload, offsetParam string, streamParam string) {
+	offset, err := strconv.ParseInt(offsetParam, 10, 64)
+	if err != nil {
+		subConn.writeMessage(501, "Invalid offset")
+		return
+	}
+	streamID, ok := parseClientStreamID(streamParam)
+	if !ok {
+		subConn.writeMessage(501, "Stream ID has not a valid value for a unidirectional stream from the client.")
+		return
+	}
+	info, err := subConn.driver.Stat(upload.tempPath)
+	if err != nil {
+		subConn.writeError(550, fmt.Sprint("Upload not available: ", err), err)
+		return
+	}
+	if info.Size() != offset {
+		subConn.writeMessage(554, "Offset mismatch, next chunk starts at "+strconv.FormatInt(info.Size(), 10))
+		return
+	}
+	if !subConn.connection.acquireTransfer() {
+		subConn.writeMessage(425, "Too many concurrent transfers")
+		return
+	}
+	defer subConn.connection.releaseTransfer()
+	if _, err := subConn.writeMessage(150, "Data transfer starting"); err != nil {
+		return
+	}
+	stream, err := subConn.connection.getReceiveDataStream(streamID)
+	if err != nil {
+		subConn.writeMessage(425, "Can't open data stream.")
+		return
+	}
+	defer subConn.connection.server.releaseDataStream()
+
+	var data io.Reader = stream
+	if rate := subConn.connection.server.UploadRateLimit; rate > 0 {
+		data = &rateLimitedReader{Reader: stream, limiter: newRateLimiter(rate)}
+	}
+	start := time.Now()
+	bytes, err := subConn.driver.PutFile(upload.tempPath, data, true)
+	subConn.transferredBytes += bytes
+	subConn.observeTransfer(server.TransferUpload, bytes, start)
+	if err != nil {
+		subConn.writeError(450, fmt.Sprint("error during transfer: ", err), err)
+		return
+	}
+	subConn.writeMessage(226, "OK, received "+strconv.FormatInt(bytes, 10)+" bytes")
+}
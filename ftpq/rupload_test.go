@@ -0,0 +1,131 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"errors"
+	server "github.com/attenberger/ftps_qftp-server"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSiteRupload(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	subConn, control, session := newTestSubConn(driver, nil)
+	session.receiveStreams = []*fakeStream{
+		{id: 2, reader: strings.NewReader("Hello, ")},
+		// interrupted chunk
+		{id: 6, reader: io.MultiReader(strings.NewReader("wor"), &failingReader{})},
+		{id: 10, reader: strings.NewReader("world")},
+	}
+
+	subConn.receiveLine("SITE RUPLOAD START /dir/file.txt\r\n")
+	response := lastResponse(control)
+	if !strings.HasPrefix(response, "200 ") || len(response) != 4+32 {
+		t.Fatalf("START: got %q", response)
+	}
+	token := response[4:]
+
+	steps := []struct {
+		line     string
+		response string
+	}{
+		{"SITE RUPLOAD CHUNK " + token + " 0 2", "226 OK, received 7 bytes"},
+		{"SITE RUPLOAD CHUNK " + token + " 0 6", "554 Offset mismatch, next chunk starts at 7"},
+		{"SITE RUPLOAD CHUNK " + token + " 7 6", "450 error during transfer: connection lost"},
+		{"SITE RUPLOAD STATUS " + token, "213 7"},
+		{"SITE RUPLOAD CHUNK " + token + " 7 10", "226 OK, received 5 bytes"},
+		{"SITE RUPLOAD COMMIT " + token, "250 Upload committed to /dir/file.txt"},
+		{"SITE RUPLOAD STATUS " + token, "550 Unknown upload token"},
+	}
+	for _, step := range steps {
+		subConn.receiveLine(step.line + "\r\n")
+		if response := lastResponse(control); response != step.response {
+			t.Errorf("%s: got %q, want %q", step.line, response, step.response)
+		}
+	}
+	if content, _ := driver.content("/dir/file.txt"); content != "Hello, world" {
+		t.Errorf("assembled %q", content)
+	}
+	if _, ok := driver.content("/dir/.rupload-" + token); ok {
+		t.Error("temporary file left behind")
+	}
+}
+
+func TestSiteRuploadOtherUser(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), nil)
+	subConn.receiveLine("SITE RUPLOAD START /file\r\n")
+	token := lastResponse(control)[4:]
+
+	other := subConn.connection.newSubConn(&fakeStream{}, subConn.driver)
+	other.logger = &server.DiscardLogger{}
+	other.user = "other"
+	other.receiveLine("SITE RUPLOAD STATUS " + token + "\r\n")
+	if response := lastResponse(other.controlStream.(*fakeStream)); response != "550 Unknown upload token" {
+		t.Errorf("got %q", response)
+	}
+}
+
+// failingReader fails like a data stream reset by the client.
+type failingReader struct{}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection lost")
+}
+
+func TestSiteRuploadExpiry(t *testing.T) {
+	driver := newMemDriver()
+	subConn, control, _ := newTestSubConn(driver, &ServerOpts{ResumableUploadTTL: time.Hour})
+	subConn.receiveLine("SITE RUPLOAD START /file\r\n")
+	token := lastResponse(control)[4:]
+	s := subConn.connection.server
+
+	s.expireUploads(time.Now().Add(30 * time.Minute))
+	if s.getUpload(token, "admin") == nil {
+		t.Fatal("upload expired before its TTL")
+	}
+	s.expireUploads(time.Now().Add(2 * time.Hour))
+	subConn.receiveLine("SITE RUPLOAD STATUS " + token + "\r\n")
+	if response := lastResponse(control); response != "550 Unknown upload token" {
+		t.Errorf("STATUS of expired upload: got %q", response)
+	}
+	if _, ok := driver.content("/" + uploadTempPrefix + token); ok {
+		t.Error("temporary file of expired upload left behind")
+	}
+}
+
+func TestSiteRuploadLimits(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	subConn, control, session := newTestSubConn(driver, &ServerOpts{MaxResumableUploads: 1})
+	subConn.receiveLine("SITE RUPLOAD START /dir/file\r\n")
+	token := lastResponse(control)[4:]
+	subConn.receiveLine("SITE RUPLOAD START /dir/other\r\n")
+	if response := lastResponse(control); response != "450 Too many open uploads, retry later" {
+		t.Errorf("START above the limit: got %q", response)
+	}
+
+	s := subConn.connection.server
+	upload, _ := s.acquireUpload(token, "admin")
+	for _, line := range []string{"CHUNK " + token + " 0 2", "COMMIT " + token} {
+		subConn.receiveLine("SITE RUPLOAD " + line + "\r\n")
+		if response := lastResponse(control); response != "450 Upload busy with another command, retry later" {
+			t.Errorf("%s while busy: got %q", line, response)
+		}
+	}
+	s.expireUploads(time.Now().Add(48 * time.Hour))
+	s.releaseUpload(upload)
+	if s.getUpload(token, "admin") == nil {
+		t.Error("busy upload expired")
+	}
+
+	subConn.receiveLine("NLST /dir\r\n")
+	if listing := session.sendStreams[0].String(); listing != "" {
+		t.Errorf("temporary file listed: %q", listing)
+	}
+}
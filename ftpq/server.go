@@ -12,10 +12,15 @@ import (
 	server "github.com/attenberger/ftps_qftp-server"
 	"github.com/lucas-clemente/quic-go"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Defaults of the QUIC options in ServerOpts.
 const (
 	MaxStreamsPerSession = 3      // like default in vsftpd // but separate limit for uni- and bidirectional streams
 	MaxStreamFlowControl = 212992 // like OpenSuse TCP /proc/sys/net/core/rmem_max
@@ -60,8 +65,267 @@ type ServerOpts struct {
 
 	WelcomeMessage string
 
+	// If set this text is sent as 220 reply as soon as a control stream is
+	// opened, before any command, e.g. a legal notice required before
+	// login. With ClientListStreams it is sent before the reply to the
+	// first command instead, since the stream might be taken for a
+	// listing. It may span several lines.
+	LegalBanner string
+
 	// A logger implementation, if nil the StdLogger is used
 	Logger server.Logger
+
+	// If true RNTO refuses to move files into another directory,
+	// only renames within the same directory are allowed
+	RestrictRenameToSameDir bool
+
+	// If true RMD lists the directory before deleting it and refuses to
+	// delete it with a clear message if it is not empty
+	CheckDirEmptyOnRmd bool
+
+	// If true STOR checks that the parent directory of the target exists
+	// before accepting the data stream and answers 550 otherwise, instead
+	// of passing the upload to the driver and returning its error
+	CheckParentDirOnStor bool
+
+	// The maximum number of data streams open at the same time over all
+	// sessions. Further transfers are refused with 425. Zero means unlimited.
+	MaxTotalDataStreams int
+
+	// The maximum speed of each upload and download in bytes per second.
+	// Bursts are smoothed over 100ms. Zero means unlimited.
+	UploadRateLimit   int64
+	DownloadRateLimit int64
+
+	// The maximum number of LIST, NLST and MLSD commands a control stream
+	// may send within a minute, to protect backends on which listings are
+	// expensive. Further listings are refused with 450. Zero means
+	// unlimited.
+	MaxListsPerMinute int
+
+	// The networks sessions are accepted from. Sessions from addresses in
+	// DeniedNets are refused, even if they are in AllowedNets as well. An
+	// empty AllowedNets allows all addresses not denied. Refused sessions
+	// are closed with ErrorCodeServiceUnavailable right after they were
+	// accepted. The address is only checked when a session is accepted. It
+	// is not checked again if the client address of the session changes
+	// later, e.g. by a NAT rebinding or connection migration.
+	AllowedNets []*net.IPNet
+	DeniedNets  []*net.IPNet
+
+	// The maximum number of sessions served at the same time. Further
+	// sessions are closed with ErrorCodeServiceUnavailable right after they
+	// were accepted. Zero means unlimited.
+	MaxConnections int
+
+	// The maximum number of transfers (RETR, STOR, APPE, STOU and chunks of
+	// SITE RUPLOAD) running at the same time on the control streams of one
+	// session. Further transfers are refused with 425. Zero means unlimited.
+	MaxConcurrentTransfersPerSession int
+
+	// If true directory listings start with the entries "." and ".." for
+	// the listed directory and its parent
+	IncludeDotEntries bool
+
+	// If true all paths are converted to lower case before they are passed
+	// to the driver, so clients get case insensitive behavior on a case
+	// sensitive backend. Files and directories already stored with upper
+	// case letters become unreachable and can be overwritten by their lower
+	// case variant, so only enable this on a backend that has always been
+	// used with it.
+	CanonicalizePathCase bool
+
+	// If true names in directory listings are converted to the Unicode
+	// normalization form C
+	NormalizeListingNFC bool
+
+	// If true paths received from clients are converted to the Unicode
+	// normalization form C before they are passed to the driver
+	NormalizePathNFC bool
+
+	// If at least this many data streams are open over all sessions, the
+	// commands in busyCommands and busySiteCommands (transfers and file
+	// modifications) are answered with 450 so that clients back off and
+	// retry later. Zero disables the check.
+	BusyDataStreamThreshold int
+
+	// Uploads of files with one of these extensions, like "exe" or
+	// "tar.gz", are refused. The comparison ignores case.
+	DeniedExtensions []string
+
+	// The terminator of response lines, defaults to "\r\n" as required by
+	// RFC 959. Only change it for testing against lenient clients.
+	LineTerminator string
+
+	// If set it is called for every new control stream of a session, after
+	// its SubConn is constructed and before the first command is read. With
+	// ClientListStreams it is only called when the first command arrives,
+	// and not for streams taken for listings. At that time no user is
+	// logged in yet. The SubConn is served until the
+	// client sends QUIT or the stream fails.
+	OnNewSubConn func(*SubConn)
+
+	// The number of protocol errors in a row, like unknown commands,
+	// missing parameters or commands out of sequence, after which a control
+	// stream is closed with 421. Zero means unlimited.
+	MaxProtocolErrors int
+
+	// The minimum time USER and PASS take to respond. Answers are delayed
+	// until it has passed, so that the response time does not reveal
+	// whether a user exists or how long the password check took. Zero
+	// disables the delay.
+	AuthResponseTime time.Duration
+
+	// If greater than zero RETR reports the progress of a transfer every
+	// this many bytes with an additional 150 response on the control
+	// stream. Zero disables it. Clients expecting exactly one preliminary
+	// reply may take the additional ones as the final reply, so only enable
+	// it if all clients are known to skip them.
+	ProgressInterval int64
+
+	// If true every path is resolved with the drivers RealPath before it is
+	// used and refused if a symlink leads outside of the root of the
+	// driver. Cleaning the path in the server only removes "..", it can not
+	// see symlinks. Serve refuses to start, if the drivers of the Factory
+	// do not implement server.RealPathDriver. Without it the cleaned paths
+	// are passed on to the driver as they are.
+	ConfineToRoot bool
+
+	// If set it receives an entry for every command, e.g. a
+	// server.CLFAccessLogger to write an access log in the Common Log Format
+	AccessLogger server.AccessLogger
+
+	// If true the 226 response of a download resumed with REST reports the
+	// offset plus the bytes sent, i.e. the file position reached, instead
+	// of only the bytes sent over the data stream. Clients can compare it
+	// to the file size to verify they received the whole file.
+	ReportCumulativeBytes bool
+
+	// Resumable uploads of SITE RUPLOAD not continued for this long are
+	// dropped and their temporary files deleted. Default is 24 hours.
+	ResumableUploadTTL time.Duration
+
+	// The number of resumable uploads open at once over all sessions,
+	// further SITE RUPLOAD START are answered with 450. Default is 1000.
+	MaxResumableUploads int
+
+	// The response to uploads failing with server.ErrQuotaExceeded.
+	// "{remaining}" is replaced by the number of bytes the drivers
+	// AvailableSpace reports, e.g. "Quota exceeded, {remaining} bytes left".
+	// Only logged in users can upload, so nobody else learns about the
+	// quota. Default is "Quota exceeded".
+	QuotaExceededMessage string
+
+	// If set the server sends an Event to it for every session, login,
+	// command and transfer, e.g. to follow the flow of a session in tests.
+	// Events are dropped while the channel is full, so that the server
+	// never blocks on it. It should be buffered therefore.
+	Events chan<- Event
+
+	// If set it chooses the response code and message of errors reported
+	// to clients, e.g. 553 instead of 550 for denied permissions. It gets
+	// the category of the error, the command in upper case and the code
+	// and message the server would send. Without it these are sent.
+	ResponseCodeMapper func(category ErrorCategory, command string, code int, message string) (int, string)
+
+	// If set it receives the time every executed command took. Commands
+	// refused before execution, e.g. because of a missing login, are not
+	// measured.
+	Metrics server.Metrics
+
+	// If set only these curves are used for the key exchange, e.g. to
+	// comply with FIPS. There is no option for the cipher suites: QUIC
+	// always negotiates TLS 1.3, whose suites crypto/tls does not allow to
+	// configure.
+	CurvePreferences []tls.CurveID
+
+	// The minimum TLS version accepted, defaults to TLS 1.2. QUIC itself
+	// negotiates TLS 1.3, so this only matters if the TLS config is used
+	// for other listeners as well.
+	MinTLSVersion uint16
+
+	// An OCSP response for the certificate, which is stapled to the TLS
+	// handshake, so that clients checking the revocation of the
+	// certificate do not have to ask the responder of the CA themselves.
+	// It can be obtained with "openssl ocsp -issuer ca.pem -cert cert.pem
+	// -url <responder> -respout staple.der" and has to be renewed before
+	// its nextUpdate time.
+	OCSPStaple []byte
+
+	// If set it is called at start and then every OCSPRefreshInterval to
+	// fetch a fresh OCSP response, which replaces OCSPStaple. A failed
+	// refresh keeps the previous response. RefreshOCSPStaple can be used to
+	// refresh it at other times.
+	OCSPFetcher         func() ([]byte, error)
+	OCSPRefreshInterval time.Duration
+
+	// The commands still answered while the server is in maintenance mode,
+	// all others are refused with 450. SITE subcommands are given with
+	// their name, e.g. "SITE INFO". Defaults to defaultMaintenanceCommands.
+	MaintenanceCommands []string
+
+	// If set STOU calls it to get a name for a file in dir derived from the
+	// name base. It is called again if the name is already in use, so it
+	// should return a different name each time, e.g. with a random part.
+	// By default the names are base, base-1, base-2 and so on, keeping the
+	// extension, e.g. "file-2.txt".
+	UniqueNameFunc func(dir, base string) string
+
+	// If true the parameter of LIST and NLST may start with the ID of a
+	// bidirectional stream the client opened without sending a command on
+	// it, e.g. "LIST 8 /dir". The listing is then sent over this stream
+	// instead of a new stream opened by the server, so the client controls
+	// the lifecycle of the data stream. A directory whose name is a valid
+	// stream ID has to be listed with a path like "./8".
+	ClientListStreams bool
+
+	// The maximum length in bytes of the parameter of a command, e.g. of a
+	// path handed to a driver with a limit of its own. Longer parameters
+	// are refused with 501. MaxParamLengths overrides it for the commands
+	// given by their upper case name, e.g. {"SITE": 1024}. Zero means
+	// unlimited.
+	MaxParamLength  int
+	MaxParamLengths map[string]int
+
+	// If set this line is sent after the entries of LIST, NLST and MLSD,
+	// e.g. "# end", so clients can tell a complete listing from one cut
+	// off with the data stream. Clients have to know about it, otherwise
+	// they take it for an entry.
+	ListingEndMarker string
+
+	// The size in bytes of the receive and send buffers of the UDP socket.
+	// QUIC handles all sessions over this one socket, so at high
+	// throughput or under bursts of new sessions the default buffers of
+	// the OS overflow and packets are dropped. About 2500000 bytes are
+	// recommended, on Linux net.core.rmem_max and net.core.wmem_max have
+	// to be raised to allow that. Zero keeps the default of the OS.
+	UDPReadBufferSize  int
+	UDPWriteBufferSize int
+
+	// The time a control stream may stay without a command before it is
+	// closed with 421. The time a command runs, e.g. a transfer, does not
+	// count. Zero means no limit.
+	IdleTimeout time.Duration
+
+	// The bounds of the idle timeout a client can choose for its control
+	// stream with SITE IDLE. MinIdleTimeout defaults to one second,
+	// MaxIdleTimeout to IdleTimeout, so clients can only shorten it.
+	MinIdleTimeout time.Duration
+	MaxIdleTimeout time.Duration
+
+	// The number of streams a client may open at the same time in each
+	// direction, which limits the parallel transfers of a session.
+	// Defaults to MaxStreamsPerSession.
+	MaxStreamsPerSession int
+
+	// The flow control window of a stream in bytes, the window of the
+	// whole session is one more stream than MaxStreamsPerSession. On links
+	// with a high latency it has to be raised to reach the bandwidth.
+	// Defaults to MaxStreamFlowControl.
+	StreamFlowControlWindow uint64
+
+	// If true, QUIC keeps idle sessions alive with pings.
+	KeepAlive bool
 }
 
 // Server is the root of your FTP application. You should instantiate one
@@ -77,9 +341,58 @@ type Server struct {
 	quicConfig *quic.Config
 	ctx        context.Context
 	cancel     context.CancelFunc
-	feats      string
+	featCmds   string
+	// the commands answered by this server by upper case name
+	commands commandMap
+	// the subcommands of SITE answered by this server by upper case name
+	siteCommands commandMap
+	// one element per served session if MaxConnections is set
+	connectionSlots chan struct{}
+	// one element per open data stream if MaxTotalDataStreams is set
+	dataStreamSlots chan struct{}
+	// number of open data streams, accessed atomically
+	openDataStreams int32
+	// closed by Resume, nil while not paused
+	resumed     chan struct{}
+	pausedMutex sync.Mutex
+	// resumable uploads by token
+	uploads      map[string]*resumableUpload
+	uploadsMutex sync.Mutex
+	// current OCSP response stapled to the certificate
+	ocspStaple      []byte
+	ocspStapleMutex sync.Mutex
+	// the *tls.Certificate presented in new handshakes, replaced by
+	// ReloadCertificate
+	certificate atomic.Value
+	// 1 while in maintenance mode, accessed atomically
+	maintenance int32
+	// MaintenanceCommands in upper case
+	maintenanceCommands map[string]bool
+	// sessions being served, for ShutdownGracefully
+	conns      map[*Conn]bool
+	connsWait  sync.WaitGroup
+	connsMutex sync.Mutex
+	// targets of uploads in progress, by STOR and APPE or handed out by STOU
+	reservedNames      map[string]bool
+	reservedNamesMutex sync.Mutex
 }
 
+// ErrorCodeServiceUnavailable is the QUIC application error code sessions
+// are closed with, if the server is not able to serve them, e.g. because no
+// driver could be created. It matches the FTP reply code 421.
+const ErrorCodeServiceUnavailable quic.ErrorCode = 421
+
+// errServiceUnavailable is the reason sent with ErrorCodeServiceUnavailable.
+var errServiceUnavailable = errors.New("Service not available, closing session")
+
+// errTooManyConnections is the reason sent with ErrorCodeServiceUnavailable
+// to sessions beyond MaxConnections.
+var errTooManyConnections = errors.New("Too many connections, closing session")
+
+// errAddressDenied is the reason sent with ErrorCodeServiceUnavailable to
+// sessions from addresses refused by AllowedNets and DeniedNets.
+var errAddressDenied = errors.New("Access denied, closing session")
+
 // ErrServerClosed is returned by ListenAndServe() or Serve() when a shutdown
 // was requested.
 var ErrServerClosed = errors.New("quic-ftp: Server closed")
@@ -108,6 +421,8 @@ func serverOptsWithDefaults(opts *ServerOpts) *ServerOpts {
 		newOpts.Name = opts.Name
 	}
 
+	newOpts.LegalBanner = opts.LegalBanner
+
 	if opts.WelcomeMessage == "" {
 		newOpts.WelcomeMessage = defaultWelcomeMessage
 	} else {
@@ -129,6 +444,106 @@ func serverOptsWithDefaults(opts *ServerOpts) *ServerOpts {
 
 	newOpts.PublicIp = opts.PublicIp
 
+	newOpts.RestrictRenameToSameDir = opts.RestrictRenameToSameDir
+	newOpts.CheckDirEmptyOnRmd = opts.CheckDirEmptyOnRmd
+	newOpts.CheckParentDirOnStor = opts.CheckParentDirOnStor
+	newOpts.MaxTotalDataStreams = opts.MaxTotalDataStreams
+	newOpts.MaxConnections = opts.MaxConnections
+	newOpts.AllowedNets = opts.AllowedNets
+	newOpts.DeniedNets = opts.DeniedNets
+	newOpts.UploadRateLimit = opts.UploadRateLimit
+	newOpts.DownloadRateLimit = opts.DownloadRateLimit
+	newOpts.MaxListsPerMinute = opts.MaxListsPerMinute
+	newOpts.MaxConcurrentTransfersPerSession = opts.MaxConcurrentTransfersPerSession
+	newOpts.IncludeDotEntries = opts.IncludeDotEntries
+	newOpts.CanonicalizePathCase = opts.CanonicalizePathCase
+	newOpts.NormalizeListingNFC = opts.NormalizeListingNFC
+	newOpts.NormalizePathNFC = opts.NormalizePathNFC
+	newOpts.BusyDataStreamThreshold = opts.BusyDataStreamThreshold
+	newOpts.DeniedExtensions = opts.DeniedExtensions
+	newOpts.OnNewSubConn = opts.OnNewSubConn
+	newOpts.MaxProtocolErrors = opts.MaxProtocolErrors
+	newOpts.AuthResponseTime = opts.AuthResponseTime
+	newOpts.ProgressInterval = opts.ProgressInterval
+	newOpts.ConfineToRoot = opts.ConfineToRoot
+	newOpts.AccessLogger = opts.AccessLogger
+	newOpts.ReportCumulativeBytes = opts.ReportCumulativeBytes
+	newOpts.Metrics = opts.Metrics
+	newOpts.Events = opts.Events
+	newOpts.ResponseCodeMapper = opts.ResponseCodeMapper
+	if opts.MinTLSVersion == 0 {
+		newOpts.MinTLSVersion = tls.VersionTLS12
+	} else {
+		newOpts.MinTLSVersion = opts.MinTLSVersion
+	}
+	newOpts.CurvePreferences = opts.CurvePreferences
+	newOpts.OCSPStaple = opts.OCSPStaple
+	newOpts.OCSPFetcher = opts.OCSPFetcher
+	newOpts.OCSPRefreshInterval = opts.OCSPRefreshInterval
+	newOpts.UniqueNameFunc = opts.UniqueNameFunc
+	newOpts.ClientListStreams = opts.ClientListStreams
+	newOpts.MaxParamLength = opts.MaxParamLength
+	newOpts.MaxParamLengths = opts.MaxParamLengths
+	newOpts.ListingEndMarker = opts.ListingEndMarker
+	newOpts.UDPReadBufferSize = opts.UDPReadBufferSize
+	newOpts.UDPWriteBufferSize = opts.UDPWriteBufferSize
+	newOpts.IdleTimeout = opts.IdleTimeout
+	newOpts.KeepAlive = opts.KeepAlive
+
+	if opts.MaxStreamsPerSession == 0 {
+		newOpts.MaxStreamsPerSession = MaxStreamsPerSession
+	} else {
+		newOpts.MaxStreamsPerSession = opts.MaxStreamsPerSession
+	}
+
+	if opts.StreamFlowControlWindow == 0 {
+		newOpts.StreamFlowControlWindow = MaxStreamFlowControl
+	} else {
+		newOpts.StreamFlowControlWindow = opts.StreamFlowControlWindow
+	}
+
+	if opts.MinIdleTimeout == 0 {
+		newOpts.MinIdleTimeout = time.Second
+	} else {
+		newOpts.MinIdleTimeout = opts.MinIdleTimeout
+	}
+
+	if opts.MaxIdleTimeout == 0 {
+		newOpts.MaxIdleTimeout = opts.IdleTimeout
+	} else {
+		newOpts.MaxIdleTimeout = opts.MaxIdleTimeout
+	}
+
+	if opts.MaintenanceCommands == nil {
+		newOpts.MaintenanceCommands = defaultMaintenanceCommands
+	} else {
+		newOpts.MaintenanceCommands = opts.MaintenanceCommands
+	}
+
+	if opts.QuotaExceededMessage == "" {
+		newOpts.QuotaExceededMessage = server.ErrQuotaExceeded.Error()
+	} else {
+		newOpts.QuotaExceededMessage = opts.QuotaExceededMessage
+	}
+
+	if opts.ResumableUploadTTL == 0 {
+		newOpts.ResumableUploadTTL = 24 * time.Hour
+	} else {
+		newOpts.ResumableUploadTTL = opts.ResumableUploadTTL
+	}
+
+	if opts.MaxResumableUploads == 0 {
+		newOpts.MaxResumableUploads = 1000
+	} else {
+		newOpts.MaxResumableUploads = opts.MaxResumableUploads
+	}
+
+	if opts.LineTerminator == "" {
+		newOpts.LineTerminator = "\r\n"
+	} else {
+		newOpts.LineTerminator = opts.LineTerminator
+	}
+
 	return &newOpts
 }
 
@@ -155,9 +570,151 @@ func NewServer(opts *ServerOpts) *Server {
 	s.ServerOpts = opts
 	s.listenTo = net.JoinHostPort(opts.Hostname, strconv.Itoa(opts.Port))
 	s.logger = opts.Logger
+	s.commands = make(commandMap, len(commands))
+	for name, command := range commands {
+		s.commands[name] = command
+	}
+	s.featCmds = featCmds(s.commands)
+	s.siteCommands = make(commandMap, len(siteCommands))
+	for name, command := range siteCommands {
+		s.siteCommands[name] = command
+	}
+	if opts.MaxTotalDataStreams > 0 {
+		s.dataStreamSlots = make(chan struct{}, opts.MaxTotalDataStreams)
+	}
+	if opts.MaxConnections > 0 {
+		s.connectionSlots = make(chan struct{}, opts.MaxConnections)
+	}
+	s.maintenanceCommands = make(map[string]bool)
+	for _, command := range opts.MaintenanceCommands {
+		s.maintenanceCommands[strings.ToUpper(command)] = true
+	}
 	return s
 }
 
+// RegisterCommand adds a command to the server or replaces a built-in one.
+// The name is not case sensitive. Like DisableCommand it has to be called
+// before the server is started.
+func (server *Server) RegisterCommand(name string, command Command) {
+	server.commands[strings.ToUpper(name)] = command
+	server.featCmds = featCmds(server.commands)
+}
+
+// DisableCommand removes a command from the server, clients get 502 as for
+// an unknown command.
+func (server *Server) DisableCommand(name string) {
+	delete(server.commands, strings.ToUpper(name))
+	server.featCmds = featCmds(server.commands)
+}
+
+// RegisterSiteCommand adds a subcommand of SITE to the server or replaces a
+// built-in one, e.g. "SITE STATS" with the name "STATS". The parameter
+// following the name is passed on to its Execute. Like RegisterCommand it
+// has to be called before the server is started.
+func (server *Server) RegisterSiteCommand(name string, command Command) {
+	server.siteCommands[strings.ToUpper(name)] = command
+}
+
+// Commands returns the sorted names of the commands the server answers.
+func (server *Server) Commands() []string {
+	names := make([]string, 0, len(server.commands))
+	for name := range server.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// defaultMaintenanceCommands are the commands answered in maintenance mode,
+// if MaintenanceCommands is not set. They allow health checks but no login.
+var defaultMaintenanceCommands = []string{"FEAT", "NOOP", "QUIT", "SYST"}
+
+// SetMaintenanceMode switches the maintenance mode on or off. In maintenance
+// mode only the MaintenanceCommands are answered, other commands of new and
+// existing sessions are refused.
+func (server *Server) SetMaintenanceMode(on bool) {
+	var value int32
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&server.maintenance, value)
+}
+
+// InMaintenanceMode reports whether the server is in maintenance mode.
+func (server *Server) InMaintenanceMode() bool {
+	return atomic.LoadInt32(&server.maintenance) == 1
+}
+
+// allowedInMaintenance reports whether command with param is answered in
+// maintenance mode.
+func (server *Server) allowedInMaintenance(command string, param string) bool {
+	command = strings.ToUpper(command)
+	if command == "SITE" {
+		if fields := strings.Fields(param); len(fields) > 0 {
+			command += " " + strings.ToUpper(fields[0])
+		}
+	}
+	return server.maintenanceCommands[command]
+}
+
+// maxParamLength returns the maximum parameter length of command, zero if
+// it is unlimited.
+func (server *Server) maxParamLength(command string) int {
+	if maxLength, ok := server.MaxParamLengths[strings.ToUpper(command)]; ok {
+		return maxLength
+	}
+	return server.MaxParamLength
+}
+
+// acquireConnection reserves a slot for a new session. It returns false if
+// MaxConnections sessions are already served.
+func (server *Server) acquireConnection() bool {
+	if server.connectionSlots == nil {
+		return true
+	}
+	select {
+	case server.connectionSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseConnection frees a slot reserved by acquireConnection.
+func (server *Server) releaseConnection() {
+	if server.connectionSlots != nil {
+		<-server.connectionSlots
+	}
+}
+
+// acquireDataStream reserves a slot for a new data stream. It returns false
+// if MaxTotalDataStreams data streams are already open.
+func (server *Server) acquireDataStream() bool {
+	if server.dataStreamSlots != nil {
+		select {
+		case server.dataStreamSlots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	atomic.AddInt32(&server.openDataStreams, 1)
+	return true
+}
+
+// releaseDataStream frees a slot reserved by acquireDataStream.
+func (server *Server) releaseDataStream() {
+	atomic.AddInt32(&server.openDataStreams, -1)
+	if server.dataStreamSlots != nil {
+		<-server.dataStreamSlots
+	}
+}
+
+// isBusy reports whether the load reached the BusyDataStreamThreshold.
+func (server *Server) isBusy() bool {
+	return server.BusyDataStreamThreshold > 0 &&
+		int(atomic.LoadInt32(&server.openDataStreams)) >= server.BusyDataStreamThreshold
+}
+
 // NewConn constructs a new object that will handle the FTP protocol over
 // an active net.TCPConn. The TCP connection should already be open before
 // it is handed to this functions. driver is an instance of FTPDriver that
@@ -167,11 +724,15 @@ func (server *Server) newConn(quicSession quic.Session, driver server.Driver) (*
 	c.factory = server.Factory
 	c.session = quicSession
 	c.dataReceiveStreams = map[quic.StreamID]quic.ReceiveStream{}
+	c.idleStreams = map[quic.StreamID]*SubConn{}
 	c.structAccessMutex = sync.Mutex{}
 	c.server = server
 	c.sessionID = newSessionID()
 	c.logger = server.logger
 	c.runningSubConn = 0
+	if server.MaxConcurrentTransfersPerSession > 0 {
+		c.transferSlots = make(chan struct{}, server.MaxConcurrentTransfersPerSession)
+	}
 	return c, nil
 }
 
@@ -190,17 +751,184 @@ func simpleTLSConfig(certFile, keyFile string) (*tls.Config, error) {
 	return config, nil
 }
 
-func simpleQUICConfig() *quic.Config {
+// restrictTLSConfig applies the MinTLSVersion and CurvePreferences options
+// to config.
+func (server *Server) restrictTLSConfig(config *tls.Config) {
+	config.MinVersion = server.MinTLSVersion
+	if len(server.CurvePreferences) > 0 {
+		config.CurvePreferences = server.CurvePreferences
+	}
+}
+
+// setupOCSPStapling makes config staple the current OCSP response to its
+// certificate, if OCSPStaple or OCSPFetcher is set.
+func (server *Server) setupOCSPStapling(config *tls.Config) error {
+	if server.OCSPStaple == nil && server.OCSPFetcher == nil {
+		return nil
+	}
+	server.ocspStaple = server.OCSPStaple
+	if server.OCSPFetcher != nil {
+		if err := server.RefreshOCSPStaple(); err != nil {
+			return err
+		}
+	}
+	server.serveCertificate(config)
+	return nil
+}
+
+// serveCertificate makes config present the certificate through
+// GetCertificate, so that ReloadCertificate can replace it for new
+// handshakes.
+func (server *Server) serveCertificate(config *tls.Config) {
+	if config.GetCertificate != nil {
+		return
+	}
+	certificate := config.Certificates[0]
+	server.certificate.Store(&certificate)
+	// GetCertificate is only called without SNI if there are no Certificates
+	config.Certificates = nil
+	config.GetCertificate = server.getCertificate
+}
+
+// getCertificate returns the current certificate with the current OCSP
+// response stapled, if there is one.
+func (server *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// The lock keeps the certificate and its OCSP response together while
+	// ReloadCertificate replaces both.
+	server.ocspStapleMutex.Lock()
+	certificate := *server.certificate.Load().(*tls.Certificate)
+	if server.ocspStaple != nil {
+		certificate.OCSPStaple = server.ocspStaple
+	}
+	server.ocspStapleMutex.Unlock()
+	return &certificate, nil
+}
+
+// ReloadCertificate replaces the certificate of a running server by the one
+// in certFile and keyFile, e.g. after it was renewed. New handshakes present
+// it, open sessions are not affected. The OCSP response of the previous
+// certificate is dropped, with an OCSPFetcher a new one is fetched.
+func (server *Server) ReloadCertificate(certFile, keyFile string) error {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	server.ocspStapleMutex.Lock()
+	server.certificate.Store(&certificate)
+	server.ocspStaple = nil
+	server.ocspStapleMutex.Unlock()
+	if server.OCSPFetcher != nil {
+		if err := server.RefreshOCSPStaple(); err != nil {
+			logEntry(server.logger, levelWarn, "", "Refreshing OCSP staple failed: "+err.Error(), "error", err)
+		}
+	}
+	return nil
+}
+
+// RefreshOCSPStaple replaces the stapled OCSP response by a new one from
+// the OCSPFetcher. On error the previous response is kept.
+func (server *Server) RefreshOCSPStaple() error {
+	if server.OCSPFetcher == nil {
+		return errors.New("quic-ftp: no OCSPFetcher set")
+	}
+	staple, err := server.OCSPFetcher()
+	if err != nil {
+		return err
+	}
+	server.ocspStapleMutex.Lock()
+	server.ocspStaple = staple
+	server.ocspStapleMutex.Unlock()
+	return nil
+}
+
+// refreshOCSPStaplePeriodically refreshes the OCSP response every
+// OCSPRefreshInterval until the server is shut down.
+func (server *Server) refreshOCSPStaplePeriodically(ctx context.Context) {
+	ticker := time.NewTicker(server.OCSPRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := server.RefreshOCSPStaple(); err != nil {
+				logEntry(server.logger, levelWarn, "", "Refreshing OCSP staple failed: "+err.Error(), "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func simpleQUICConfig(opts *ServerOpts) *quic.Config {
 	config := &quic.Config{}
 	config.ConnectionIDLength = 4
-	config.MaxIncomingUniStreams = MaxStreamsPerSession
-	config.MaxIncomingStreams = MaxStreamsPerSession
-	config.MaxReceiveStreamFlowControlWindow = MaxStreamFlowControl
-	config.MaxReceiveConnectionFlowControlWindow = MaxStreamFlowControl * (MaxStreamsPerSession + 1) // + 1 buffer for controllstreams
-	config.KeepAlive = KeepAlive
+	config.MaxIncomingUniStreams = opts.MaxStreamsPerSession
+	config.MaxIncomingStreams = opts.MaxStreamsPerSession
+	config.MaxReceiveStreamFlowControlWindow = opts.StreamFlowControlWindow
+	config.MaxReceiveConnectionFlowControlWindow = opts.StreamFlowControlWindow * uint64(opts.MaxStreamsPerSession+1) // + 1 buffer for controllstreams
+	config.KeepAlive = opts.KeepAlive
 	return config
 }
 
+// socketBuffers is implemented by *net.UDPConn.
+type socketBuffers interface {
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+}
+
+// setSocketBuffers applies UDPReadBufferSize and UDPWriteBufferSize to
+// conn.
+func (server *Server) setSocketBuffers(conn socketBuffers) error {
+	if server.UDPReadBufferSize > 0 {
+		if err := conn.SetReadBuffer(server.UDPReadBufferSize); err != nil {
+			return err
+		}
+	}
+	if server.UDPWriteBufferSize > 0 {
+		if err := conn.SetWriteBuffer(server.UDPWriteBufferSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packetConnListener closes the UDP socket it was created on together with
+// the QUIC listener, which does not close a socket passed to quic.Listen.
+type packetConnListener struct {
+	quic.Listener
+	conn net.PacketConn
+}
+
+func (l *packetConnListener) Close() error {
+	err := l.Listener.Close()
+	if connErr := l.conn.Close(); err == nil {
+		err = connErr
+	}
+	return err
+}
+
+// listenWithSocketBuffers creates the UDP socket itself, unlike
+// quic.ListenAddr, to set the sizes of its buffers before listening on it.
+func (server *Server) listenWithSocketBuffers() (quic.Listener, error) {
+	addr, err := net.ResolveUDPAddr("udp", server.listenTo)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := server.setSocketBuffers(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	listener, err := quic.Listen(conn, server.tlsConfig, server.quicConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &packetConnListener{Listener: listener, conn: conn}, nil
+}
+
 // ListenAndServe asks a new Server to begin accepting client connections. It
 // accepts no arguments - all configuration is provided via the NewServer
 // function.
@@ -212,23 +940,31 @@ func simpleQUICConfig() *quic.Config {
 func (server *Server) ListenAndServe() error {
 	var listener quic.Listener
 	var err error
-	var curFeats = featCmds
 
 	server.tlsConfig, err = simpleTLSConfig(server.CertFile, server.KeyFile)
 	if err != nil {
 		return err
 	}
+	server.restrictTLSConfig(server.tlsConfig)
+	if err = server.setupOCSPStapling(server.tlsConfig); err != nil {
+		return err
+	}
+	server.serveCertificate(server.tlsConfig)
 
-	server.quicConfig = simpleQUICConfig()
+	server.quicConfig = simpleQUICConfig(server.ServerOpts)
 
-	listener, err = quic.ListenAddr(server.listenTo, server.tlsConfig, server.quicConfig)
+	if server.UDPReadBufferSize > 0 || server.UDPWriteBufferSize > 0 {
+		listener, err = server.listenWithSocketBuffers()
+	} else {
+		listener, err = quic.ListenAddr(server.listenTo, server.tlsConfig, server.quicConfig)
+	}
 	if err != nil {
 		return err
 	}
-	server.feats = fmt.Sprintf(feats, curFeats)
 
 	sessionID := ""
-	server.logger.Printf(sessionID, "%s listening on %d", server.Name, server.Port)
+	logEntry(server.logger, levelInfo, sessionID, fmt.Sprintf("%s listening on %d", server.Name, server.Port),
+		"name", server.Name, "port", server.Port)
 
 	return server.Serve(listener)
 }
@@ -237,10 +973,24 @@ func (server *Server) ListenAndServe() error {
 // request in a new goroutine.
 //
 func (server *Server) Serve(l quic.Listener) error {
+	if server.ConfineToRoot && server.Factory != nil {
+		if err := checkRealPath(server.Factory); err != nil {
+			return err
+		}
+	}
 	server.listener = l
 	server.ctx, server.cancel = context.WithCancel(context.Background())
+	if server.OCSPFetcher != nil && server.OCSPRefreshInterval > 0 {
+		go server.refreshOCSPStaplePeriodically(server.ctx)
+	}
+	go server.expireUploadsPeriodically(server.ctx)
 	sessionID := ""
 	for {
+		select {
+		case <-server.waitForResume():
+		case <-server.ctx.Done():
+			return ErrServerClosed
+		}
 		quicSession, err := server.listener.Accept()
 		if err != nil {
 			select {
@@ -248,25 +998,181 @@ func (server *Server) Serve(l quic.Listener) error {
 				return ErrServerClosed
 			default:
 			}
-			server.logger.Printf(sessionID, "listening error: %v", err)
+			logEntry(server.logger, levelError, sessionID, fmt.Sprintf("listening error: %v", err), "error", err)
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				continue
 			}
 			return err
 		}
+		// Pause may have been called while Accept was waiting.
+		select {
+		case <-server.waitForResume():
+		case <-server.ctx.Done():
+			quicSession.CloseWithError(ErrorCodeServiceUnavailable, errServiceUnavailable)
+			return ErrServerClosed
+		}
+		if !server.allowedAddr(quicSession.RemoteAddr()) {
+			logEntry(server.logger, levelWarn, sessionID, fmt.Sprintf("Refusing session from %v, address not allowed",
+				quicSession.RemoteAddr()), "remote", quicSession.RemoteAddr().String())
+			quicSession.CloseWithError(ErrorCodeServiceUnavailable, errAddressDenied)
+			continue
+		}
+		if !server.acquireConnection() {
+			logEntry(server.logger, levelWarn, sessionID, fmt.Sprintf("Refusing session from %v, MaxConnections of %d reached",
+				quicSession.RemoteAddr(), server.MaxConnections), "remote", quicSession.RemoteAddr().String())
+			quicSession.CloseWithError(ErrorCodeServiceUnavailable, errTooManyConnections)
+			continue
+		}
 		driver, err := server.Factory.NewDriver()
 		if err != nil {
-			server.logger.Printf(sessionID, "Error creating driver, aborting client connection: %v", err)
-			quicSession.Close()
+			logEntry(server.logger, levelError, sessionID, fmt.Sprintf("Error creating driver, aborting client connection: %v", err), "error", err)
+			quicSession.CloseWithError(ErrorCodeServiceUnavailable, errServiceUnavailable)
+			server.releaseConnection()
 		} else {
 			ftpConn, err := server.newConn(quicSession, driver)
 			if err != nil {
-				server.logger.Printf(sessionID, "Error establishing new connection: %v", err)
+				logEntry(server.logger, levelError, sessionID, fmt.Sprintf("Error establishing new connection: %v", err), "error", err)
 				quicSession.Close()
+				server.releaseConnection()
 				continue
 			}
-			go ftpConn.Serve()
+			if !server.trackConn(ftpConn) {
+				quicSession.CloseWithError(ErrorCodeServiceUnavailable, errServiceUnavailable)
+				server.releaseConnection()
+				continue
+			}
+			server.emitConnEvent(EventConnect, ftpConn)
+			go func() {
+				ftpConn.Serve()
+				server.emitConnEvent(EventDisconnect, ftpConn)
+				server.untrackConn(ftpConn)
+				server.releaseConnection()
+			}()
+		}
+	}
+}
+
+// Pause stops accepting new sessions until Resume is called. The listener
+// and the open sessions are not affected, new sessions wait in the
+// listener until they are accepted again or time out. A session accepted
+// right when Pause is called is held until Resume.
+func (server *Server) Pause() {
+	server.pausedMutex.Lock()
+	defer server.pausedMutex.Unlock()
+	if server.resumed == nil {
+		server.resumed = make(chan struct{})
+	}
+}
+
+// Resume continues accepting new sessions after Pause.
+func (server *Server) Resume() {
+	server.pausedMutex.Lock()
+	defer server.pausedMutex.Unlock()
+	if server.resumed != nil {
+		close(server.resumed)
+		server.resumed = nil
+	}
+}
+
+// waitForResume returns a channel, which is closed when the server is not
+// paused.
+func (server *Server) waitForResume() <-chan struct{} {
+	server.pausedMutex.Lock()
+	defer server.pausedMutex.Unlock()
+	if server.resumed == nil {
+		return closedChannel
+	}
+	return server.resumed
+}
+
+// closedChannel is returned by waitForResume, if the server is not paused.
+var closedChannel = func() chan struct{} {
+	channel := make(chan struct{})
+	close(channel)
+	return channel
+}()
+
+// allowedAddr reports whether sessions from addr are accepted according to
+// AllowedNets and DeniedNets. Addresses without an IP are only accepted if
+// both are empty.
+func (server *Server) allowedAddr(addr net.Addr) bool {
+	if len(server.AllowedNets) == 0 && len(server.DeniedNets) == 0 {
+		return true
+	}
+	var ip net.IP
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		ip = udpAddr.IP
+	} else if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+	for _, denied := range server.DeniedNets {
+		if denied.Contains(ip) {
+			return false
+		}
+	}
+	if len(server.AllowedNets) == 0 {
+		return true
+	}
+	for _, allowed := range server.AllowedNets {
+		if allowed.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackConn adds conn to the sessions ShutdownGracefully waits for. It
+// returns false if the server is shutting down already.
+func (server *Server) trackConn(conn *Conn) bool {
+	server.connsMutex.Lock()
+	defer server.connsMutex.Unlock()
+	if server.ctx.Err() != nil {
+		return false
+	}
+	if server.conns == nil {
+		server.conns = make(map[*Conn]bool)
+	}
+	server.conns[conn] = true
+	server.connsWait.Add(1)
+	return true
+}
+
+// untrackConn removes conn after its session ended.
+func (server *Server) untrackConn(conn *Conn) {
+	server.connsMutex.Lock()
+	delete(server.conns, conn)
+	server.connsMutex.Unlock()
+	server.connsWait.Done()
+}
+
+// ShutdownGracefully stops accepting new sessions like Shutdown and waits
+// until the open sessions ended, so running transfers can finish. If ctx
+// expires before, the remaining sessions are closed and the error of ctx is
+// returned.
+func (server *Server) ShutdownGracefully(ctx context.Context) error {
+	err := server.Shutdown()
+	// Sessions accepted before the shutdown are tracked by now, later ones
+	// are refused by trackConn.
+	server.connsMutex.Lock()
+	server.connsMutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		server.connsWait.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		server.connsMutex.Lock()
+		for conn := range server.conns {
+			conn.Close()
 		}
+		server.connsMutex.Unlock()
+		return ctx.Err()
 	}
 }
 
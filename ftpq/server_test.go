@@ -0,0 +1,546 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	server "github.com/attenberger/ftps_qftp-server"
+	"github.com/lucas-clemente/quic-go"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeListener hands out the given sessions and fails afterwards.
+type fakeListener struct {
+	quic.Listener
+	mutex    sync.Mutex
+	sessions []quic.Session
+	accepts  int
+}
+
+func (l *fakeListener) Accept() (quic.Session, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.accepts++
+	if len(l.sessions) == 0 {
+		return nil, errors.New("listener closed")
+	}
+	session := l.sessions[0]
+	l.sessions = l.sessions[1:]
+	return session, nil
+}
+
+func (l *fakeListener) Close() error {
+	return nil
+}
+
+type failingFactory struct{}
+
+func (f failingFactory) NewDriver() (server.Driver, error) {
+	return nil, errors.New("backend unavailable")
+}
+
+func TestServeFactoryFailure(t *testing.T) {
+	s := NewServer(&ServerOpts{Factory: failingFactory{}, Logger: &server.DiscardLogger{}})
+	session := &fakeSession{}
+	s.Serve(&fakeListener{sessions: []quic.Session{session}})
+	if !session.closed || session.closeCode != ErrorCodeServiceUnavailable {
+		t.Fatalf("session closed %v with code %d", session.closed, session.closeCode)
+	}
+	if session.closeError != errServiceUnavailable {
+		t.Errorf("unexpected close reason %v", session.closeError)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	s := NewServer(&ServerOpts{Factory: failingFactory{}, Logger: &server.DiscardLogger{}})
+	session := &fakeSession{}
+	listener := &fakeListener{sessions: []quic.Session{session}}
+
+	s.Pause()
+	s.Pause()
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(listener)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	listener.mutex.Lock()
+	accepts := listener.accepts
+	listener.mutex.Unlock()
+	if accepts != 0 {
+		t.Fatalf("%d sessions accepted while paused", accepts)
+	}
+
+	s.Resume()
+	s.Resume()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sessions not accepted after Resume")
+	}
+	if !session.closed {
+		t.Error("session was not handled after Resume")
+	}
+}
+
+// blockingListener returns the sessions sent to it, Accept blocks until
+// one arrives.
+type blockingListener struct {
+	quic.Listener
+	sessions chan quic.Session
+}
+
+func (l *blockingListener) Accept() (quic.Session, error) {
+	session, ok := <-l.sessions
+	if !ok {
+		return nil, errors.New("listener closed")
+	}
+	return session, nil
+}
+
+func (l *blockingListener) Close() error {
+	return nil
+}
+
+func TestPauseWhileAccepting(t *testing.T) {
+	s := NewServer(&ServerOpts{Factory: failingFactory{}, Logger: &server.DiscardLogger{}})
+	listener := &blockingListener{sessions: make(chan quic.Session)}
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(listener)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	s.Pause()
+	session := &fakeSession{}
+	listener.sessions <- session
+	time.Sleep(20 * time.Millisecond)
+	if session.closed {
+		t.Fatal("session accepted by a waiting Accept handled while paused")
+	}
+
+	s.Resume()
+	close(listener.sessions)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return")
+	}
+	if !session.closed {
+		t.Error("session was not handled after Resume")
+	}
+}
+
+func TestRestrictTLSConfig(t *testing.T) {
+	s := NewServer(&ServerOpts{CurvePreferences: []tls.CurveID{tls.CurveP384}})
+	config := &tls.Config{}
+	s.restrictTLSConfig(config)
+	if len(config.CurvePreferences) != 1 || config.CurvePreferences[0] != tls.CurveP384 {
+		t.Errorf("curves %v", config.CurvePreferences)
+	}
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("default minimum version %x", config.MinVersion)
+	}
+
+	s = NewServer(&ServerOpts{MinTLSVersion: tls.VersionTLS13})
+	config = &tls.Config{}
+	s.restrictTLSConfig(config)
+	if config.MinVersion != tls.VersionTLS13 {
+		t.Errorf("minimum version %x", config.MinVersion)
+	}
+}
+
+func TestOCSPStapling(t *testing.T) {
+	staple := []byte("first")
+	s := NewServer(&ServerOpts{OCSPFetcher: func() ([]byte, error) {
+		return staple, nil
+	}})
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{[]byte("cert")}}}}
+	if err := s.setupOCSPStapling(config); err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := config.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil || string(certificate.OCSPStaple) != "first" || string(certificate.Certificate[0]) != "cert" {
+		t.Fatalf("got %v, %v", certificate, err)
+	}
+
+	staple = []byte("second")
+	if err := s.RefreshOCSPStaple(); err != nil {
+		t.Fatal(err)
+	}
+	if certificate, _ := config.GetCertificate(&tls.ClientHelloInfo{}); string(certificate.OCSPStaple) != "second" {
+		t.Errorf("staple not refreshed: %q", certificate.OCSPStaple)
+	}
+}
+
+// writeCertificate writes a self-signed certificate for commonName and its
+// key to dir and returns the paths of both files.
+func writeCertificate(t *testing.T, dir string, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, commonName+".pem")
+	keyFile := filepath.Join(dir, commonName+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// handshakeCommonName returns the common name of the certificate presented
+// by a TLS server with config.
+func handshakeCommonName(t *testing.T, config *tls.Config) string {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go tls.Server(serverConn, config).Handshake()
+	client := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return client.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestReloadCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftpq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(t, dir, "old")
+	s := NewServer(&ServerOpts{CertFile: certFile, KeyFile: keyFile})
+	config, err := simpleTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serveCertificate(config)
+	if name := handshakeCommonName(t, config); name != "old" {
+		t.Errorf("before reload: got %q", name)
+	}
+
+	certFile, keyFile = writeCertificate(t, dir, "new")
+	if err := s.ReloadCertificate(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if name := handshakeCommonName(t, config); name != "new" {
+		t.Errorf("after reload: got %q", name)
+	}
+	if err := s.ReloadCertificate(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Error("missing certificate loaded")
+	}
+	if name := handshakeCommonName(t, config); name != "new" {
+		t.Errorf("after failed reload: got %q", name)
+	}
+}
+
+func TestOCSPStaplingDisabled(t *testing.T) {
+	s := NewServer(&ServerOpts{})
+	config := &tls.Config{Certificates: []tls.Certificate{{}}}
+	if err := s.setupOCSPStapling(config); err != nil || config.GetCertificate != nil || len(config.Certificates) != 1 {
+		t.Error("config changed without OCSP options")
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/file", "data")
+	cases := []struct {
+		opts    *ServerOpts
+		line    string
+		allowed bool
+	}{
+		{nil, "NOOP", true},
+		{nil, "feat", true},
+		{nil, "USER admin", false},
+		{nil, "RETR /file", false},
+		{nil, "SITE INFO /file", false},
+		{&ServerOpts{MaintenanceCommands: []string{"NOOP", "site info"}}, "SITE INFO /file", true},
+		{&ServerOpts{MaintenanceCommands: []string{"NOOP", "site info"}}, "SITE DU /", false},
+		{&ServerOpts{MaintenanceCommands: []string{"NOOP", "site info"}}, "FEAT", false},
+	}
+	for _, c := range cases {
+		subConn, control, _ := newTestSubConn(driver, c.opts)
+		subConn.connection.server.SetMaintenanceMode(true)
+		subConn.receiveLine(c.line + "\r\n")
+		refused := lastResponse(control) == "450 Server in maintenance, retry later"
+		if refused == c.allowed {
+			t.Errorf("%q: allowed %v, got %q", c.line, c.allowed, lastResponse(control))
+		}
+	}
+
+	subConn, control, _ := newTestSubConn(driver, nil)
+	subConn.connection.server.SetMaintenanceMode(true)
+	subConn.connection.server.SetMaintenanceMode(false)
+	subConn.receiveLine("RETR /file\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "226 ") {
+		t.Errorf("after maintenance: got %q", response)
+	}
+}
+
+type recordingSocketBuffers struct {
+	read, write int
+}
+
+func (b *recordingSocketBuffers) SetReadBuffer(size int) error {
+	b.read = size
+	return nil
+}
+
+func (b *recordingSocketBuffers) SetWriteBuffer(size int) error {
+	b.write = size
+	return nil
+}
+
+func TestSocketBuffers(t *testing.T) {
+	s := NewServer(&ServerOpts{Factory: failingFactory{}, UDPReadBufferSize: 2500000, UDPWriteBufferSize: 1250000})
+	buffers := &recordingSocketBuffers{}
+	if err := s.setSocketBuffers(buffers); err != nil {
+		t.Fatal(err)
+	}
+	if buffers.read != 2500000 || buffers.write != 1250000 {
+		t.Errorf("buffers set to %d and %d bytes", buffers.read, buffers.write)
+	}
+
+	s = NewServer(&ServerOpts{Factory: failingFactory{}, UDPReadBufferSize: 65536})
+	buffers = &recordingSocketBuffers{}
+	s.setSocketBuffers(buffers)
+	if buffers.read != 65536 || buffers.write != 0 {
+		t.Errorf("buffers set to %d and %d bytes", buffers.read, buffers.write)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	if err := s.setSocketBuffers(conn); err != nil {
+		t.Errorf("UDP socket: %v", err)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	s := NewServer(&ServerOpts{Factory: failingFactory{}})
+	names := s.Commands()
+	if len(names) != len(commands) || !sort.StringsAreSorted(names) {
+		t.Errorf("got %v", names)
+	}
+
+	s.RegisterCommand("xrep", reportCommand{})
+	s.DisableCommand("Dele")
+	names = s.Commands()
+	joined := "," + strings.Join(names, ",") + ","
+	if !strings.Contains(joined, ",XREP,") || strings.Contains(joined, ",DELE,") || len(names) != len(commands) {
+		t.Errorf("got %v", names)
+	}
+	if _, ok := commands["DELE"]; !ok {
+		t.Error("disabling a command changed the defaults of other servers")
+	}
+
+	subConn, control, _ := newTestSubConn(newMemDriver(), nil)
+	subConn.connection.server.DisableCommand("DELE")
+	subConn.receiveLine("DELE /file\r\n")
+	if response := lastResponse(control); response != "502 Command not found" {
+		t.Errorf("disabled command: got %q", response)
+	}
+}
+
+func TestQUICConfig(t *testing.T) {
+	config := simpleQUICConfig(serverOptsWithDefaults(&ServerOpts{}))
+	if config.MaxIncomingStreams != MaxStreamsPerSession || config.MaxIncomingUniStreams != MaxStreamsPerSession ||
+		config.MaxReceiveStreamFlowControlWindow != MaxStreamFlowControl ||
+		config.MaxReceiveConnectionFlowControlWindow != MaxStreamFlowControl*(MaxStreamsPerSession+1) || config.KeepAlive {
+		t.Errorf("defaults: got %+v", config)
+	}
+
+	config = simpleQUICConfig(serverOptsWithDefaults(&ServerOpts{
+		MaxStreamsPerSession:    10,
+		StreamFlowControlWindow: 1 << 24,
+		KeepAlive:               true,
+	}))
+	if config.MaxIncomingStreams != 10 || config.MaxIncomingUniStreams != 10 ||
+		config.MaxReceiveStreamFlowControlWindow != 1<<24 ||
+		config.MaxReceiveConnectionFlowControlWindow != 11<<24 || !config.KeepAlive {
+		t.Errorf("got %+v", config)
+	}
+}
+
+type memFactory struct{}
+
+func (f memFactory) NewDriver() (server.Driver, error) {
+	return newMemDriver(), nil
+}
+
+// idleSession is a fakeSession without control streams, AcceptStream
+// blocks until it is closed.
+type idleSession struct {
+	*fakeSession
+	done chan struct{}
+	once sync.Once
+}
+
+func newIdleSession() *idleSession {
+	return &idleSession{fakeSession: &fakeSession{}, done: make(chan struct{})}
+}
+
+func (s *idleSession) AcceptStream() (quic.Stream, error) {
+	<-s.done
+	return nil, errors.New("NO_ERROR")
+}
+
+func (s *idleSession) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return s.fakeSession.Close()
+}
+
+func TestMaxConnections(t *testing.T) {
+	s := NewServer(&ServerOpts{Factory: memFactory{}, Logger: &server.DiscardLogger{}, MaxConnections: 1})
+	first, second, third := newIdleSession(), &fakeSession{}, newIdleSession()
+	s.Serve(&fakeListener{sessions: []quic.Session{first, second}})
+	if !second.closed || second.closeCode != ErrorCodeServiceUnavailable || second.closeError != errTooManyConnections {
+		t.Errorf("second session closed %v with %d: %v", second.closed, second.closeCode, second.closeError)
+	}
+	if first.closed {
+		t.Error("first session closed")
+	}
+
+	first.Close()
+	deadline := time.Now().Add(time.Second)
+	for len(s.connectionSlots) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s.Serve(&fakeListener{sessions: []quic.Session{third}})
+	if third.closed {
+		t.Error("session refused after the first one ended")
+	}
+	third.Close()
+}
+
+// mustParseCIDR returns the network of cidr.
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+func TestAllowedAddr(t *testing.T) {
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+	denied := &net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 4242}
+	excepted := &net.UDPAddr{IP: net.IPv4(10, 9, 9, 9), Port: 4242}
+	cases := []struct {
+		opts    *ServerOpts
+		addr    net.Addr
+		allowed bool
+	}{
+		{&ServerOpts{}, denied, true},
+		{&ServerOpts{DeniedNets: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}}, loopback, true},
+		{&ServerOpts{DeniedNets: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}}, denied, false},
+		{&ServerOpts{AllowedNets: []*net.IPNet{mustParseCIDR(t, "127.0.0.0/8")}}, loopback, true},
+		{&ServerOpts{AllowedNets: []*net.IPNet{mustParseCIDR(t, "127.0.0.0/8")}}, denied, false},
+		{&ServerOpts{AllowedNets: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")},
+			DeniedNets: []*net.IPNet{mustParseCIDR(t, "10.1.0.0/16")}}, denied, false},
+		{&ServerOpts{AllowedNets: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")},
+			DeniedNets: []*net.IPNet{mustParseCIDR(t, "10.1.0.0/16")}}, excepted, true},
+		{&ServerOpts{AllowedNets: []*net.IPNet{mustParseCIDR(t, "::1/128")}},
+			&net.UDPAddr{IP: net.IPv6loopback, Port: 4242}, true},
+	}
+	for i, c := range cases {
+		if allowed := NewServer(c.opts).allowedAddr(c.addr); allowed != c.allowed {
+			t.Errorf("case %d, %v: allowed %v", i, c.addr, allowed)
+		}
+	}
+}
+
+func TestDeniedNets(t *testing.T) {
+	s := NewServer(&ServerOpts{Factory: memFactory{}, Logger: &server.DiscardLogger{},
+		DeniedNets: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}})
+	denied := &fakeSession{remoteAddr: &net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 4242}}
+	allowed := newIdleSession()
+	allowed.remoteAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+	s.Serve(&fakeListener{sessions: []quic.Session{denied, allowed}})
+	if !denied.closed || denied.closeCode != ErrorCodeServiceUnavailable || denied.closeError != errAddressDenied {
+		t.Errorf("denied session closed %v with %d: %v", denied.closed, denied.closeCode, denied.closeError)
+	}
+	if allowed.closed {
+		t.Error("loopback session closed")
+	}
+	allowed.Close()
+}
+
+func TestShutdownGracefully(t *testing.T) {
+	s := NewServer(&ServerOpts{Factory: memFactory{}, Logger: &server.DiscardLogger{}})
+	session := newIdleSession()
+	s.Serve(&fakeListener{sessions: []quic.Session{session}})
+
+	done := make(chan error)
+	go func() {
+		done <- s.ShutdownGracefully(context.Background())
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("returned with %v while a session is open", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	session.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not return after the session ended")
+	}
+}
+
+func TestShutdownGracefullyTimeout(t *testing.T) {
+	s := NewServer(&ServerOpts{Factory: memFactory{}, Logger: &server.DiscardLogger{}})
+	session := newIdleSession()
+	s.Serve(&fakeListener{sessions: []quic.Session{session}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.ShutdownGracefully(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v", err)
+	}
+	select {
+	case <-session.done:
+	default:
+		t.Error("session not closed")
+	}
+}
@@ -0,0 +1,455 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	server "github.com/attenberger/ftps_qftp-server"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxDiskUsageDepth limits how deep SITE DU descends into a directory tree.
+const maxDiskUsageDepth = 64
+
+var (
+	siteCommands = commandMap{
+		"CHMOD":   siteCommandChmod{},
+		"DU":      siteCommandDu{},
+		"IDLE":    siteCommandIdle{},
+		"INFO":    siteCommandInfo{},
+		"MKDCD":   siteCommandMkdcd{},
+		"NOW":     siteCommandNow{},
+		"RUPLOAD": siteCommandRupload{},
+		"SYNC":    siteCommandSync{},
+		"UMASK":   siteCommandUmask{},
+	}
+)
+
+// busySiteCommands are the SITE commands refused while the server is
+// overloaded, like busyCommands.
+var busySiteCommands = map[string]bool{
+	"CHMOD":   true,
+	"MKDCD":   true,
+	"RUPLOAD": true,
+}
+
+// siteFeat returns the FEAT line listing the SITE commands of a server, e.g.
+// "SITE DU;INFO".
+func siteFeat(cmds commandMap) string {
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "SITE " + strings.Join(names, ";")
+}
+
+// commandSite responds to the SITE FTP command. The first word of the
+// parameter selects one of the SITE commands of the server, the rest is
+// passed on to it.
+type commandSite struct{}
+
+func (cmd commandSite) IsExtend() bool {
+	return false
+}
+
+func (cmd commandSite) RequireParam() bool {
+	return true
+}
+
+func (cmd commandSite) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandSite) Execute(subConn *SubConn, param string) {
+	subCommand, subParam := subConn.parseLine(param)
+	cmdObj := subConn.connection.server.siteCommands[strings.ToUpper(subCommand)]
+	if cmdObj == nil {
+		subConn.writeMessage(502, "SITE command not found")
+		return
+	}
+	if cmdObj.RequireParam() && subParam == "" {
+		subConn.writeMessage(553, "action aborted, required param missing")
+	} else if cmdObj.RequireAuth() && subConn.user == "" {
+		subConn.writeMessage(530, "not logged in")
+	} else if busySiteCommands[strings.ToUpper(subCommand)] && subConn.connection.server.isBusy() {
+		subConn.writeMessage(450, "Service busy, retry later")
+	} else {
+		cmdObj.Execute(subConn, subParam)
+	}
+}
+
+// siteCommandChmod responds to the SITE CHMOD command. It changes the
+// permissions of a file to an octal mode, like "SITE CHMOD 644 file".
+type siteCommandChmod struct{}
+
+func (cmd siteCommandChmod) IsExtend() bool {
+	return false
+}
+
+func (cmd siteCommandChmod) RequireParam() bool {
+	return true
+}
+
+func (cmd siteCommandChmod) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteCommandChmod) Execute(subConn *SubConn, param string) {
+	params := strings.SplitN(param, " ", 2)
+	if len(params) != 2 || strings.TrimSpace(params[1]) == "" {
+		subConn.writeMessage(501, "Mode and path separated by a blank needed")
+		return
+	}
+	mode, ok := parseMode(params[0])
+	if !ok {
+		subConn.writeMessage(501, "Invalid mode "+params[0])
+		return
+	}
+	chmodDriver, ok := unwrapDriver(subConn.driver).(server.ChmodDriver)
+	if !ok {
+		subConn.writeMessage(502, "SITE CHMOD not supported by this server")
+		return
+	}
+	path := subConn.buildPath(strings.TrimSpace(params[1]))
+	err := checkPath(subConn.driver, path)
+	if err == nil {
+		err = chmodDriver.Chmod(path, mode)
+	}
+	if err != nil {
+		subConn.writeError(550, fmt.Sprint("Could not change permissions: ", err), err)
+		return
+	}
+	subConn.writeMessage(200, "SITE CHMOD command successful")
+}
+
+// parseMode parses octal permission bits like "644" or "0755".
+func parseMode(param string) (os.FileMode, bool) {
+	mode, err := strconv.ParseUint(param, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, false
+	}
+	return os.FileMode(mode), true
+}
+
+// siteCommandDu responds to the SITE DU command. It returns the summed up
+// size of all files below the requested path.
+type siteCommandDu struct{}
+
+func (cmd siteCommandDu) IsExtend() bool {
+	return false
+}
+
+func (cmd siteCommandDu) RequireParam() bool {
+	return false
+}
+
+func (cmd siteCommandDu) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteCommandDu) Execute(subConn *SubConn, param string) {
+	path := subConn.buildPath(param)
+	var size int64
+	var err error
+	if duDriver, ok := unwrapDriver(subConn.driver).(server.DiskUsageDriver); ok {
+		if err = checkPath(subConn.driver, path); err == nil {
+			size, err = duDriver.DiskUsage(path)
+		}
+	} else {
+		size, err = diskUsage(subConn.driver, path)
+	}
+	if err != nil {
+		subConn.writeError(550, err.Error(), err)
+		return
+	}
+	subConn.writeMessage(213, strconv.FormatInt(size, 10))
+}
+
+// diskUsage walks the tree below filePath with the drivers ListDir and sums
+// up the file sizes. Symlinks are not followed, so they can not cause loops.
+func diskUsage(driver server.Driver, filePath string) (int64, error) {
+	info, err := driver.Stat(filePath)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+	return diskUsageDir(driver, filePath, 0)
+}
+
+func diskUsageDir(driver server.Driver, dir string, depth int) (int64, error) {
+	if depth >= maxDiskUsageDepth {
+		return 0, errors.New("Directory tree too deep")
+	}
+	var size int64
+	var subDirs []string
+	err := driver.ListDir(dir, func(f server.FileInfo) error {
+		if f.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		if f.IsDir() {
+			subDirs = append(subDirs, path.Join(dir, f.Name()))
+		} else {
+			size += f.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, subDir := range subDirs {
+		subSize, err := diskUsageDir(driver, subDir, depth+1)
+		if err != nil {
+			return 0, err
+		}
+		size += subSize
+	}
+	return size, nil
+}
+
+// siteCommandIdle responds to the SITE IDLE command. It sets the idle
+// timeout of the control stream in seconds within MinIdleTimeout and
+// MaxIdleTimeout. Without a parameter it returns the current one.
+type siteCommandIdle struct{}
+
+func (cmd siteCommandIdle) IsExtend() bool {
+	return false
+}
+
+func (cmd siteCommandIdle) RequireParam() bool {
+	return false
+}
+
+func (cmd siteCommandIdle) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteCommandIdle) Execute(subConn *SubConn, param string) {
+	s := subConn.connection.server
+	if s.IdleTimeout == 0 {
+		subConn.writeMessage(502, "No idle timeout on this server")
+		return
+	}
+	if param == "" {
+		subConn.writeMessage(200, fmt.Sprintf("Idle timeout is %d seconds, maximum %d seconds",
+			int64(subConn.getIdleTimeout()/time.Second), int64(s.MaxIdleTimeout/time.Second)))
+		return
+	}
+	seconds, err := strconv.ParseInt(param, 10, 64)
+	timeout := time.Duration(seconds) * time.Second
+	if err != nil || seconds <= 0 || timeout < s.MinIdleTimeout || timeout > s.MaxIdleTimeout {
+		subConn.writeMessage(501, fmt.Sprintf("Idle timeout has to be between %d and %d seconds",
+			int64(s.MinIdleTimeout/time.Second), int64(s.MaxIdleTimeout/time.Second)))
+		return
+	}
+	atomic.StoreInt64(&subConn.idleTimeout, int64(timeout))
+	subConn.writeMessage(200, fmt.Sprintf("Idle timeout set to %d seconds", seconds))
+}
+
+// siteCommandMkdcd responds to the SITE MKDCD command. It creates a
+// directory like MKD and changes into it like CWD in one exchange. An
+// already existing directory is just changed into.
+type siteCommandMkdcd struct{}
+
+func (cmd siteCommandMkdcd) IsExtend() bool {
+	return false
+}
+
+func (cmd siteCommandMkdcd) RequireParam() bool {
+	return true
+}
+
+func (cmd siteCommandMkdcd) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteCommandMkdcd) Execute(subConn *SubConn, param string) {
+	path := subConn.buildPath(param)
+	err := subConn.driver.MakeDir(path)
+	if err == nil {
+		subConn.applyUmask(path, 0777)
+	} else if !os.IsExist(err) {
+		subConn.writeError(550, fmt.Sprint("Action not taken: ", err), err)
+		return
+	}
+	commandCwd{}.Execute(subConn, path)
+}
+
+// siteCommandNow responds to the SITE NOW command. It returns the current
+// UTC time of the server in ISO 8601 with milliseconds, e.g.
+// "2018-01-02T03:04:05.678Z", so clients can estimate the skew of their
+// clock from the round trip.
+type siteCommandNow struct{}
+
+func (cmd siteCommandNow) IsExtend() bool {
+	return false
+}
+
+func (cmd siteCommandNow) RequireParam() bool {
+	return false
+}
+
+func (cmd siteCommandNow) RequireAuth() bool {
+	return false
+}
+
+func (cmd siteCommandNow) Execute(subConn *SubConn, param string) {
+	subConn.writeMessage(200, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))
+}
+
+// siteCommandSync responds to the SITE SYNC command. It asks the driver to
+// flush a file to stable storage, by default the last uploaded one.
+type siteCommandSync struct{}
+
+func (cmd siteCommandSync) IsExtend() bool {
+	return false
+}
+
+func (cmd siteCommandSync) RequireParam() bool {
+	return false
+}
+
+func (cmd siteCommandSync) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteCommandSync) Execute(subConn *SubConn, param string) {
+	syncDriver, ok := unwrapDriver(subConn.driver).(server.SyncDriver)
+	if !ok {
+		subConn.writeMessage(502, "SITE SYNC not supported by this server")
+		return
+	}
+	path := subConn.lastUploadPath
+	if param != "" {
+		path = subConn.buildPath(param)
+	}
+	if path == "" {
+		subConn.writeMessage(501, "No file uploaded yet, path required")
+		return
+	}
+	err := checkPath(subConn.driver, path)
+	if err == nil {
+		err = syncDriver.Sync(path)
+	}
+	if err != nil {
+		subConn.writeError(550, fmt.Sprint("Sync failed: ", err), err)
+		return
+	}
+	subConn.writeMessage(200, "Synced "+path)
+}
+
+// siteCommandUmask responds to the SITE UMASK command. The octal umask is
+// cleared from the permissions of the directories and files created by MKD,
+// SITE MKDCD, STOR, STOU and SITE RUPLOAD afterwards, like "SITE UMASK 022".
+type siteCommandUmask struct{}
+
+func (cmd siteCommandUmask) IsExtend() bool {
+	return false
+}
+
+func (cmd siteCommandUmask) RequireParam() bool {
+	return true
+}
+
+func (cmd siteCommandUmask) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteCommandUmask) Execute(subConn *SubConn, param string) {
+	umask, ok := parseMode(param)
+	if !ok {
+		subConn.writeMessage(501, "Invalid umask "+param)
+		return
+	}
+	if _, ok := unwrapDriver(subConn.driver).(server.ChmodDriver); !ok {
+		subConn.writeMessage(502, "SITE UMASK not supported by this server")
+		return
+	}
+	subConn.umask = umask
+	subConn.hasUmask = true
+	subConn.writeMessage(200, fmt.Sprintf("UMASK set to %03o", umask))
+}
+
+// applyUmask sets the permissions of a newly created path to perm without
+// the bits of the umask, if one was set with SITE UMASK. Failures are only
+// logged, as the path was created anyway.
+func (subConn *SubConn) applyUmask(path string, perm os.FileMode) {
+	if !subConn.hasUmask {
+		return
+	}
+	chmodDriver, ok := unwrapDriver(subConn.driver).(server.ChmodDriver)
+	if !ok {
+		return
+	}
+	err := checkPath(subConn.driver, path)
+	if err == nil {
+		err = chmodDriver.Chmod(path, perm&^subConn.umask)
+	}
+	if err != nil {
+		subConn.log(levelWarn, fmt.Sprintf("Applying the umask to %s failed: %v", path, err), "path", path, "error", err)
+	}
+}
+
+// siteCommandInfo responds to the SITE INFO command. It returns the metadata
+// of a file as JSON object on the control stream.
+type siteCommandInfo struct{}
+
+// fileInfoJSON is the object returned by SITE INFO.
+type fileInfoJSON struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	MTime string `json:"mtime"`
+	Type  string `json:"type"`
+	Perms string `json:"perms"`
+}
+
+func (cmd siteCommandInfo) IsExtend() bool {
+	return false
+}
+
+func (cmd siteCommandInfo) RequireParam() bool {
+	return true
+}
+
+func (cmd siteCommandInfo) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteCommandInfo) Execute(subConn *SubConn, param string) {
+	filePath := subConn.buildPath(param)
+	info, err := subConn.driver.Stat(filePath)
+	if err != nil {
+		subConn.writeError(550, fmt.Sprint("File not available: ", err), err)
+		return
+	}
+	fileType := "file"
+	if info.IsDir() {
+		fileType = "dir"
+	}
+	// json.Marshal escapes all control characters, so the object always
+	// fits into a single line of the response.
+	data, err := json.Marshal(fileInfoJSON{
+		Name:  path.Base(filePath),
+		Size:  info.Size(),
+		MTime: info.ModTime().UTC().Format(time.RFC3339),
+		Type:  fileType,
+		Perms: fmt.Sprintf("%04o", info.Mode().Perm()),
+	})
+	if err != nil {
+		subConn.writeError(550, err.Error(), err)
+		return
+	}
+	subConn.writeMessageMultiline(211, "File information:\n"+string(data)+"\nEnd")
+}
@@ -0,0 +1,330 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type diskUsageMemDriver struct {
+	*memDriver
+}
+
+func (d diskUsageMemDriver) DiskUsage(path string) (int64, error) {
+	return 4711, nil
+}
+
+func newNestedMemDriver() *memDriver {
+	driver := newMemDriver()
+	driver.addDir("/a")
+	driver.addFile("/a/one", "0123456789")
+	driver.addDir("/a/b")
+	driver.addFile("/a/b/two", "01234567890123456789")
+	driver.addDir("/a/b/c")
+	driver.addFile("/a/b/c/three", "01234")
+	driver.addFile("/other", "not counted")
+	return driver
+}
+
+func TestSiteDu(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newNestedMemDriver(), nil)
+	subConn.receiveLine("SITE DU /a\r\n")
+	if response := lastResponse(control); response != "213 35" {
+		t.Errorf("SITE DU /a: got %q", response)
+	}
+	subConn.receiveLine("SITE DU /a/b/two\r\n")
+	if response := lastResponse(control); response != "213 20" {
+		t.Errorf("SITE DU /a/b/two: got %q", response)
+	}
+	subConn.receiveLine("SITE DU /missing\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "550 ") {
+		t.Errorf("SITE DU /missing: got %q", response)
+	}
+}
+
+func TestSiteDuDriverSupport(t *testing.T) {
+	subConn, control, _ := newTestSubConn(diskUsageMemDriver{newNestedMemDriver()}, nil)
+	subConn.receiveLine("SITE DU /a\r\n")
+	if response := lastResponse(control); response != "213 4711" {
+		t.Errorf("SITE DU with driver support: got %q", response)
+	}
+}
+
+func TestSiteDuDepthLimit(t *testing.T) {
+	driver := newMemDriver()
+	dir := ""
+	for i := 0; i <= maxDiskUsageDepth; i++ {
+		dir += "/d"
+		driver.addDir(dir)
+	}
+	if _, err := diskUsage(driver, "/"); err == nil {
+		t.Error("expected an error for a tree deeper than the limit")
+	}
+}
+
+func TestSiteUnknown(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), nil)
+	subConn.receiveLine("SITE FOO bar\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "502 ") {
+		t.Errorf("unknown SITE command: got %q", response)
+	}
+}
+
+type syncMemDriver struct {
+	*memDriver
+	synced []string
+}
+
+func (d *syncMemDriver) Sync(path string) error {
+	d.synced = append(d.synced, path)
+	return nil
+}
+
+func TestSiteSync(t *testing.T) {
+	driver := &syncMemDriver{memDriver: newMemDriver()}
+	subConn, control, _ := newTestSubConn(driver, nil)
+
+	subConn.receiveLine("SITE SYNC\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "501 ") {
+		t.Errorf("SITE SYNC without upload: got %q", response)
+	}
+	subConn.lastUploadPath = "/uploaded"
+	subConn.receiveLine("SITE SYNC\r\n")
+	subConn.receiveLine("SITE SYNC other\r\n")
+	if response := lastResponse(control); response != "200 Synced /other" {
+		t.Errorf("SITE SYNC other: got %q", response)
+	}
+	if strings.Join(driver.synced, ",") != "/uploaded,/other" {
+		t.Errorf("synced %v", driver.synced)
+	}
+}
+
+func TestSiteSyncUnsupported(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), nil)
+	subConn.receiveLine("SITE SYNC /file\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "502 ") {
+		t.Errorf("got %q", response)
+	}
+}
+
+func TestSiteInfo(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/a \"quoted\" file", "data")
+	driver.files["/dir"].modTime = time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	subConn, control, _ := newTestSubConn(driver, nil)
+
+	cases := map[string]fileInfoJSON{
+		"/dir/a \"quoted\" file": {Name: "a \"quoted\" file", Size: 4, MTime: "0001-01-01T00:00:00Z", Type: "file", Perms: "0644"},
+		"/dir":                   {Name: "dir", Size: 0, MTime: "2018-01-02T03:04:05Z", Type: "dir", Perms: "0755"},
+	}
+	for filePath, expected := range cases {
+		subConn.receiveLine("SITE INFO " + filePath + "\r\n")
+		lines := responses(control)
+		line := lines[len(lines)-2]
+		if lines[len(lines)-1] != "211 End" {
+			t.Fatalf("SITE INFO %s: got %q", filePath, lines)
+		}
+		var info fileInfoJSON
+		if err := json.Unmarshal([]byte(line), &info); err != nil {
+			t.Fatalf("SITE INFO %s: invalid JSON %q: %v", filePath, line, err)
+		}
+		if info != expected {
+			t.Errorf("SITE INFO %s: got %+v, want %+v", filePath, info, expected)
+		}
+	}
+}
+
+func TestSiteMkdcd(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/existing")
+	driver.addFile("/file", "data")
+	subConn, control, _ := newTestSubConn(driver, nil)
+
+	subConn.receiveLine("SITE MKDCD /new\r\n")
+	if response := lastResponse(control); response != "250 Directory changed to /new" {
+		t.Errorf("SITE MKDCD /new: got %q", response)
+	}
+	if info, err := driver.Stat("/new"); err != nil || !info.IsDir() {
+		t.Error("/new was not created")
+	}
+	subConn.receiveLine("SITE MKDCD sub\r\n")
+	if dir := subConn.CurrentDir(); dir != "/new/sub" {
+		t.Errorf("relative SITE MKDCD: current directory %q", dir)
+	}
+	subConn.receiveLine("SITE MKDCD /existing\r\n")
+	if response := lastResponse(control); response != "250 Directory changed to /existing" {
+		t.Errorf("SITE MKDCD /existing: got %q", response)
+	}
+	subConn.receiveLine("SITE MKDCD /file\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "550 ") || subConn.CurrentDir() != "/existing" {
+		t.Errorf("SITE MKDCD /file: got %q in %s", response, subConn.CurrentDir())
+	}
+}
+
+func TestSiteFeat(t *testing.T) {
+	s := NewServer(&ServerOpts{Factory: failingFactory{}})
+	s.RegisterSiteCommand("zzz", siteCommandSync{})
+	if line := siteFeat(s.siteCommands); line != "SITE CHMOD;DU;IDLE;INFO;MKDCD;NOW;RUPLOAD;SYNC;UMASK;ZZZ" {
+		t.Errorf("got %q", line)
+	}
+}
+
+func TestSiteIdle(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), &ServerOpts{
+		IdleTimeout:    time.Minute,
+		MinIdleTimeout: 10 * time.Second,
+		MaxIdleTimeout: 5 * time.Minute,
+	})
+	cases := []struct {
+		line     string
+		response string
+	}{
+		{"SITE IDLE", "200 Idle timeout is 60 seconds, maximum 300 seconds"},
+		{"SITE IDLE 10", "200 Idle timeout set to 10 seconds"},
+		{"SITE IDLE 300", "200 Idle timeout set to 300 seconds"},
+		{"SITE IDLE 9", "501 Idle timeout has to be between 10 and 300 seconds"},
+		{"SITE IDLE 301", "501 Idle timeout has to be between 10 and 300 seconds"},
+		{"SITE IDLE -5", "501 Idle timeout has to be between 10 and 300 seconds"},
+		{"SITE IDLE soon", "501 Idle timeout has to be between 10 and 300 seconds"},
+		{"SITE IDLE", "200 Idle timeout is 300 seconds, maximum 300 seconds"},
+	}
+	for _, c := range cases {
+		subConn.receiveLine(c.line + "\r\n")
+		if response := lastResponse(control); response != c.response {
+			t.Errorf("%s: got %q, want %q", c.line, response, c.response)
+		}
+	}
+	if timeout := subConn.getIdleTimeout(); timeout != 5*time.Minute {
+		t.Errorf("idle timeout %v", timeout)
+	}
+
+	subConn, control, _ = newTestSubConn(newMemDriver(), nil)
+	subConn.receiveLine("SITE IDLE 60\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "502 ") {
+		t.Errorf("SITE IDLE without idle timeout: got %q", response)
+	}
+}
+
+type chmodMemDriver struct {
+	*memDriver
+	modes map[string]os.FileMode
+}
+
+func (d *chmodMemDriver) Chmod(path string, mode os.FileMode) error {
+	if _, err := d.Stat(path); err != nil {
+		return err
+	}
+	d.modes[path] = mode
+	return nil
+}
+
+func TestSiteChmod(t *testing.T) {
+	driver := &chmodMemDriver{memDriver: newMemDriver(), modes: map[string]os.FileMode{}}
+	driver.addFile("/file name", "data")
+	subConn, control, _ := newTestSubConn(driver, nil)
+	cases := []struct {
+		line     string
+		response string
+	}{
+		{"SITE CHMOD 640 /file name", "200 SITE CHMOD command successful"},
+		{"SITE CHMOD 0755 /file name", "200 SITE CHMOD command successful"},
+		{"SITE CHMOD 1777 /file name", "501 Invalid mode 1777"},
+		{"SITE CHMOD rwx /file name", "501 Invalid mode rwx"},
+		{"SITE CHMOD 644", "501 Mode and path separated by a blank needed"},
+	}
+	for _, c := range cases {
+		subConn.receiveLine(c.line + "\r\n")
+		if response := lastResponse(control); response != c.response {
+			t.Errorf("%s: got %q, want %q", c.line, response, c.response)
+		}
+	}
+	if mode := driver.modes["/file name"]; mode != 0755 {
+		t.Errorf("mode %o", mode)
+	}
+	subConn.receiveLine("SITE CHMOD 644 /missing\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "550 ") {
+		t.Errorf("SITE CHMOD of missing file: got %q", response)
+	}
+
+	subConn, control, _ = newTestSubConn(newMemDriver(), nil)
+	subConn.receiveLine("SITE CHMOD 644 /file\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "502 ") {
+		t.Errorf("SITE CHMOD without driver support: got %q", response)
+	}
+}
+
+func TestSiteUmask(t *testing.T) {
+	driver := &chmodMemDriver{memDriver: newMemDriver(), modes: map[string]os.FileMode{}}
+	subConn, control, session := newTestSubConn(driver, nil)
+
+	subConn.receiveLine("MKD /before\r\n")
+	if _, ok := driver.modes["/before"]; ok {
+		t.Error("permissions changed without umask")
+	}
+	subConn.receiveLine("SITE UMASK 8\r\n")
+	if response := lastResponse(control); response != "501 Invalid umask 8" {
+		t.Errorf("SITE UMASK 8: got %q", response)
+	}
+	subConn.receiveLine("SITE UMASK 027\r\n")
+	if response := lastResponse(control); response != "200 UMASK set to 027" {
+		t.Errorf("SITE UMASK 027: got %q", response)
+	}
+	subConn.receiveLine("MKD /dir\r\n")
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("data")}}
+	subConn.receiveLine("STOR 2 /dir/file\r\n")
+	if mode := driver.modes["/dir"]; mode != 0750 {
+		t.Errorf("directory mode %o", mode)
+	}
+	if mode := driver.modes["/dir/file"]; mode != 0640 {
+		t.Errorf("file mode %o", mode)
+	}
+	subConn.receiveLine("SITE MKDCD /dir/sub\r\n")
+	if mode := driver.modes["/dir/sub"]; mode != 0750 {
+		t.Errorf("SITE MKDCD directory mode %o", mode)
+	}
+	subConn.receiveLine("SITE RUPLOAD START /dir/upload\r\n")
+	subConn.receiveLine("SITE RUPLOAD COMMIT " + lastResponse(control)[4:] + "\r\n")
+	if mode := driver.modes["/dir/upload"]; mode != 0640 {
+		t.Errorf("SITE RUPLOAD file mode %o", mode)
+	}
+
+	subConn, control, _ = newTestSubConn(newMemDriver(), nil)
+	subConn.receiveLine("SITE UMASK 022\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "502 ") {
+		t.Errorf("SITE UMASK without driver support: got %q", response)
+	}
+}
+
+func TestRegisterSiteCommand(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), nil)
+	subConn.connection.server.RegisterSiteCommand("report", reportCommand{})
+	subConn.receiveLine("SITE REPORT\r\n")
+	if lines := responses(control); lines[len(lines)-1] != "226 Closing data stream, sent 16 bytes" {
+		t.Errorf("got %q", lines)
+	}
+	if _, ok := siteCommands["REPORT"]; ok {
+		t.Error("registering a SITE command changed the defaults of other servers")
+	}
+}
+
+func TestSiteNow(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), nil)
+	before := time.Now().Truncate(time.Millisecond)
+	subConn.receiveLine("SITE NOW\r\n")
+	after := time.Now()
+	response := lastResponse(control)
+	if !strings.HasPrefix(response, "200 ") || len(response) != len("200 2018-01-02T03:04:05.678Z") {
+		t.Fatalf("got %q", response)
+	}
+	now, err := time.Parse("2006-01-02T15:04:05.000Z", strings.TrimPrefix(response, "200 "))
+	if err != nil || now.Before(before) || now.After(after) {
+		t.Errorf("got %q, want between %v and %v", response, before, after)
+	}
+}
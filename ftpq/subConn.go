@@ -2,13 +2,21 @@ package ftpq
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	server "github.com/attenberger/ftps_qftp-server"
 	"github.com/lucas-clemente/quic-go"
+	"golang.org/x/text/unicode/norm"
 	"io"
+	"net"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type SubConn struct {
@@ -26,37 +34,223 @@ type SubConn struct {
 	appendData    bool
 	closed        bool
 	namePrefix    string
+	// code of the last response written to the control stream
+	lastResponseCode int
+	// path of the last file uploaded successfully
+	lastUploadPath string
+	// the command being executed in upper case, for the ResponseCodeMapper
+	command string
+	// number of protocol errors since the last successful command
+	protocolErrors int
+	// checksum algorithm selected with OPTS HASH
+	hashAlgorithm string
+	// set by TYPE A, data is transferred unchanged anyway
+	asciiType bool
+	// facts sent by MLSD and MLST, selected with OPTS MLST
+	mlstFacts []string
+	// cleared from the permissions of created files if hasUmask is set,
+	// see SITE UMASK
+	umask    os.FileMode
+	hasUmask bool
+	// times of the listings within the last minute, see MaxListsPerMinute
+	listTimes []time.Time
+	// serializes writes to the control stream
+	controlMutex sync.Mutex
+	// bytes transferred over data streams by the current command
+	transferredBytes int64
+	// passed to a server.ContextDriver, canceled when Serve returns
+	ctx    context.Context
+	cancel context.CancelFunc
+	// cancels the running transfer on ABOR, guarded by transferMutex
+	transferCancel context.CancelFunc
+	transferMutex  sync.Mutex
+	// idle timeout of the control stream in nanoseconds, changed with
+	// SITE IDLE, accessed atomically
+	idleTimeout int64
+	// end of the current idle period as Unix time in nanoseconds, zero
+	// without idle timeout, accessed atomically
+	idleDeadline int64
+	// set by readLines when the idle timeout is reached, accessed atomically
+	idleTimedOut int32
+	// 1 while a command is executed, accessed atomically
+	executing int32
+	// set when the control stream is taken as data stream for a listing,
+	// guarded by the structAccessMutex of the connection
+	claimed bool
 }
 
 func (subConn *SubConn) Serve() {
-	// read commands
-	for {
-		line, err := subConn.controlReader.ReadString('\n')
-		if err != nil {
-			if err != io.EOF {
-				subConn.logger.Print(subConn.sessionID+":"+strconv.FormatUint(uint64(subConn.controlStream.StreamID()), 10), fmt.Sprint("read error:", err))
-			}
-
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	defer subConn.cancel()
+	// With ClientListStreams the stream is only known to be a control
+	// stream with its first command, before it might be taken as data
+	// stream.
+	greeted := !subConn.connection.server.ClientListStreams
+	if greeted {
+		subConn.sendLegalBanner()
+	}
+	go subConn.readLines(lines, done)
+	for line := range lines {
+		if !subConn.connection.useControlStream(subConn) {
 			break
 		}
+		if !greeted {
+			if hook := subConn.connection.server.OnNewSubConn; hook != nil {
+				hook(subConn)
+			}
+			subConn.sendLegalBanner()
+			greeted = true
+		}
+		atomic.StoreInt32(&subConn.executing, 1)
 		subConn.receiveLine(line)
 		// QUIT command closes connection, break to avoid error on reading from
 		// closed socket
 		if subConn.closed == true {
 			break
 		}
+		// The idle period starts when the command is done.
+		subConn.armIdleTimeout()
+		atomic.StoreInt32(&subConn.executing, 0)
+	}
+	if atomic.LoadInt32(&subConn.idleTimedOut) == 1 && !subConn.closed &&
+		subConn.connection.useControlStream(subConn) {
+		subConn.writeMessage(421, "Idle timeout, closing control stream")
+		subConn.Close()
+		subConn.connection.ReportSubConnFinsihed()
+	}
+	subConn.log(levelInfo, "Stream Terminated")
+}
+
+// sendLegalBanner sends the LegalBanner, if it is set.
+func (subConn *SubConn) sendLegalBanner() {
+	if banner := subConn.connection.server.LegalBanner; banner != "" {
+		subConn.writeMessageMultiline(220, banner)
+	}
+}
+
+// readLines reads commands from the control stream and passes them on to
+// Serve until the stream ends or done is closed. ABOR aborts the running
+// transfer right away, since Serve executes it only after the transfer.
+// If no command arrives within the idle timeout, unless a command is still
+// executed, it stops and Serve closes the control stream. It also stops
+// when the stream is taken as data stream.
+func (subConn *SubConn) readLines(lines chan<- string, done <-chan struct{}) {
+	defer close(lines)
+	pending := ""
+	for {
+		subConn.armIdleTimeout()
+		// Checked after arming, the deadline set when the stream is
+		// taken must not be overwritten.
+		if subConn.connection.isClaimed(subConn) {
+			return
+		}
+		line, err := subConn.controlReader.ReadString('\n')
+		line = pending + line
+		pending = ""
+		// A deadline set by someone else, like QUIT, ends reading.
+		if isTimeout(err) && subConn.idleTimeoutReached() {
+			if atomic.LoadInt32(&subConn.executing) == 1 {
+				pending = line
+				continue
+			}
+			atomic.StoreInt32(&subConn.idleTimedOut, 1)
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !isTimeout(err) {
+				subConn.log(levelWarn, fmt.Sprint("read error:", err), "error", err)
+			}
+			// Stop the driver at once, Serve might wait for it.
+			subConn.cancel()
+			return
+		}
+		if isAbort(line) {
+			subConn.abortTransfer()
+			line = strings.TrimLeft(line, telnetAbortPrefix)
+		}
+		select {
+		case lines <- line:
+		case <-done:
+			return
+		}
 	}
-	subConn.logger.Print(subConn.sessionID+":"+strconv.FormatUint(uint64(subConn.controlStream.StreamID()), 10), "Stream Terminated")
 }
 
 func (subConn *SubConn) LoginUser() string {
 	return subConn.user
 }
 
+// SessionID returns the ID of the QUIC session the SubConn belongs to.
+func (subConn *SubConn) SessionID() string {
+	return subConn.sessionID
+}
+
+// ControlStreamID returns the ID of the QUIC stream used for the commands.
+func (subConn *SubConn) ControlStreamID() quic.StreamID {
+	return subConn.controlStream.StreamID()
+}
+
+// CurrentDir returns the current working directory of the client.
+func (subConn *SubConn) CurrentDir() string {
+	return subConn.namePrefix
+}
+
 func (subConn *SubConn) IsLogin() bool {
 	return len(subConn.user) > 0
 }
 
+// resetSession brings the SubConn back into the state of a new control
+// stream: logged out, in the root directory and with the default options.
+func (subConn *SubConn) resetSession() {
+	subConn.user = ""
+	subConn.reqUser = ""
+	subConn.namePrefix = "/"
+	subConn.renameFrom = ""
+	subConn.lastFilePos = 0
+	subConn.appendData = false
+	subConn.lastUploadPath = ""
+	subConn.asciiType = false
+	subConn.hashAlgorithm = defaultHashAlgorithm
+	subConn.mlstFacts = defaultMlstFacts
+	subConn.umask = 0
+	subConn.hasUmask = false
+	subConn.protocolErrors = 0
+	atomic.StoreInt64(&subConn.idleTimeout, int64(subConn.connection.server.IdleTimeout))
+}
+
+// Reply sends a response to the client. It is meant for commands
+// implemented outside of this package.
+func (subConn *SubConn) Reply(code int, message string) error {
+	_, err := subConn.writeMessage(code, message)
+	return err
+}
+
+// OpenSendStream opens a new unidirectional data stream to the client. The
+// caller has to announce it with a 150 reply containing the stream ID,
+// close it after writing the data and confirm the transfer with a 226 reply.
+func (subConn *SubConn) OpenSendStream() (quic.SendStream, error) {
+	return subConn.connection.getNewSendDataStream()
+}
+
+// SendData transfers data to the client over a new data stream. It sends
+// the 150 and 226 replies itself. If no stream could be opened 425 is sent
+// and the error is returned, as is the error of sending the 150 reply.
+func (subConn *SubConn) SendData(data []byte) error {
+	stream, err := subConn.OpenSendStream()
+	if err != nil {
+		subConn.writeMessage(425, "Can't open data stream.")
+		return err
+	}
+	if _, err := subConn.writeMessage(150, fmt.Sprintf("%d Opening data stream", stream.StreamID())); err != nil {
+		stream.Close()
+		return err
+	}
+	subConn.sendOutofbandData(data, stream)
+	return nil
+}
+
 // Close will manually close this connection, even if the client isn't ready.
 func (subConn *SubConn) Close() {
 	subConn.controlStream.Close()
@@ -65,22 +259,65 @@ func (subConn *SubConn) Close() {
 
 // writeMessage will send a standard FTP response back to the client.
 func (subConn *SubConn) writeMessage(code int, message string) (wrote int, err error) {
-	subConn.logger.PrintResponse(subConn.sessionID+":"+strconv.FormatUint(uint64(subConn.controlStream.StreamID()), 10), code, message)
-	line := fmt.Sprintf("%d %s\r\n", code, message)
+	subConn.logResponse(code, message)
+	subConn.controlMutex.Lock()
+	defer subConn.controlMutex.Unlock()
+	subConn.lastResponseCode = code
+	line := fmt.Sprintf("%d %s%s", code, message, subConn.connection.server.LineTerminator)
 	wrote, err = subConn.controlWriter.WriteString(line)
-	subConn.controlWriter.Flush()
+	if flushErr := subConn.controlWriter.Flush(); err == nil {
+		err = flushErr
+	}
 	return
 }
 
-// writeMessage will send a standard FTP response back to the client.
+// writeMessageMultiline will send a multiline FTP response back to the
+// client. Each line of the message becomes a line of the response, the
+// last one is sent after the code to terminate the response.
 func (subConn *SubConn) writeMessageMultiline(code int, message string) (wrote int, err error) {
-	subConn.logger.PrintResponse(subConn.sessionID+":"+strconv.FormatUint(uint64(subConn.controlStream.StreamID()), 10), code, message)
-	line := fmt.Sprintf("%d-%s\r\n%d END\r\n", code, message, code)
-	wrote, err = subConn.controlWriter.WriteString(line)
-	subConn.controlWriter.Flush()
+	subConn.logResponse(code, message)
+	subConn.controlMutex.Lock()
+	defer subConn.controlMutex.Unlock()
+	subConn.lastResponseCode = code
+	lines := formatMultiline(code, message, subConn.connection.server.LineTerminator)
+	wrote, err = subConn.controlWriter.WriteString(lines)
+	if flushErr := subConn.controlWriter.Flush(); err == nil {
+		err = flushErr
+	}
 	return
 }
 
+// formatMultiline formats a message spanning several lines in the
+// continuation format of RFC 959:
+//
+//    123-First line
+//    Second line
+//     234 A line beginning with numbers
+//    123 The last line
+//
+// Lines within the message starting with a digit are indented by a blank,
+// so they are not mistaken for the end of the response. A message with a
+// single line results in a single line response.
+func formatMultiline(code int, message string, terminator string) string {
+	lines := strings.Split(strings.TrimRight(message, "\r\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+	last := len(lines) - 1
+	var buf bytes.Buffer
+	if last > 0 {
+		fmt.Fprintf(&buf, "%d-%s%s", code, lines[0], terminator)
+		for _, line := range lines[1:last] {
+			if len(line) > 0 && line[0] >= '0' && line[0] <= '9' {
+				line = " " + line
+			}
+			buf.WriteString(line + terminator)
+		}
+	}
+	fmt.Fprintf(&buf, "%d %s%s", code, lines[last], terminator)
+	return buf.String()
+}
+
 // buildPath takes a client supplied path or filename and generates a safe
 // absolute path within their account sandbox.
 //
@@ -95,6 +332,9 @@ func (subConn *SubConn) writeMessageMultiline(code int, message string) (wrote i
 //    buildpath("/../../../../etc/passwd")
 //    => "/etc/passwd"
 //
+// With the NormalizePathNFC option the path is converted to the Unicode
+// normalization form C, with the CanonicalizePathCase option to lower case.
+//
 // The driver implementation is responsible for deciding how to treat this path.
 // Obviously they MUST NOT just read the path off disk. The probably want to
 // prefix the path with something to scope the users access to a sandbox.
@@ -108,6 +348,12 @@ func (subConn *SubConn) buildPath(filename string) (fullPath string) {
 	}
 	fullPath = strings.Replace(fullPath, "//", "/", -1)
 	fullPath = strings.Replace(fullPath, string(filepath.Separator), "/", -1)
+	if subConn.connection.server.NormalizePathNFC {
+		fullPath = norm.NFC.String(fullPath)
+	}
+	if subConn.connection.server.CanonicalizePathCase {
+		fullPath = strings.ToLower(fullPath)
+	}
 	return
 }
 
@@ -115,18 +361,119 @@ func (subConn *SubConn) buildPath(filename string) (fullPath string) {
 // appropriate response.
 func (subConn *SubConn) receiveLine(line string) {
 	command, param := subConn.parseLine(line)
-	subConn.logger.PrintCommand(subConn.sessionID+":"+strconv.FormatUint(uint64(subConn.controlStream.StreamID()), 10), command, param)
-	cmdObj := commands[strings.ToUpper(command)]
+	subConn.logCommand(command, param)
+	subConn.lastResponseCode = 0
+	subConn.transferredBytes = 0
+	subConn.command = strings.ToUpper(command)
+	if accessLogger := subConn.connection.server.AccessLogger; accessLogger != nil {
+		defer subConn.logAccess(accessLogger, command, param)
+	}
+	if commandLogger, ok := unwrapDriver(subConn.driver).(server.CommandLogger); ok {
+		defer subConn.logToDriver(commandLogger, command, param)
+	}
+	defer subConn.emitCommandEvents(command, param)
+	cmdObj := subConn.connection.server.commands[strings.ToUpper(command)]
 	if cmdObj == nil {
 		subConn.writeMessage(502, "Command not found")
+		subConn.protocolError()
 		return
 	}
-	if cmdObj.RequireParam() && param == "" {
+	if subConn.connection.server.InMaintenanceMode() && !subConn.connection.server.allowedInMaintenance(command, param) {
+		subConn.writeMessage(450, "Server in maintenance, retry later")
+	} else if cmdObj.RequireParam() && param == "" {
 		subConn.writeMessage(553, "action aborted, required param missing")
+		subConn.protocolError()
+	} else if maxLength := subConn.connection.server.maxParamLength(command); maxLength > 0 && len(param) > maxLength {
+		subConn.writeMessage(501, "Parameter too long")
+		subConn.protocolError()
 	} else if cmdObj.RequireAuth() && subConn.user == "" {
 		subConn.writeMessage(530, "not logged in")
+	} else if busyCommands[strings.ToUpper(command)] && subConn.connection.server.isBusy() {
+		subConn.writeMessage(450, "Service busy, retry later")
+	} else if transferCommands[strings.ToUpper(command)] && !subConn.connection.acquireTransfer() {
+		subConn.writeMessage(425, "Too many concurrent transfers")
 	} else {
+		if transferCommands[strings.ToUpper(command)] {
+			defer subConn.connection.releaseTransfer()
+		}
+		start := time.Now()
 		cmdObj.Execute(subConn, param)
+		if metrics := subConn.connection.server.Metrics; metrics != nil {
+			metrics.ObserveCommand(strings.ToUpper(command), time.Since(start))
+		}
+		subConn.logCommandDone(command, time.Since(start))
+		if subConn.lastResponseCode == 503 {
+			subConn.protocolError()
+		} else if subConn.lastResponseCode < 400 {
+			subConn.protocolErrors = 0
+		}
+	}
+}
+
+// protocolError counts a malformed or out of sequence command and closes
+// the control stream when MaxProtocolErrors is reached.
+func (subConn *SubConn) protocolError() {
+	subConn.protocolErrors++
+	maxErrors := subConn.connection.server.MaxProtocolErrors
+	if maxErrors > 0 && subConn.protocolErrors >= maxErrors {
+		subConn.writeMessage(421, "Too many protocol errors, closing control stream")
+		subConn.Close()
+		subConn.connection.ReportSubConnFinsihed()
+	}
+}
+
+// padAuthResponse sleeps until AuthResponseTime has passed since start, so
+// that USER and PASS answer in constant time.
+func (subConn *SubConn) padAuthResponse(start time.Time) {
+	responseTime := subConn.connection.server.AuthResponseTime
+	if remaining := responseTime - time.Since(start); remaining > 0 {
+		time.Sleep(remaining)
+	}
+}
+
+// logAccess hands a completed command to the servers access log.
+func (subConn *SubConn) logAccess(accessLogger server.AccessLogger, command string, param string) {
+	command = strings.ToUpper(command)
+	if command == "PASS" {
+		param = "****"
+	}
+	accessLogger.LogAccess(server.AccessEntry{
+		RemoteAddr: subConn.connection.session.RemoteAddr().String(),
+		User:       subConn.user,
+		Time:       time.Now(),
+		Command:    command,
+		Param:      param,
+		Code:       subConn.lastResponseCode,
+		Bytes:      subConn.transferredBytes,
+	})
+}
+
+// logToDriver hands an executed command to the drivers audit trail.
+func (subConn *SubConn) logToDriver(commandLogger server.CommandLogger, command string, param string) {
+	command = strings.ToUpper(command)
+	if command == "PASS" {
+		param = "****"
+	}
+	user := subConn.user
+	if user == "" {
+		user = subConn.reqUser
+	}
+	commandLogger.LogCommand(user, command, param, subConn.lastResponseCode)
+}
+
+// observeTransfer reports a finished transfer to the Metrics of the server,
+// if they implement server.TransferMetrics.
+func (subConn *SubConn) observeTransfer(direction string, bytes int64, start time.Time) {
+	if transferMetrics, ok := subConn.connection.server.Metrics.(server.TransferMetrics); ok {
+		transferMetrics.ObserveTransfer(direction, bytes, time.Since(start))
+	}
+}
+
+// observeAuth reports a login attempt to the Metrics of the server, if they
+// implement server.AuthMetrics.
+func (subConn *SubConn) observeAuth(user string, ok bool) {
+	if authMetrics, isAuthMetrics := subConn.connection.server.Metrics.(server.AuthMetrics); isAuthMetrics {
+		authMetrics.ObserveAuth(user, ok)
 	}
 }
 
@@ -138,29 +485,159 @@ func (subConn *SubConn) parseLine(line string) (string, string) {
 	return params[0], strings.TrimSpace(params[1])
 }
 
+// listDir calls callback for the entries of the directory dir to list. The
+// temporary files of resumable uploads are left out.
+func (subConn *SubConn) listDir(dir string, callback func(server.FileInfo) error) error {
+	return listDirContext(subConn.ctx, subConn.driver, dir, func(f server.FileInfo) error {
+		if isUploadTempName(f.Name()) {
+			return nil
+		}
+		return callback(f)
+	})
+}
+
+// listFormatter prepares files for a directory listing according to the
+// server options.
+func (subConn *SubConn) listFormatter(files []server.FileInfo) server.ListFormatter {
+	formatter := server.ListFormatter(files)
+	if subConn.connection.server.NormalizeListingNFC {
+		formatter = formatter.NFC()
+	}
+	return formatter
+}
+
+// getIdleTimeout returns the idle timeout of the control stream, zero if
+// there is none.
+func (subConn *SubConn) getIdleTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&subConn.idleTimeout))
+}
+
+// armIdleTimeout starts a new idle period of the control stream, if there
+// is an idle timeout.
+func (subConn *SubConn) armIdleTimeout() {
+	timeout := subConn.getIdleTimeout()
+	if timeout <= 0 {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	atomic.StoreInt64(&subConn.idleDeadline, deadline.UnixNano())
+	subConn.controlStream.SetReadDeadline(deadline)
+}
+
+// idleTimeoutReached reports whether the current idle period is over.
+func (subConn *SubConn) idleTimeoutReached() bool {
+	deadline := atomic.LoadInt64(&subConn.idleDeadline)
+	return deadline != 0 && time.Now().UnixNano() >= deadline
+}
+
+// isTimeout reports whether err is caused by a read deadline.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 // sendOutofbandData will send a string to the client via the currently open
-// data socket. Assumes the socket is open and ready to be used.
+// data socket. Assumes the socket is open and ready to be used. The stream
+// is closed before 226 is sent, so the client has seen the end of the data
+// when it reads the reply.
 func (subConn *SubConn) sendOutofbandData(data []byte, stream quic.SendStream) quic.StreamID {
-	bytes := len(data)
-	stream.Write(data)
+	bytes, err := stream.Write(data)
+	subConn.transferredBytes += int64(bytes)
 	streamID := stream.StreamID()
-	stream.Close()
-	message := "Closing data strea,, sent " + strconv.Itoa(bytes) + " bytes"
+	if closeErr := stream.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		subConn.writeMessage(426, fmt.Sprint("Data stream failed: ", err))
+		return streamID
+	}
+	message := "Closing data stream, sent " + strconv.Itoa(bytes) + " bytes"
 	subConn.writeMessage(226, message)
 
 	return streamID
 }
 
+// sendListing sends the listing of LIST, NLST or MLSD followed by the
+// ListingEndMarker line, if it is set.
+func (subConn *SubConn) sendListing(listing []byte, stream quic.SendStream) {
+	if marker := subConn.connection.server.ListingEndMarker; marker != "" {
+		listing = append(listing, marker+"\r\n"...)
+	}
+	subConn.sendOutofbandData(listing, stream)
+}
+
+// progressWriter wraps the data stream of a download and writes a 150
+// response to the control stream every interval bytes.
+type progressWriter struct {
+	quic.SendStream
+	subConn  *SubConn
+	total    int64
+	interval int64
+	sent     int64
+	next     int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if int64(len(chunk)) > w.next-w.sent {
+			chunk = chunk[:w.next-w.sent]
+		}
+		n, err := w.SendStream.Write(chunk)
+		written += n
+		w.sent += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if w.sent == w.next {
+			w.next += w.interval
+			if w.total == server.SizeUnknown {
+				w.subConn.writeMessage(150, fmt.Sprintf("Transferred %d bytes", w.sent))
+			} else if w.sent < w.total {
+				w.subConn.writeMessage(150, fmt.Sprintf("Transferred %d of %d bytes", w.sent, w.total))
+			}
+		}
+	}
+	return written, nil
+}
+
+// sendOutofBandDataWriter copies the data read from the driver to the
+// stream. The reader is handed to io.Copy unwrapped, so a driver reader
+// implementing io.WriterTo (or a stream implementing io.ReaderFrom) is used
+// for the transfer instead of an intermediate buffer.
 func (subConn *SubConn) sendOutofBandDataWriter(data io.ReadCloser, stream quic.SendStream) error {
+	offset := subConn.lastFilePos
 	subConn.lastFilePos = 0
+	if rate := subConn.connection.server.DownloadRateLimit; rate > 0 {
+		stream = &rateLimitedStream{SendStream: stream, limiter: newRateLimiter(rate)}
+	}
+	ctx, endTransfer := subConn.beginTransfer(func() {
+		stream.CancelWrite(ErrorCodeTransferAborted)
+	})
+	defer endTransfer()
+	start := time.Now()
 	bytes, err := io.Copy(stream, data)
+	subConn.transferredBytes += bytes
+	subConn.observeTransfer(server.TransferDownload, bytes, start)
+	if ctx.Err() != nil {
+		// The stream has been reset already, Close only releases its slot.
+		stream.Close()
+		return ctx.Err()
+	}
 	if err != nil {
 		stream.Close()
 		return err
 	}
+	// Close the stream before confirming the transfer, so the client has
+	// seen the end of the data, even if there was none, when it reads 226.
+	stream.Close()
+	if subConn.connection.server.ReportCumulativeBytes {
+		bytes += offset
+	}
 	message := "Closing data stream, sent " + strconv.Itoa(int(bytes)) + " bytes"
 	subConn.writeMessage(226, message)
-	stream.Close()
 
 	return nil
 }
@@ -0,0 +1,998 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	server "github.com/attenberger/ftps_qftp-server"
+	"github.com/lucas-clemente/quic-go"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStream is an in-memory quic.Stream. Only the methods used by the
+// server are implemented, calling any other one panics.
+type fakeStream struct {
+	quic.Stream
+	id      quic.StreamID
+	reader  io.Reader
+	mutex   sync.Mutex
+	written bytes.Buffer
+	closed  bool
+	// if set, writes fail like on a broken stream
+	failWrites bool
+	// error code the stream was reset with by CancelWrite or CancelRead
+	cancelCode quic.ErrorCode
+}
+
+func (s *fakeStream) StreamID() quic.StreamID {
+	return s.id
+}
+
+func (s *fakeStream) Read(p []byte) (int, error) {
+	if s.reader == nil {
+		return 0, io.EOF
+	}
+	return s.reader.Read(p)
+}
+
+func (s *fakeStream) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failWrites || s.cancelCode != 0 {
+		return 0, errors.New("stream reset")
+	}
+	return s.written.Write(p)
+}
+
+func (s *fakeStream) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *fakeStream) CancelWrite(code quic.ErrorCode) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cancelCode = code
+	return nil
+}
+
+func (s *fakeStream) CancelRead(code quic.ErrorCode) error {
+	return s.CancelWrite(code)
+}
+
+func (s *fakeStream) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (s *fakeStream) String() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.written.String()
+}
+
+// fakeSession is an in-memory quic.Session handing out fakeStreams.
+type fakeSession struct {
+	quic.Session
+	mutex          sync.Mutex
+	sendStreams    []*fakeStream
+	receiveStreams []*fakeStream
+	closed         bool
+	closeCode      quic.ErrorCode
+	closeError     error
+	// returned by RemoteAddr instead of 192.0.2.1:4242, if set
+	remoteAddr net.Addr
+}
+
+func (s *fakeSession) OpenUniStreamSync() (quic.SendStream, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stream := &fakeStream{id: quic.StreamID(3 + 4*len(s.sendStreams))}
+	s.sendStreams = append(s.sendStreams, stream)
+	return stream, nil
+}
+
+func (s *fakeSession) AcceptUniStream() (quic.ReceiveStream, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.receiveStreams) == 0 {
+		return nil, errors.New("no stream available")
+	}
+	stream := s.receiveStreams[0]
+	s.receiveStreams = s.receiveStreams[1:]
+	return stream, nil
+}
+
+func (s *fakeSession) RemoteAddr() net.Addr {
+	if s.remoteAddr != nil {
+		return s.remoteAddr
+	}
+	return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4242}
+}
+
+func (s *fakeSession) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *fakeSession) CloseWithError(code quic.ErrorCode, err error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	s.closeCode = code
+	s.closeError = err
+	return nil
+}
+
+// memFile is a file or directory of the memDriver.
+type memFile struct {
+	name    string
+	dir     bool
+	data    []byte
+	modTime time.Time
+}
+
+func (f *memFile) Name() string       { return f.name }
+func (f *memFile) Size() int64        { return int64(len(f.data)) }
+func (f *memFile) ModTime() time.Time { return f.modTime }
+func (f *memFile) IsDir() bool        { return f.dir }
+func (f *memFile) Sys() interface{}   { return nil }
+func (f *memFile) Owner() string      { return "owner" }
+func (f *memFile) Group() string      { return "group" }
+
+func (f *memFile) Mode() os.FileMode {
+	if f.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// memDriver is a server.Driver keeping all files in memory.
+type memDriver struct {
+	mutex sync.Mutex
+	files map[string]*memFile
+}
+
+func newMemDriver() *memDriver {
+	driver := &memDriver{files: map[string]*memFile{}}
+	driver.files["/"] = &memFile{name: "/", dir: true}
+	return driver
+}
+
+func (d *memDriver) addDir(filePath string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.files[filePath] = &memFile{name: path.Base(filePath), dir: true}
+}
+
+func (d *memDriver) addFile(filePath string, data string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.files[filePath] = &memFile{name: path.Base(filePath), data: []byte(data)}
+}
+
+func (d *memDriver) content(filePath string) (string, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	f, ok := d.files[filePath]
+	if !ok {
+		return "", false
+	}
+	return string(f.data), true
+}
+
+func (d *memDriver) Stat(filePath string) (server.FileInfo, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	f, ok := d.files[filePath]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return f, nil
+}
+
+func (d *memDriver) ChangeDir(filePath string) error {
+	info, err := d.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory")
+	}
+	return nil
+}
+
+func (d *memDriver) children(dir string) []string {
+	var names []string
+	for name := range d.files {
+		if name != dir && path.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *memDriver) ListDir(dir string, callback func(server.FileInfo) error) error {
+	d.mutex.Lock()
+	var files []server.FileInfo
+	for _, name := range d.children(dir) {
+		files = append(files, d.files[name])
+	}
+	d.mutex.Unlock()
+	for _, f := range files {
+		if err := callback(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *memDriver) DeleteDir(filePath string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.files[filePath]; !ok {
+		return os.ErrNotExist
+	}
+	if len(d.children(filePath)) > 0 {
+		return errors.New("directory not empty")
+	}
+	delete(d.files, filePath)
+	return nil
+}
+
+func (d *memDriver) DeleteFile(filePath string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.files[filePath]; !ok {
+		return os.ErrNotExist
+	}
+	delete(d.files, filePath)
+	return nil
+}
+
+func (d *memDriver) Rename(from string, to string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	f, ok := d.files[from]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if _, ok := d.files[to]; ok {
+		return os.ErrExist
+	}
+	delete(d.files, from)
+	f.name = path.Base(to)
+	d.files[to] = f
+	return nil
+}
+
+func (d *memDriver) MakeDir(filePath string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.files[filePath]; ok {
+		return os.ErrExist
+	}
+	d.files[filePath] = &memFile{name: path.Base(filePath), dir: true}
+	return nil
+}
+
+func (d *memDriver) GetFile(filePath string, offset int64) (int64, io.ReadCloser, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	f, ok := d.files[filePath]
+	if !ok {
+		return 0, nil, os.ErrNotExist
+	}
+	data := f.data[offset:]
+	return int64(len(data)), ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (d *memDriver) PutFile(filePath string, data io.Reader, appendData bool) (int64, error) {
+	content, err := ioutil.ReadAll(data)
+	if err != nil {
+		return 0, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	f, ok := d.files[filePath]
+	if !ok || !appendData {
+		f = &memFile{name: path.Base(filePath)}
+		d.files[filePath] = f
+	}
+	f.data = append(f.data, content...)
+	return int64(len(content)), nil
+}
+
+// newTestSubConn returns a logged in SubConn on top of fake QUIC streams.
+func newTestSubConn(driver server.Driver, opts *ServerOpts) (*SubConn, *fakeStream, *fakeSession) {
+	if opts == nil {
+		opts = &ServerOpts{}
+	}
+	if opts.Logger == nil {
+		opts.Logger = &server.DiscardLogger{}
+	}
+	if opts.Auth == nil {
+		opts.Auth = &server.SimpleAuth{Name: "admin", Password: "secret"}
+	}
+	s := NewServer(opts)
+	session := &fakeSession{}
+	conn, _ := s.newConn(session, driver)
+	control := &fakeStream{}
+	subConn := conn.newSubConn(control, driver)
+	subConn.user = "admin"
+	return subConn, control, session
+}
+
+// responses splits everything written to the control stream into lines.
+func responses(control *fakeStream) []string {
+	return strings.Split(strings.TrimSuffix(control.String(), "\r\n"), "\r\n")
+}
+
+// lastResponse returns the last line written to the control stream.
+func lastResponse(control *fakeStream) string {
+	lines := responses(control)
+	return lines[len(lines)-1]
+}
+
+func TestBuildPath(t *testing.T) {
+	subConn, _, _ := newTestSubConn(newMemDriver(), nil)
+	subConn.namePrefix = "/files"
+	cases := map[string]string{
+		"":                        "/files",
+		"/":                       "/",
+		"one.txt":                 "/files/one.txt",
+		"/two.txt":                "/two.txt",
+		"../three.txt":            "/three.txt",
+		"/../../../../etc/passwd": "/etc/passwd",
+	}
+	for param, expected := range cases {
+		if result := subConn.buildPath(param); result != expected {
+			t.Errorf("buildPath(%q) = %q, want %q", param, result, expected)
+		}
+	}
+}
+
+// writerToReader only supports being copied via io.WriterTo.
+type writerToReader struct {
+	data     []byte
+	usedRead bool
+	usedWrTo bool
+}
+
+func (r *writerToReader) Read(p []byte) (int, error) {
+	r.usedRead = true
+	return 0, errors.New("Read must not be used")
+}
+
+func (r *writerToReader) WriteTo(w io.Writer) (int64, error) {
+	r.usedWrTo = true
+	n, err := w.Write(r.data)
+	return int64(n), err
+}
+
+func (r *writerToReader) Close() error {
+	return nil
+}
+
+func TestSendOutofBandDataWriterUsesWriterTo(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), nil)
+	stream := &fakeStream{id: 3}
+	reader := &writerToReader{data: []byte("zero copy")}
+	if err := subConn.sendOutofBandDataWriter(reader, stream); err != nil {
+		t.Fatal(err)
+	}
+	if !reader.usedWrTo || reader.usedRead {
+		t.Error("WriteTo of the driver reader was not used")
+	}
+	if stream.String() != "zero copy" {
+		t.Errorf("got %q on the data stream", stream.String())
+	}
+	if response := lastResponse(control); response != "226 Closing data stream, sent 9 bytes" {
+		t.Errorf("got %q", response)
+	}
+}
+
+func benchmarkSendOutofBandDataWriter(b *testing.B, newReader func([]byte) io.ReadCloser) {
+	subConn, _, _ := newTestSubConn(newMemDriver(), nil)
+	data := make([]byte, 1<<20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream := &fakeStream{id: 3}
+		subConn.sendOutofBandDataWriter(newReader(data), stream)
+	}
+}
+
+func BenchmarkSendOutofBandDataWriterReader(b *testing.B) {
+	benchmarkSendOutofBandDataWriter(b, func(data []byte) io.ReadCloser {
+		return ioutil.NopCloser(struct{ io.Reader }{bytes.NewReader(data)})
+	})
+}
+
+func BenchmarkSendOutofBandDataWriterWriterTo(b *testing.B) {
+	benchmarkSendOutofBandDataWriter(b, func(data []byte) io.ReadCloser {
+		return &writerToReader{data: data}
+	})
+}
+
+type auditMemDriver struct {
+	*memDriver
+	records []string
+}
+
+func (d *auditMemDriver) LogCommand(user, command, param string, code int) {
+	d.records = append(d.records, fmt.Sprintf("%s|%s|%s|%d", user, command, param, code))
+}
+
+func TestCommandLogger(t *testing.T) {
+	driver := &auditMemDriver{memDriver: newMemDriver()}
+	subConn, _, _ := newTestSubConn(driver, nil)
+	subConn.user = ""
+	for _, line := range []string{"USER admin", "PASS wrong", "PASS secret", "noop", "FOO bar"} {
+		subConn.receiveLine(line + "\r\n")
+	}
+	expected := []string{
+		"admin|USER|admin|331",
+		"admin|PASS|****|530",
+		"admin|PASS|****|230",
+		"admin|NOOP||200",
+		"admin|FOO|bar|502",
+	}
+	if strings.Join(driver.records, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got records\n%s\nwant\n%s", strings.Join(driver.records, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestBuildPathCanonicalizeCase(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/dir/file.txt", "data")
+	subConn, control, _ := newTestSubConn(driver, &ServerOpts{CanonicalizePathCase: true})
+	subConn.namePrefix = "/Dir"
+	if result := subConn.buildPath("File.TXT"); result != "/dir/file.txt" {
+		t.Errorf("got %q", result)
+	}
+	subConn.receiveLine("SIZE /DIR/FILE.txt\r\n")
+	if response := lastResponse(control); response != "213 4" {
+		t.Errorf("SIZE with mixed case: got %q", response)
+	}
+}
+
+func TestNormalizeNFC(t *testing.T) {
+	nfd := "Cafe\u0301.txt"
+	nfc := "Caf\u00e9.txt"
+	driver := newMemDriver()
+	driver.addFile("/"+nfd, "data")
+	subConn, _, session := newTestSubConn(driver, &ServerOpts{NormalizeListingNFC: true, NormalizePathNFC: true})
+	if result := subConn.buildPath(nfd); result != "/"+nfc {
+		t.Errorf("buildPath: got %q", result)
+	}
+	subConn.receiveLine("NLST /\r\n")
+	if listing := session.sendStreams[0].String(); listing != nfc+"\r\n" {
+		t.Errorf("NLST: got %q", listing)
+	}
+}
+
+func TestBusyDataStreamThreshold(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/file", "data")
+	subConn, control, _ := newTestSubConn(driver, &ServerOpts{BusyDataStreamThreshold: 1})
+
+	stream, err := subConn.connection.getNewSendDataStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subConn.receiveLine("RETR /file\r\n")
+	if response := lastResponse(control); response != "450 Service busy, retry later" {
+		t.Errorf("RETR while busy: got %q", response)
+	}
+	subConn.receiveLine("MFMT 20200102030405 /file\r\n")
+	if response := lastResponse(control); response != "450 Service busy, retry later" {
+		t.Errorf("MFMT while busy: got %q", response)
+	}
+	subConn.receiveLine("SITE MKDCD /dir\r\n")
+	if response := lastResponse(control); response != "450 Service busy, retry later" {
+		t.Errorf("SITE MKDCD while busy: got %q", response)
+	}
+	if _, err := driver.Stat("/dir"); err == nil {
+		t.Error("SITE MKDCD created a directory while busy")
+	}
+	subConn.receiveLine("NOOP\r\n")
+	if response := lastResponse(control); response != "200 OK" {
+		t.Errorf("NOOP while busy: got %q", response)
+	}
+
+	stream.Close()
+	subConn.receiveLine("RETR /file\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "226 ") {
+		t.Errorf("RETR after load dropped: got %q", response)
+	}
+}
+
+// readMultiline parses a response like a client does and returns the
+// code and the lines of the message.
+func readMultiline(t *testing.T, response string) (string, []string) {
+	lines := strings.Split(strings.TrimSuffix(response, "\r\n"), "\r\n")
+	code := lines[0][:3]
+	if len(lines) == 1 {
+		if lines[0][3] != ' ' {
+			t.Errorf("single line response %q without blank after the code", lines[0])
+		}
+		return code, []string{lines[0][4:]}
+	}
+	if lines[0][3] != '-' {
+		t.Errorf("first line %q does not start a multiline response", lines[0])
+	}
+	message := []string{lines[0][4:]}
+	for i, line := range lines[1:] {
+		if strings.HasPrefix(line, code+" ") {
+			if i != len(lines)-2 {
+				t.Errorf("response %q terminated early", response)
+			}
+			return code, append(message, line[4:])
+		}
+		message = append(message, line)
+	}
+	t.Errorf("response %q is not terminated", response)
+	return code, message
+}
+
+func TestFormatMultiline(t *testing.T) {
+	cases := []struct {
+		message  string
+		expected []string
+	}{
+		{"single", []string{"single"}},
+		{"Extensions supported:\n UTF8\n MLSD\nEnd", []string{"Extensions supported:", " UTF8", " MLSD", "End"}},
+		{"first\r\n211 looks like an end\nlast\n", []string{"first", " 211 looks like an end", "last"}},
+	}
+	for _, c := range cases {
+		code, lines := readMultiline(t, formatMultiline(211, c.message, "\r\n"))
+		if code != "211" || strings.Join(lines, "|") != strings.Join(c.expected, "|") {
+			t.Errorf("formatMultiline(%q) parsed as %s %q, want %q", c.message, code, lines, c.expected)
+		}
+	}
+	if result := formatMultiline(211, "a\nb\nc", "\r\n"); result != "211-a\r\nb\r\n211 c\r\n" {
+		t.Errorf("got %q", result)
+	}
+}
+
+func TestLineTerminator(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), &ServerOpts{LineTerminator: "\n"})
+	subConn.receiveLine("NOOP\r\n")
+	subConn.writeMessageMultiline(211, "a\nb")
+	if result := control.String(); result != "200 OK\n211-a\n211 b\n" {
+		t.Errorf("got %q", result)
+	}
+}
+
+func TestGetters(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	subConn, _, _ := newTestSubConn(driver, nil)
+	subConn.controlStream = &fakeStream{id: 8}
+	subConn.receiveLine("CWD dir\r\n")
+	if subConn.CurrentDir() != "/dir" {
+		t.Errorf("CurrentDir() = %q", subConn.CurrentDir())
+	}
+	if subConn.SessionID() != subConn.connection.sessionID || len(subConn.SessionID()) != 20 {
+		t.Errorf("SessionID() = %q", subConn.SessionID())
+	}
+	if subConn.ControlStreamID() != 8 {
+		t.Errorf("ControlStreamID() = %d", subConn.ControlStreamID())
+	}
+	if subConn.LoginUser() != "admin" || !subConn.IsLogin() {
+		t.Errorf("LoginUser() = %q", subConn.LoginUser())
+	}
+}
+
+// reportCommand is a custom command streaming a generated report.
+type reportCommand struct{}
+
+func (cmd reportCommand) IsExtend() bool     { return false }
+func (cmd reportCommand) RequireParam() bool { return false }
+func (cmd reportCommand) RequireAuth() bool  { return true }
+
+func (cmd reportCommand) Execute(subConn *SubConn, param string) {
+	subConn.SendData([]byte("report for " + subConn.LoginUser()))
+}
+
+func TestCustomCommandSendData(t *testing.T) {
+	subConn, control, session := newTestSubConn(newMemDriver(), nil)
+	reportCommand{}.Execute(subConn, "")
+	if lines := responses(control); len(lines) != 2 || lines[0] != "150 3 Opening data stream" ||
+		lines[1] != "226 Closing data stream, sent 16 bytes" {
+		t.Errorf("got responses %q", lines)
+	}
+	if data := session.sendStreams[0].String(); data != "report for admin" || !session.sendStreams[0].closed {
+		t.Errorf("got %q on the data stream", data)
+	}
+}
+
+func TestMaxProtocolErrors(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), &ServerOpts{MaxProtocolErrors: 3})
+	for _, line := range []string{"GARBAGE", "CWD", "NOOP", "GARBAGE", "RNTO x", "GARBAGE"} {
+		if subConn.closed {
+			t.Fatalf("closed before %q", line)
+		}
+		subConn.receiveLine(line + "\r\n")
+	}
+	if !subConn.closed {
+		t.Error("control stream not closed")
+	}
+	if response := lastResponse(control); response != "421 Too many protocol errors, closing control stream" {
+		t.Errorf("got %q", response)
+	}
+}
+
+// recordingAccessLogger keeps all access entries.
+type recordingAccessLogger struct {
+	entries []server.AccessEntry
+}
+
+func (l *recordingAccessLogger) LogAccess(entry server.AccessEntry) {
+	l.entries = append(l.entries, entry)
+}
+
+func TestAccessLogger(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/file", "data")
+	accessLogger := &recordingAccessLogger{}
+	subConn, _, _ := newTestSubConn(driver, &ServerOpts{AccessLogger: accessLogger})
+
+	subConn.receiveLine("PASS secret\r\n")
+	subConn.receiveLine("RETR /file\r\n")
+	if len(accessLogger.entries) != 2 {
+		t.Fatalf("got %d entries", len(accessLogger.entries))
+	}
+	if entry := accessLogger.entries[0]; entry.Param != "****" {
+		t.Errorf("password not masked: %+v", entry)
+	}
+	entry := accessLogger.entries[1]
+	entry.Time = time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	var buffer bytes.Buffer
+	server.NewCLFAccessLogger(&buffer).LogAccess(entry)
+	expected := "192.0.2.1:4242 - admin [02/Jan/2018:03:04:05 +0000] \"RETR /file\" 226 4\n"
+	if result := buffer.String(); result != expected {
+		t.Errorf("got %q, want %q", result, expected)
+	}
+}
+
+// recordingMetrics keeps the observed command durations, transfers and
+// logins.
+type recordingMetrics struct {
+	mutex     sync.Mutex
+	durations map[string][]time.Duration
+	transfers []string
+	auths     []string
+}
+
+func (m *recordingMetrics) ObserveCommand(command string, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.durations[command] = append(m.durations[command], duration)
+}
+
+func (m *recordingMetrics) ObserveTransfer(direction string, bytes int64, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.transfers = append(m.transfers, fmt.Sprintf("%s %d", direction, bytes))
+}
+
+func (m *recordingMetrics) ObserveAuth(user string, ok bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.auths = append(m.auths, fmt.Sprintf("%s %v", user, ok))
+}
+
+func TestMetrics(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/file", "data")
+	metrics := &recordingMetrics{durations: make(map[string][]time.Duration)}
+	subConn, _, _ := newTestSubConn(driver, &ServerOpts{Metrics: metrics})
+
+	subConn.receiveLine("noop\r\n")
+	subConn.receiveLine("RETR /file\r\n")
+	subConn.receiveLine("RETR /file\r\n")
+	subConn.user = ""
+	subConn.receiveLine("LIST /\r\n")
+
+	if len(metrics.durations["NOOP"]) != 1 || len(metrics.durations["RETR"]) != 2 {
+		t.Errorf("got %v", metrics.durations)
+	}
+	if _, ok := metrics.durations["LIST"]; ok {
+		t.Error("refused command was measured")
+	}
+	for command, durations := range metrics.durations {
+		for _, duration := range durations {
+			if duration <= 0 {
+				t.Errorf("%s took %v", command, duration)
+			}
+		}
+	}
+}
+
+func TestServeQuit(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), nil)
+	commands, client := io.Pipe()
+	defer client.Close()
+	control.reader = commands
+	served := make(chan struct{})
+	go func() {
+		subConn.Serve()
+		close(served)
+	}()
+	client.Write([]byte("NOOP\r\nQUIT\r\n"))
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after QUIT")
+	}
+	if response := lastResponse(control); response != "221 Goodbye" || !control.closed {
+		t.Errorf("got %q", response)
+	}
+}
+
+func TestTransferAndAuthMetrics(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/file", "data")
+	metrics := &recordingMetrics{durations: make(map[string][]time.Duration)}
+	subConn, _, session := newTestSubConn(driver, &ServerOpts{Metrics: metrics})
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("upload")}}
+
+	subConn.receiveLine("RETR /file\r\n")
+	subConn.receiveLine("STOR 2 /new\r\n")
+	subConn.receiveLine("USER admin\r\n")
+	subConn.receiveLine("PASS wrong\r\n")
+	subConn.receiveLine("USER admin\r\n")
+	subConn.receiveLine("PASS secret\r\n")
+
+	if !reflect.DeepEqual(metrics.transfers, []string{"download 4", "upload 6"}) {
+		t.Errorf("transfers %v", metrics.transfers)
+	}
+	if !reflect.DeepEqual(metrics.auths, []string{"admin false", "admin true"}) {
+		t.Errorf("logins %v", metrics.auths)
+	}
+}
+
+func TestMaxParamLength(t *testing.T) {
+	driver := newMemDriver()
+	subConn, control, _ := newTestSubConn(driver, &ServerOpts{
+		MaxParamLength:  8,
+		MaxParamLengths: map[string]int{"MKD": 4},
+	})
+
+	subConn.receiveLine("CWD /1234567\r\n")
+	if response := lastResponse(control); !strings.HasPrefix(response, "550 ") {
+		t.Errorf("parameter at the limit: got %q", response)
+	}
+	subConn.receiveLine("CWD /12345678\r\n")
+	if response := lastResponse(control); response != "501 Parameter too long" {
+		t.Errorf("parameter above the limit: got %q", response)
+	}
+	subConn.receiveLine("mkd /123\r\n")
+	subConn.receiveLine("MKD /1234\r\n")
+	if response := lastResponse(control); response != "501 Parameter too long" {
+		t.Errorf("parameter above the command limit: got %q", response)
+	}
+	if _, err := driver.Stat("/123"); err != nil {
+		t.Error("parameter at the command limit refused")
+	}
+}
+
+// closeOrderStream records what was written to the control stream when the
+// data stream was closed.
+type closeOrderStream struct {
+	*fakeStream
+	control        *fakeStream
+	controlAtClose string
+}
+
+func (s *closeOrderStream) Close() error {
+	s.controlAtClose = s.control.String()
+	return s.fakeStream.Close()
+}
+
+func TestSendListing(t *testing.T) {
+	subConn, control, _ := newTestSubConn(newMemDriver(), &ServerOpts{ListingEndMarker: "# end"})
+	stream := &closeOrderStream{fakeStream: &fakeStream{id: 3}, control: control}
+	subConn.sendListing([]byte("file\r\n"), stream)
+	if data := stream.String(); data != "file\r\n# end\r\n" {
+		t.Errorf("sent %q", data)
+	}
+	if stream.controlAtClose != "" {
+		t.Errorf("%q sent before the data stream was closed", stream.controlAtClose)
+	}
+	if response := lastResponse(control); response != "226 Closing data stream, sent 13 bytes" {
+		t.Errorf("got %q", response)
+	}
+
+	broken := &fakeStream{id: 7, failWrites: true}
+	subConn.sendListing([]byte("file\r\n"), broken)
+	if response := lastResponse(control); !strings.HasPrefix(response, "426 ") || !broken.closed {
+		t.Errorf("broken data stream: got %q", response)
+	}
+}
+
+func TestLegalBanner(t *testing.T) {
+	banner := "Authorized use only.\n\n220 policy applies.\nAll access is logged."
+	subConn, control, _ := newTestSubConn(newMemDriver(), &ServerOpts{LegalBanner: banner})
+	subConn.user = ""
+	control.reader = strings.NewReader("USER admin\r\n")
+	subConn.Serve()
+	expected := []string{
+		"220-Authorized use only.",
+		"",
+		" 220 policy applies.",
+		"220 All access is logged.",
+		"331 User name ok, password required",
+	}
+	if lines := responses(control); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got %q", lines)
+	}
+}
+
+// timeoutError is returned by deadlineStream when its read deadline passed.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "deadline exceeded" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// deadlineStream is a fakeStream whose reads honor the read deadline, also
+// if it is changed during a read like with quic-go. It reads the lines sent
+// to it.
+type deadlineStream struct {
+	*fakeStream
+	lines         chan string
+	deadlineMutex sync.Mutex
+	deadline      time.Time
+	// closed when the deadline changes
+	changed chan struct{}
+}
+
+func (s *deadlineStream) SetReadDeadline(t time.Time) error {
+	s.deadlineMutex.Lock()
+	defer s.deadlineMutex.Unlock()
+	s.deadline = t
+	if s.changed != nil {
+		close(s.changed)
+	}
+	s.changed = make(chan struct{})
+	return nil
+}
+
+func (s *deadlineStream) Read(p []byte) (int, error) {
+	for {
+		s.deadlineMutex.Lock()
+		deadline := s.deadline
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.deadlineMutex.Unlock()
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			expired = time.After(time.Until(deadline))
+		}
+		select {
+		case line := <-s.lines:
+			return copy(p, line), nil
+		case <-expired:
+			return 0, timeoutError{}
+		case <-changed:
+		}
+	}
+}
+
+// slowStatMemDriver takes a while to stat files.
+type slowStatMemDriver struct {
+	*memDriver
+}
+
+func (d slowStatMemDriver) Stat(filePath string) (server.FileInfo, error) {
+	time.Sleep(120 * time.Millisecond)
+	return d.memDriver.Stat(filePath)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	opts := &ServerOpts{IdleTimeout: 50 * time.Millisecond, Logger: &server.DiscardLogger{}, Auth: &server.SimpleAuth{}}
+	driver := slowStatMemDriver{newMemDriver()}
+	driver.addFile("/file", "data")
+	conn, _ := NewServer(opts).newConn(&fakeSession{}, driver)
+	control := &deadlineStream{fakeStream: &fakeStream{}, lines: make(chan string)}
+	subConn := conn.newSubConn(control, driver)
+	subConn.logger = &server.DiscardLogger{}
+	subConn.user = "admin"
+	served := make(chan struct{})
+	go func() {
+		subConn.Serve()
+		close(served)
+	}()
+
+	control.lines <- "NOOP\r\n"
+	time.Sleep(30 * time.Millisecond)
+	control.lines <- "SIZE /file\r\n"
+	time.Sleep(30 * time.Millisecond)
+	control.lines <- "NOOP\r\n"
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("control stream not closed after the idle timeout")
+	}
+	expected := []string{"200 OK", "213 4", "200 OK", "421 Idle timeout, closing control stream"}
+	if lines := responses(control.fakeStream); strings.Join(lines, "\n") != strings.Join(expected, "\n") || !control.closed {
+		t.Errorf("got %q", lines)
+	}
+}
+
+// slowSizeMemDriver takes longer than the idle timeout of
+// TestIdleTimeoutAfterLongCommand to stat files.
+type slowSizeMemDriver struct {
+	*memDriver
+}
+
+func (d slowSizeMemDriver) Stat(filePath string) (server.FileInfo, error) {
+	time.Sleep(250 * time.Millisecond)
+	return d.memDriver.Stat(filePath)
+}
+
+func TestIdleTimeoutAfterLongCommand(t *testing.T) {
+	opts := &ServerOpts{IdleTimeout: 100 * time.Millisecond, Logger: &server.DiscardLogger{}, Auth: &server.SimpleAuth{}}
+	driver := slowSizeMemDriver{newMemDriver()}
+	driver.addFile("/file", "data")
+	session := &fakeSession{}
+	conn, _ := NewServer(opts).newConn(session, driver)
+	control := &deadlineStream{fakeStream: &fakeStream{}, lines: make(chan string)}
+	subConn := conn.newSubConn(control, driver)
+	subConn.logger = &server.DiscardLogger{}
+	subConn.user = "admin"
+	conn.runningSubConn = 1
+	served := make(chan struct{})
+	go func() {
+		subConn.Serve()
+		close(served)
+	}()
+
+	// SIZE is done after 250ms, the idle period only starts then.
+	start := time.Now()
+	control.lines <- "SIZE /file\r\n"
+	time.Sleep(325 * time.Millisecond)
+	select {
+	case control.lines <- "NOOP\r\n":
+	case <-served:
+		t.Fatal("control stream closed during the idle timeout after SIZE")
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("control stream not closed after the idle timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("closed after %v, before the idle timeout after NOOP", elapsed)
+	}
+	expected := []string{"213 4", "200 OK", "421 Idle timeout, closing control stream"}
+	if lines := responses(control.fakeStream); strings.Join(lines, "\n") != strings.Join(expected, "\n") || !control.closed {
+		t.Errorf("got %q", lines)
+	}
+	if !subConn.closed || !session.closed {
+		t.Error("connection not finished after the idle timeout")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxUniqueNameAttempts limits the names tried to find an unused one.
+const maxUniqueNameAttempts = 1000
+
+var errNoUniqueName = errors.New("Could not find a unique file name")
+
+// defaultUniqueName returns base for the first attempt and then base with
+// the number of the attempt in front of the extension.
+func defaultUniqueName(base string, attempt int) string {
+	if attempt == 0 {
+		return base
+	}
+	ext := path.Ext(base)
+	return strings.TrimSuffix(base, ext) + "-" + strconv.Itoa(attempt) + ext
+}
+
+// reserveUniqueName returns a path in dir, which neither exists nor is
+// reserved by another upload in progress. The caller has to release it with
+// releaseName after the upload.
+func (subConn *SubConn) reserveUniqueName(dir string, base string) (string, error) {
+	server := subConn.connection.server
+	for attempt := 0; attempt < maxUniqueNameAttempts; attempt++ {
+		var name string
+		if server.UniqueNameFunc != nil {
+			name = path.Base(server.UniqueNameFunc(dir, base))
+		} else {
+			name = defaultUniqueName(base, attempt)
+		}
+		filePath := path.Join(dir, name)
+		if !server.reserveName(filePath) {
+			continue
+		}
+		if _, err := subConn.driver.Stat(filePath); os.IsNotExist(err) {
+			return filePath, nil
+		}
+		server.releaseName(filePath)
+	}
+	return "", errNoUniqueName
+}
+
+// reserveName marks filePath as the target of an upload in progress. It
+// returns false if it is already reserved.
+func (server *Server) reserveName(filePath string) bool {
+	server.reservedNamesMutex.Lock()
+	defer server.reservedNamesMutex.Unlock()
+	if server.reservedNames == nil {
+		server.reservedNames = make(map[string]bool)
+	}
+	if server.reservedNames[filePath] {
+		return false
+	}
+	server.reservedNames[filePath] = true
+	return true
+}
+
+// releaseName removes the reservation of filePath.
+func (server *Server) releaseName(filePath string) {
+	server.reservedNamesMutex.Lock()
+	defer server.reservedNamesMutex.Unlock()
+	delete(server.reservedNames, filePath)
+}
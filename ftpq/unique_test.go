@@ -0,0 +1,90 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpq
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStouDefaultNames(t *testing.T) {
+	driver := newMemDriver()
+	driver.addDir("/dir")
+	driver.addFile("/dir/report.txt", "old")
+	driver.addFile("/dir/report-1.txt", "old")
+	subConn, control, session := newTestSubConn(driver, nil)
+	subConn.namePrefix = "/dir"
+	session.receiveStreams = []*fakeStream{
+		{id: 2, reader: strings.NewReader("new")},
+		{id: 6, reader: strings.NewReader("new")},
+	}
+
+	subConn.receiveLine("STOU 2 report.txt\r\n")
+	lines := responses(control)
+	if len(lines) != 2 || lines[0] != "150 FILE: report-2.txt" || lines[1] != "226 FILE: report-2.txt" {
+		t.Errorf("got %q", lines)
+	}
+	subConn.receiveLine("STOU 6\r\n")
+	if lines := responses(control); lines[2] != "150 FILE: file" {
+		t.Errorf("without name: got %q", lines)
+	}
+	if content, _ := driver.content("/dir/report-2.txt"); content != "new" {
+		t.Errorf("stored %q", content)
+	}
+}
+
+func TestStouNameWithQuotes(t *testing.T) {
+	subConn, control, session := newTestSubConn(newMemDriver(), nil)
+	session.receiveStreams = []*fakeStream{{id: 2, reader: strings.NewReader("new")}}
+	// RFC 1123 gives the name after "FILE:" unquoted, so it is not escaped
+	subConn.receiveLine("STOU 2 a\"b\r\n")
+	if lines := responses(control); len(lines) != 2 || lines[0] != "150 FILE: a\"b" || lines[1] != "226 FILE: a\"b" {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestStouReservedNames(t *testing.T) {
+	driver := newMemDriver()
+	subConn, _, _ := newTestSubConn(driver, nil)
+	first, err := subConn.reserveUniqueName("/", "a.txt")
+	if err != nil || first != "/a.txt" {
+		t.Fatalf("got %q, %v", first, err)
+	}
+	// a concurrent STOU must not get the name before the upload finished
+	second, _ := subConn.reserveUniqueName("/", "a.txt")
+	if second != "/a-1.txt" {
+		t.Errorf("got %q", second)
+	}
+	subConn.connection.server.releaseName(first)
+	if third, _ := subConn.reserveUniqueName("/", "a.txt"); third != first {
+		t.Errorf("released name not reused, got %q", third)
+	}
+}
+
+func TestStouUniqueNameFunc(t *testing.T) {
+	driver := newMemDriver()
+	driver.addFile("/upload-1", "old")
+	calls := 0
+	uniqueName := func(dir, base string) string {
+		calls++
+		return "upload-" + strconv.Itoa(calls)
+	}
+	subConn, _, _ := newTestSubConn(driver, &ServerOpts{UniqueNameFunc: uniqueName})
+	if name, err := subConn.reserveUniqueName("/", "a.txt"); err != nil || name != "/upload-2" {
+		t.Errorf("got %q, %v", name, err)
+	}
+
+	subConn, control, _ := newTestSubConn(driver, &ServerOpts{UniqueNameFunc: func(dir, base string) string {
+		return "upload-1"
+	}})
+	if _, err := subConn.reserveUniqueName("/", "a.txt"); err != errNoUniqueName {
+		t.Errorf("expected errNoUniqueName, got %v", err)
+	}
+	subConn.receiveLine("STOU 2 a.txt\r\n")
+	if response := lastResponse(control); response != "550 Could not find a unique file name" {
+		t.Errorf("STOU without unique name: got %q", response)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"github.com/attenberger/ftps_qftp-server"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -36,6 +37,7 @@ var (
 		"EPRT": commandEprt{},
 		"EPSV": commandEpsv{},
 		"FEAT": commandFeat{},
+		"HELP": commandHelp{},
 		"LIST": commandList{},
 		"NLST": commandNlst{},
 		"MDTM": commandMdtm{},
@@ -91,6 +93,9 @@ func (cmd commandAllo) Execute(conn *Conn, param string) {
 	conn.writeMessage(202, "Obsolete")
 }
 
+// commandAppe responds to the APPE FTP command. It works like STOR, but
+// appends the data to the file if it already exists. With DisableAppe it
+// replies 502.
 type commandAppe struct{}
 
 func (cmd commandAppe) IsExtend() bool {
@@ -98,7 +103,7 @@ func (cmd commandAppe) IsExtend() bool {
 }
 
 func (cmd commandAppe) RequireParam() bool {
-	return false
+	return true
 }
 
 func (cmd commandAppe) RequireAuth() bool {
@@ -106,8 +111,12 @@ func (cmd commandAppe) RequireAuth() bool {
 }
 
 func (cmd commandAppe) Execute(conn *Conn, param string) {
+	if conn.server.DisableAppe {
+		conn.writeMessage(502, "Command not implemented")
+		return
+	}
 	conn.appendData = true
-	conn.writeMessage(202, "Obsolete")
+	commandStor{}.Execute(conn, param)
 }
 
 type commandOpts struct{}
@@ -157,16 +166,21 @@ func (cmd commandFeat) RequireAuth() bool {
 }
 
 var (
-	feats    = "Extensions supported:\n%s"
+	feats    = "Features:\n%sEnd"
 	featCmds = " UTF8\n"
 )
 
 func init() {
+	var extended []string
 	for k, v := range commands {
 		if v.IsExtend() {
-			featCmds = featCmds + " " + k + "\n"
+			extended = append(extended, k)
 		}
 	}
+	sort.Strings(extended)
+	for _, k := range extended {
+		featCmds = featCmds + " " + k + "\n"
+	}
 }
 
 func (cmd commandFeat) Execute(conn *Conn, param string) {
@@ -470,7 +484,7 @@ func (cmd commandMkd) Execute(conn *Conn, param string) {
 	path := conn.buildPath(param)
 	err := conn.driver.MakeDir(path)
 	if err == nil {
-		conn.writeMessage(257, "Directory created")
+		conn.writeMessage(257, quotePath(path)+" created")
 	} else {
 		conn.writeMessage(550, fmt.Sprint("Action not taken: ", err))
 	}
@@ -648,7 +662,13 @@ func (cmd commandPwd) RequireAuth() bool {
 }
 
 func (cmd commandPwd) Execute(conn *Conn, param string) {
-	conn.writeMessage(257, "\""+conn.namePrefix+"\" is the current directory")
+	conn.writeMessage(257, quotePath(conn.namePrefix)+" is the current directory")
+}
+
+// quotePath encloses a path in double quotes for a 257 reply. Quotes within
+// the path are doubled (RFC 959, appendix II).
+func quotePath(path string) string {
+	return "\"" + strings.Replace(path, "\"", "\"\"", -1) + "\""
 }
 
 // CommandQuit responds to the QUIT FTP command. The client has requested the
@@ -1000,7 +1020,7 @@ func (cmd commandSize) Execute(conn *Conn, param string) {
 		log.Printf("Size: error(%s)", err)
 		conn.writeMessage(450, fmt.Sprint("path", path, "not found"))
 	} else {
-		conn.writeMessage(213, strconv.Itoa(int(stat.Size())))
+		conn.writeMessage(213, strconv.FormatInt(stat.Size(), 10))
 	}
 }
 
@@ -1121,7 +1141,10 @@ func (cmd commandType) Execute(conn *Conn, param string) {
 	}
 }
 
-// commandUser responds to the USER FTP command by asking for the password
+// commandUser responds to the USER FTP command by asking for the password.
+// If the client presented a verified certificate and the Auth implements
+// ftp_server.CertAuth, which accepts the certificate for the user, the user
+// is logged in right away with 232 instead.
 type commandUser struct{}
 
 func (cmd commandUser) IsExtend() bool {
@@ -1137,6 +1160,21 @@ func (cmd commandUser) RequireAuth() bool {
 }
 
 func (cmd commandUser) Execute(conn *Conn, param string) {
+	if certAuth, ok := conn.server.Auth.(ftp_server.CertAuth); ok {
+		if cert := conn.clientCertificate(); cert != nil {
+			ok, err := certAuth.CheckCert(param, cert)
+			if err != nil {
+				conn.writeMessage(530, "Checking certificate error, not logged in")
+				return
+			}
+			if ok {
+				conn.user = param
+				conn.reqUser = ""
+				conn.writeMessage(232, "User logged in, authorized by certificate")
+				return
+			}
+		}
+	}
 	conn.reqUser = param
 	conn.writeMessage(331, "User name ok, password required")
 }
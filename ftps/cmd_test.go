@@ -0,0 +1,191 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftps
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/attenberger/ftps_qftp-server"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDataSocket is a data connection that delivers data.
+type fakeDataSocket struct {
+	DataSocket
+	data io.Reader
+}
+
+func (s *fakeDataSocket) Read(p []byte) (int, error) {
+	return s.data.Read(p)
+}
+
+// uploadDriver records the uploads it receives.
+type uploadDriver struct {
+	ftp_server.Driver
+	path       string
+	content    string
+	appendData bool
+}
+
+func (d *uploadDriver) PutFile(filePath string, data io.Reader, appendData bool) (int64, error) {
+	content, err := ioutil.ReadAll(data)
+	d.path, d.content, d.appendData = filePath, string(content), appendData
+	return int64(len(content)), err
+}
+
+func TestAppe(t *testing.T) {
+	conn, control := newTestConn(nil)
+	driver := &uploadDriver{}
+	conn.driver = driver
+	conn.user = "admin"
+	conn.dataConn = &fakeDataSocket{data: strings.NewReader("more")}
+	conn.receiveLine("APPE /file\r\n")
+	if response := lastResponse(control); response != "226 OK, received 4 bytes" {
+		t.Errorf("got %q", response)
+	}
+	if driver.path != "/file" || driver.content != "more" || !driver.appendData {
+		t.Errorf("uploaded %+v", driver)
+	}
+
+	conn.dataConn = &fakeDataSocket{data: strings.NewReader("new")}
+	conn.receiveLine("STOR /file\r\n")
+	if driver.appendData {
+		t.Error("STOR after APPE appended")
+	}
+}
+
+func TestAppeDisabled(t *testing.T) {
+	conn, control := newTestConn(&ServerOpts{DisableAppe: true})
+	driver := &uploadDriver{}
+	conn.driver = driver
+	conn.user = "admin"
+	conn.receiveLine("APPE /file\r\n")
+	if response := lastResponse(control); response != "502 Command not implemented" {
+		t.Errorf("got %q", response)
+	}
+	if driver.path != "" {
+		t.Errorf("uploaded to %s", driver.path)
+	}
+}
+
+// certAuth accepts certificates whose common name is the user name.
+type certAuth struct {
+	ftp_server.SimpleAuth
+}
+
+func (a *certAuth) CheckCert(name string, cert *x509.Certificate) (bool, error) {
+	if name == "broken" {
+		return false, errors.New("certificate store not available")
+	}
+	return cert.Subject.CommonName == name, nil
+}
+
+// newTestCertificate returns a certificate for name signed by parent, or
+// self-signed if parent is nil.
+func newTestCertificate(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		DNSNames:              []string{name},
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	issuer, signer := template, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// newCertTestConn returns a Conn whose control connection went through a
+// TLS handshake, in which the client presented a certificate for
+// clientName, unless it is empty. Responses are still written to the
+// fakeConn.
+func newCertTestConn(t *testing.T, clientName string) (*Conn, *fakeConn) {
+	ca := newTestCertificate(t, "CA", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	conn, control := newTestConn(&ServerOpts{Auth: &certAuth{ftp_server.SimpleAuth{Name: "admin", Password: "secret"}}})
+
+	serverSide, clientSide := net.Pipe()
+	serverConn := tls.Server(serverSide, &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "localhost", &ca)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	clientConfig := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	if clientName != "" {
+		clientConfig.Certificates = []tls.Certificate{newTestCertificate(t, clientName, &ca)}
+	}
+	clientConn := tls.Client(clientSide, clientConfig)
+	handshake := make(chan error)
+	go func() {
+		handshake <- clientConn.Handshake()
+	}()
+	if err := serverConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-handshake; err != nil {
+		t.Fatal(err)
+	}
+	conn.conn = serverConn
+	return conn, control
+}
+
+func TestUserCert(t *testing.T) {
+	cases := []struct {
+		user      string
+		cert      string
+		responses []string
+	}{
+		// the certificate logs the user in
+		{"admin", "admin", []string{"232 User logged in, authorized by certificate"}},
+		// the certificate of another user is rejected, the password is
+		// required
+		{"admin", "guest", []string{"331 User name ok, password required", "230 Password ok, continue"}},
+		// without a certificate the password is required
+		{"admin", "", []string{"331 User name ok, password required", "230 Password ok, continue"}},
+		// the Auth failed
+		{"broken", "broken", []string{"530 Checking certificate error, not logged in"}},
+	}
+	for _, c := range cases {
+		conn, control := newCertTestConn(t, c.cert)
+		conn.receiveLine("USER " + c.user + "\r\n")
+		if len(c.responses) > 1 {
+			conn.receiveLine("PASS secret\r\n")
+		}
+		lines := responses(control)
+		if strings.Join(lines, "\n") != strings.Join(c.responses, "\n") {
+			t.Errorf("%s with certificate %q: got %q", c.user, c.cert, lines)
+		}
+		if loggedIn := strings.HasPrefix(lines[len(lines)-1], "2"); conn.IsLogin() != loggedIn {
+			t.Errorf("%s with certificate %q: logged in %v", c.user, c.cert, conn.IsLogin())
+		}
+	}
+}
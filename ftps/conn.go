@@ -6,9 +6,11 @@ package ftps
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 	"github.com/attenberger/ftps_qftp-server"
@@ -157,6 +159,20 @@ func (conn *Conn) upgradeToTLS() error {
 	return err
 }
 
+// clientCertificate returns the verified certificate the client presented
+// during the TLS handshake or nil if there is none.
+func (conn *Conn) clientCertificate() *x509.Certificate {
+	tlsConn, ok := conn.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
 // receiveLine accepts a single line FTP command and co-ordinates an
 // appropriate response.
 func (conn *Conn) receiveLine(line string) {
@@ -193,15 +209,47 @@ func (conn *Conn) writeMessage(code int, message string) (wrote int, err error)
 	return
 }
 
-// writeMessage will send a standard FTP response back to the client.
+// writeMessageMultiline will send a multiline FTP response back to the
+// client. Each line of the message becomes a line of the response, the
+// last one is sent after the code to terminate the response.
 func (conn *Conn) writeMessageMultiline(code int, message string) (wrote int, err error) {
 	conn.logger.PrintResponse(conn.sessionID, code, message)
-	line := fmt.Sprintf("%d-%s\r\n%d END\r\n", code, message, code)
-	wrote, err = conn.controlWriter.WriteString(line)
+	wrote, err = conn.controlWriter.WriteString(formatMultiline(code, message))
 	conn.controlWriter.Flush()
 	return
 }
 
+// formatMultiline formats a message spanning several lines in the
+// continuation format of RFC 959:
+//
+//    123-First line
+//    Second line
+//     234 A line beginning with numbers
+//    123 The last line
+//
+// Lines within the message starting with a digit are indented by a blank,
+// so they are not mistaken for the end of the response. A message with a
+// single line results in a single line response.
+func formatMultiline(code int, message string) string {
+	lines := strings.Split(strings.TrimRight(message, "\r\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+	last := len(lines) - 1
+	var buf bytes.Buffer
+	if last > 0 {
+		fmt.Fprintf(&buf, "%d-%s\r\n", code, lines[0])
+		for _, line := range lines[1:last] {
+			if len(line) > 0 && line[0] >= '0' && line[0] <= '9' {
+				line = " " + line
+			}
+			buf.WriteString(line + "\r\n")
+		}
+	}
+	fmt.Fprintf(&buf, "%d %s\r\n", code, lines[last])
+	return buf.String()
+}
+
 // buildPath takes a client supplied path or filename and generates a safe
 // absolute path within their account sandbox.
 //
@@ -0,0 +1,55 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftps
+
+import (
+	"bytes"
+	"github.com/attenberger/ftps_qftp-server"
+	"net"
+	"strings"
+)
+
+// fakeConn is a control connection that records everything written to it.
+type fakeConn struct {
+	net.Conn
+	written bytes.Buffer
+	closed  bool
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// newTestConn returns a Conn on a fakeConn with a VirtualFS as driver.
+func newTestConn(opts *ServerOpts) (*Conn, *fakeConn) {
+	if opts == nil {
+		opts = &ServerOpts{}
+	}
+	if opts.Logger == nil {
+		opts.Logger = &ftp_server.DiscardLogger{}
+	}
+	if opts.Auth == nil {
+		opts.Auth = &ftp_server.SimpleAuth{Name: "admin", Password: "secret"}
+	}
+	control := &fakeConn{}
+	conn := NewServer(opts).newConn(control, ftp_server.NewVirtualFS())
+	return conn, control
+}
+
+// responses splits everything written to the control connection into lines.
+func responses(control *fakeConn) []string {
+	return strings.Split(strings.TrimSuffix(control.written.String(), "\r\n"), "\r\n")
+}
+
+// lastResponse returns the last line written to the control connection.
+func lastResponse(control *fakeConn) string {
+	lines := responses(control)
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftps
+
+import (
+	"github.com/attenberger/ftps_qftp-server"
+	"sort"
+	"strings"
+)
+
+// helpColumns is the number of command names per line of the HELP listing.
+const helpColumns = 8
+
+// helpTexts describes the commands for HELP <command>.
+var helpTexts = map[string]string{
+	"ADAT": "ADAT <data>: security data exchange (not supported)",
+	"ALLO": "ALLO <size>: allocate storage (ignored)",
+	"APPE": "APPE <path>: append to a file",
+	"AUTH": "AUTH TLS: secure the control connection",
+	"CCC":  "CCC: clear the command channel (not supported)",
+	"CDUP": "CDUP: change to the parent directory",
+	"CONF": "CONF <data>: confidentiality protected command (not supported)",
+	"CWD":  "CWD <path>: change the working directory",
+	"DELE": "DELE <path>: delete a file",
+	"ENC":  "ENC <data>: privacy protected command (not supported)",
+	"EPRT": "EPRT |<proto>|<address>|<port>|: open an active data connection",
+	"EPSV": "EPSV: open an extended passive data connection",
+	"FEAT": "FEAT: list the supported extensions",
+	"HELP": "HELP [<command>]: list the commands or describe one",
+	"LIST": "LIST [<path>]: list a directory",
+	"MDTM": "MDTM <path>: return the modification time",
+	"MIC":  "MIC <data>: integrity protected command (not supported)",
+	"MKD":  "MKD <path>: make a directory",
+	"MODE": "MODE <mode>: set the transfer mode (only S)",
+	"NLST": "NLST [<path>]: list the names in a directory",
+	"NOOP": "NOOP: do nothing",
+	"OPTS": "OPTS <command> <options>: set options of a command",
+	"PASS": "PASS <password>: send the password",
+	"PASV": "PASV: open a passive data connection",
+	"PBSZ": "PBSZ <size>: set the protection buffer size",
+	"PORT": "PORT <h1,h2,h3,h4,p1,p2>: open an active data connection",
+	"PROT": "PROT <level>: set the data channel protection level",
+	"PWD":  "PWD: return the working directory",
+	"QUIT": "QUIT: close the connection",
+	"REST": "REST <offset>: restart the next transfer at an offset",
+	"RETR": "RETR <path>: download a file",
+	"RMD":  "RMD <path>: remove a directory",
+	"RNFR": "RNFR <path>: select a file to rename",
+	"RNTO": "RNTO <path>: rename the selected file",
+	"SIZE": "SIZE <path>: return the size of a file",
+	"STOR": "STOR <path>: upload a file",
+	"STRU": "STRU <structure>: set the file structure (only F)",
+	"SYST": "SYST: return the system type",
+	"TYPE": "TYPE <type>: set the transfer type (A or I)",
+	"USER": "USER <name>: send the user name",
+	"XCUP": "XCUP: change to the parent directory",
+	"XCWD": "XCWD <path>: change the working directory",
+	"XPWD": "XPWD: return the working directory",
+	"XRMD": "XRMD <path>: remove a directory",
+}
+
+// commandHelp responds to the HELP FTP command. Without a parameter it lists
+// the names of all commands, with one it describes the given command.
+type commandHelp struct{}
+
+func (cmd commandHelp) IsExtend() bool {
+	return false
+}
+
+func (cmd commandHelp) RequireParam() bool {
+	return false
+}
+
+func (cmd commandHelp) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandHelp) Execute(conn *Conn, param string) {
+	if param == "" {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		conn.writeMessageMultiline(214, "The following commands are recognized.\n"+
+			ftp_server.FormatHelpColumns(names, helpColumns)+"Help OK.")
+		return
+	}
+	name := strings.ToUpper(param)
+	if commands[name] == nil {
+		conn.writeMessage(502, "Unknown command "+name)
+		return
+	}
+	if text, ok := helpTexts[name]; ok {
+		conn.writeMessage(214, text)
+	} else {
+		conn.writeMessage(214, name+": no description available")
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftps
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHelp(t *testing.T) {
+	conn, control := newTestConn(nil)
+	conn.receiveLine("HELP\r\n")
+	lines := responses(control)
+	if lines[0] != "214-The following commands are recognized." || lines[len(lines)-1] != "214 Help OK." {
+		t.Fatalf("got %q", lines)
+	}
+	if lines[1] != " ADAT ALLO APPE AUTH CCC  CDUP CONF CWD" {
+		t.Errorf("first line of names %q", lines[1])
+	}
+	var names []string
+	for _, line := range lines[1 : len(lines)-1] {
+		names = append(names, strings.Fields(line)...)
+	}
+	if len(names) != len(commands) {
+		t.Errorf("listed %v", names)
+	}
+
+	cases := []struct {
+		line     string
+		response string
+	}{
+		{"HELP retr", "214 RETR <path>: download a file"},
+		{"HELP FOO", "502 Unknown command FOO"},
+	}
+	for _, c := range cases {
+		conn.receiveLine(c.line + "\r\n")
+		if response := lastResponse(control); response != c.response {
+			t.Errorf("%s: got %q, want %q", c.line, response, c.response)
+		}
+	}
+}
@@ -8,11 +8,13 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/attenberger/ftps_qftp-server"
 	"net"
 	"strconv"
+	"sync/atomic"
 )
 
 // Version returns the library version
@@ -57,8 +59,29 @@ type ServerOpts struct {
 	// If ture TLS is used in RFC4217 mode
 	ExplicitFTPS bool
 
+	// if tls used, client certificates are verified against these CAs.
+	// Clients without a certificate are accepted, unless RequireClientCert
+	// is set. An Auth implementing ftp_server.CertAuth can log users in by
+	// their certificate, see commandUser.
+	ClientCAs *x509.CertPool
+
+	// if tls used, refuse clients without a certificate signed by one of
+	// the ClientCAs, which have to be set
+	RequireClientCert bool
+
+	// if tls used, the minimum version accepted, defaults to TLS 1.2
+	MinTLSVersion uint16
+
+	// if tls used and set, only these cipher suites are offered for TLS
+	// 1.2 and below, e.g. to disable weak ones
+	CipherSuites []uint16
+
 	WelcomeMessage string
 
+	// if set, APPE is answered with 502 like an unknown command, so that
+	// clients fall back to STOR instead of appending
+	DisableAppe bool
+
 	// A logger implementation, if nil the StdLogger is used
 	Logger ftp_server.Logger
 }
@@ -73,15 +96,22 @@ type Server struct {
 	logger    ftp_server.Logger
 	listener  net.Listener
 	tlsConfig *tls.Config
-	ctx       context.Context
-	cancel    context.CancelFunc
-	feats     string
+	// the *tls.Certificate presented in new handshakes, replaced by
+	// ReloadCertificate
+	certificate atomic.Value
+	ctx         context.Context
+	cancel      context.CancelFunc
+	feats       string
 }
 
 // ErrServerClosed is returned by ListenAndServe() or Serve() when a shutdown
 // was requested.
 var ErrServerClosed = errors.New("ftp: Server closed")
 
+// errNoClientCAs is returned by ListenAndServe if RequireClientCert is set
+// without ClientCAs, which would accept certificates of any public CA.
+var errNoClientCAs = errors.New("ftp: RequireClientCert needs ClientCAs")
+
 // serverOptsWithDefaults copies an ServerOpts struct into a new struct,
 // then adds any default values that are missing and returns the new data.
 func serverOptsWithDefaults(opts *ServerOpts) *ServerOpts {
@@ -125,9 +155,18 @@ func serverOptsWithDefaults(opts *ServerOpts) *ServerOpts {
 	newOpts.KeyFile = opts.KeyFile
 	newOpts.CertFile = opts.CertFile
 	newOpts.ExplicitFTPS = opts.ExplicitFTPS
+	newOpts.ClientCAs = opts.ClientCAs
+	newOpts.RequireClientCert = opts.RequireClientCert
+	if opts.MinTLSVersion == 0 {
+		newOpts.MinTLSVersion = tls.VersionTLS12
+	} else {
+		newOpts.MinTLSVersion = opts.MinTLSVersion
+	}
+	newOpts.CipherSuites = opts.CipherSuites
 
 	newOpts.PublicIp = opts.PublicIp
 	newOpts.PassivePorts = opts.PassivePorts
+	newOpts.DisableAppe = opts.DisableAppe
 
 	return &newOpts
 }
@@ -180,7 +219,10 @@ func (server *Server) newConn(tcpConn net.Conn, driver ftp_server.Driver) *Conn
 	return c
 }
 
-func simpleTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+func simpleTLSConfig(opts *ServerOpts) (*tls.Config, error) {
+	if opts.RequireClientCert && opts.ClientCAs == nil {
+		return nil, errNoClientCAs
+	}
 	config := &tls.Config{}
 	if config.NextProtos == nil {
 		config.NextProtos = []string{"ftp"}
@@ -188,13 +230,48 @@ func simpleTLSConfig(certFile, keyFile string) (*tls.Config, error) {
 
 	var err error
 	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	config.Certificates[0], err = tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
 	if err != nil {
 		return nil, err
 	}
+	config.MinVersion = opts.MinTLSVersion
+	if len(opts.CipherSuites) > 0 {
+		config.CipherSuites = opts.CipherSuites
+	}
+	config.ClientCAs = opts.ClientCAs
+	if opts.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if opts.ClientCAs != nil {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
 	return config, nil
 }
 
+// serveCertificate makes config present the certificate through
+// GetCertificate, so that ReloadCertificate can replace it for new
+// handshakes.
+func (server *Server) serveCertificate(config *tls.Config) {
+	certificate := config.Certificates[0]
+	server.certificate.Store(&certificate)
+	// GetCertificate is only called without SNI if there are no Certificates
+	config.Certificates = nil
+	config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return server.certificate.Load().(*tls.Certificate), nil
+	}
+}
+
+// ReloadCertificate replaces the certificate of a running server by the one
+// in certFile and keyFile, e.g. after it was renewed. New handshakes present
+// it, open connections are not affected.
+func (server *Server) ReloadCertificate(certFile, keyFile string) error {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	server.certificate.Store(&certificate)
+	return nil
+}
+
 // ListenAndServe asks a new Server to begin accepting client connections. It
 // accepts no arguments - all configuration is provided via the NewServer
 // function.
@@ -209,10 +286,11 @@ func (server *Server) ListenAndServe() error {
 	var curFeats = featCmds
 
 	if server.ServerOpts.TLS {
-		server.tlsConfig, err = simpleTLSConfig(server.CertFile, server.KeyFile)
+		server.tlsConfig, err = simpleTLSConfig(server.ServerOpts)
 		if err != nil {
 			return err
 		}
+		server.serveCertificate(server.tlsConfig)
 
 		curFeats += " AUTH TLS\n PBSZ\n PROT\n"
 
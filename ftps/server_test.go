@@ -0,0 +1,21 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftps
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+func TestRequireClientCertWithoutCAs(t *testing.T) {
+	s := NewServer(&ServerOpts{TLS: true, Hostname: "127.0.0.1", Port: 2121, RequireClientCert: true})
+	if err := s.ListenAndServe(); err != errNoClientCAs {
+		t.Errorf("got %v", err)
+	}
+
+	if _, err := simpleTLSConfig(&ServerOpts{RequireClientCert: true, ClientCAs: x509.NewCertPool()}); err == errNoClientCAs {
+		t.Errorf("refused with ClientCAs")
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp_server
+
+import (
+	"bytes"
+	"strings"
+)
+
+// FormatHelpColumns arranges the command names for the response to HELP in
+// lines of columns names, each line indented by a blank and terminated by a
+// newline. The columns are one blank wider than the longest name.
+func FormatHelpColumns(names []string, columns int) string {
+	width := 0
+	for _, name := range names {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	var buf bytes.Buffer
+	for i, name := range names {
+		if i%columns == 0 {
+			buf.WriteString(" ")
+		}
+		if i%columns == columns-1 || i == len(names)-1 {
+			buf.WriteString(name + "\n")
+		} else {
+			buf.WriteString(name + strings.Repeat(" ", width+1-len(name)))
+		}
+	}
+	return buf.String()
+}
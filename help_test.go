@@ -0,0 +1,18 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp_server
+
+import "testing"
+
+func TestFormatHelpColumns(t *testing.T) {
+	names := []string{"ABOR", "CWD", "XCHMOD", "USER", "PWD"}
+	expected := " ABOR   CWD    XCHMOD\n USER   PWD\n"
+	if columns := FormatHelpColumns(names, 3); columns != expected {
+		t.Errorf("got %q, want %q", columns, expected)
+	}
+	if columns := FormatHelpColumns(nil, 3); columns != "" {
+		t.Errorf("no names: got %q", columns)
+	}
+}
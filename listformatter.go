@@ -7,12 +7,28 @@ package ftp_server
 import (
 	"bytes"
 	"fmt"
+	"golang.org/x/text/unicode/norm"
 	"strconv"
 	"strings"
 )
 
 type ListFormatter []FileInfo
 
+// NFC returns a copy of the collection with all names converted to the
+// Unicode normalization form C. macOS clients create names in form D, most
+// other systems expect form C.
+func (formatter ListFormatter) NFC() ListFormatter {
+	normalized := make(ListFormatter, len(formatter))
+	for i, file := range formatter {
+		if norm.NFC.IsNormalString(file.Name()) {
+			normalized[i] = file
+		} else {
+			normalized[i] = renamedFileInfo{file, norm.NFC.String(file.Name())}
+		}
+	}
+	return normalized
+}
+
 // Short returns a string that lists the collection of files by name only,
 // one per line
 func (formatter ListFormatter) Short() []byte {
@@ -28,15 +44,80 @@ func (formatter ListFormatter) Short() []byte {
 func (formatter ListFormatter) Detailed() []byte {
 	var buf bytes.Buffer
 	for _, file := range formatter {
-		fmt.Fprintf(&buf, file.Mode().String())
+		fmt.Fprint(&buf, file.Mode().String())
 		fmt.Fprintf(&buf, " 1 %s %s ", file.Owner(), file.Group())
-		fmt.Fprintf(&buf, lpad(strconv.FormatInt(file.Size(), 10), 12))
-		fmt.Fprintf(&buf, file.ModTime().Format(" Jan _2 15:04 "))
+		fmt.Fprint(&buf, lpad(strconv.FormatInt(file.Size(), 10), 12))
+		fmt.Fprint(&buf, file.ModTime().Format(" Jan _2 15:04 "))
 		fmt.Fprintf(&buf, "%s\r\n", file.Name())
 	}
 	return buf.Bytes()
 }
 
+// MachineFactNames are the names of the facts MachineFacts can produce, in
+// the order they are written.
+var MachineFactNames = []string{"type", "size", "modify", "create", "unique"}
+
+// Machine returns a string that lists the collection of files in the
+// machine readable format of the MLSD command (RFC 3659), one per line
+func (formatter ListFormatter) Machine() []byte {
+	return formatter.MachineSelected(MachineFactNames)
+}
+
+// MachineSelected is like Machine, but includes only the facts named in
+// facts.
+func (formatter ListFormatter) MachineSelected(facts []string) []byte {
+	var buf bytes.Buffer
+	for _, file := range formatter {
+		fmt.Fprintf(&buf, "%s %s\r\n", SelectedMachineFacts(file, facts), file.Name())
+	}
+	return buf.Bytes()
+}
+
+// MachineFacts returns the RFC 3659 facts of a file, like
+// "type=file;size=42;modify=20180102030405;". The modify fact is included
+// for directories as well. The create and unique facts are only included
+// if the file implements CreationTimeFileInfo and UniqueFileInfo.
+func MachineFacts(file FileInfo) string {
+	return SelectedMachineFacts(file, MachineFactNames)
+}
+
+// SelectedMachineFacts is like MachineFacts, but includes only the facts
+// named in facts. The names are compared ignoring case.
+func SelectedMachineFacts(file FileInfo, facts []string) string {
+	selected := make(map[string]bool, len(facts))
+	for _, fact := range facts {
+		selected[strings.ToLower(fact)] = true
+	}
+	var buf bytes.Buffer
+	fileType := "file"
+	if file.IsDir() {
+		switch file.Name() {
+		case ".":
+			fileType = "cdir"
+		case "..":
+			fileType = "pdir"
+		default:
+			fileType = "dir"
+		}
+	}
+	if selected["type"] {
+		fmt.Fprintf(&buf, "type=%s;", fileType)
+	}
+	if selected["size"] {
+		fmt.Fprintf(&buf, "size=%d;", file.Size())
+	}
+	if selected["modify"] {
+		fmt.Fprintf(&buf, "modify=%s;", file.ModTime().UTC().Format("20060102150405"))
+	}
+	if createdFile, ok := file.(CreationTimeFileInfo); ok && selected["create"] && !createdFile.CreationTime().IsZero() {
+		fmt.Fprintf(&buf, "create=%s;", createdFile.CreationTime().UTC().Format("20060102150405"))
+	}
+	if uniqueFile, ok := file.(UniqueFileInfo); ok && selected["unique"] && uniqueFile.UniqueID() != "" {
+		fmt.Fprintf(&buf, "unique=%s;", uniqueFile.UniqueID())
+	}
+	return buf.String()
+}
+
 func lpad(input string, length int) (result string) {
 	if len(input) < length {
 		result = strings.Repeat(" ", length-len(input)) + input
@@ -0,0 +1,116 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp_server
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+type testFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (f testFileInfo) Name() string       { return f.name }
+func (f testFileInfo) Size() int64        { return f.size }
+func (f testFileInfo) Mode() os.FileMode  { return f.mode }
+func (f testFileInfo) ModTime() time.Time { return f.modTime }
+func (f testFileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f testFileInfo) Sys() interface{}   { return nil }
+func (f testFileInfo) Owner() string      { return "owner" }
+func (f testFileInfo) Group() string      { return "group" }
+
+func TestShort(t *testing.T) {
+	formatter := ListFormatter{
+		testFileInfo{name: "one.txt"},
+		testFileInfo{name: "dir", mode: os.ModeDir},
+	}
+	if result := string(formatter.Short()); result != "one.txt\r\ndir\r\n" {
+		t.Errorf("got %q", result)
+	}
+}
+
+func TestDetailed(t *testing.T) {
+	formatter := ListFormatter{
+		testFileInfo{name: "one.txt", size: 1234, mode: 0644, modTime: time.Date(2018, 3, 4, 5, 6, 0, 0, time.UTC)},
+	}
+	expected := "-rw-r--r-- 1 owner group         1234 Mar  4 05:06 one.txt\r\n"
+	if result := string(formatter.Detailed()); result != expected {
+		t.Errorf("got %q, want %q", result, expected)
+	}
+}
+
+func TestNFC(t *testing.T) {
+	nfd := "Cafe\u0301.txt"
+	nfc := "Caf\u00e9.txt"
+	formatter := ListFormatter{testFileInfo{name: nfd}, testFileInfo{name: nfc}}
+	if result := string(formatter.NFC().Short()); result != nfc+"\r\n"+nfc+"\r\n" {
+		t.Errorf("got %q", result)
+	}
+	if formatter[0].Name() != nfd {
+		t.Error("NFC modified the original collection")
+	}
+}
+
+type uniqueTestFileInfo struct {
+	testFileInfo
+	id string
+}
+
+func (f uniqueTestFileInfo) UniqueID() string { return f.id }
+
+func TestMachine(t *testing.T) {
+	modTime := time.Date(2018, 3, 4, 5, 6, 7, 0, time.FixedZone("CET", 3600))
+	formatter := ListFormatter{
+		testFileInfo{name: "one.txt", size: 42, mode: 0644, modTime: modTime},
+		testFileInfo{name: "dir", mode: os.ModeDir | 0755, modTime: modTime},
+		uniqueTestFileInfo{testFileInfo{name: "link.txt", size: 42, mode: 0644, modTime: modTime}, "801g2a"},
+	}
+	expected := "type=file;size=42;modify=20180304040607; one.txt\r\n" +
+		"type=dir;size=0;modify=20180304040607; dir\r\n" +
+		"type=file;size=42;modify=20180304040607;unique=801g2a; link.txt\r\n"
+	if result := string(formatter.Machine()); result != expected {
+		t.Errorf("got %q, want %q", result, expected)
+	}
+}
+
+type createdTestFileInfo struct {
+	testFileInfo
+	created time.Time
+}
+
+func (f createdTestFileInfo) CreationTime() time.Time { return f.created }
+
+func TestMachineTimes(t *testing.T) {
+	fileTime := time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC)
+	dirTime := time.Date(2017, 11, 12, 13, 14, 15, 0, time.FixedZone("EST", -5*3600))
+	formatter := ListFormatter{
+		createdTestFileInfo{testFileInfo{name: "file", size: 1, mode: 0644, modTime: fileTime}, fileTime.Add(-time.Hour)},
+		createdTestFileInfo{testFileInfo{name: "dir", mode: os.ModeDir | 0755, modTime: dirTime}, time.Time{}},
+	}
+	expected := "type=file;size=1;modify=20180304050607;create=20180304040607; file\r\n" +
+		"type=dir;size=0;modify=20171112181415; dir\r\n"
+	if result := string(formatter.Machine()); result != expected {
+		t.Errorf("got %q, want %q", result, expected)
+	}
+}
+
+func TestMachineSelected(t *testing.T) {
+	modTime := time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC)
+	formatter := ListFormatter{
+		uniqueTestFileInfo{testFileInfo{name: "file", size: 42, mode: 0644, modTime: modTime}, "801g2a"},
+	}
+	expected := "size=42;unique=801g2a; file\r\n"
+	if result := string(formatter.MachineSelected([]string{"UNIQUE", "size"})); result != expected {
+		t.Errorf("got %q, want %q", result, expected)
+	}
+	if result := string(formatter.MachineSelected(nil)); result != " file\r\n" {
+		t.Errorf("no facts: got %q", result)
+	}
+}
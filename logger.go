@@ -16,6 +16,18 @@ type Logger interface {
 	PrintResponse(sessionId string, code int, message string)
 }
 
+// LeveledLogger is an optional interface a Logger can implement to receive
+// structured entries, e.g. to pass them on to zap or zerolog. Each entry
+// has a level, a message and fields given as alternating keys and values,
+// like "session", "4f2a", "command", "RETR". The servers use it instead of
+// the methods of Logger.
+type LeveledLogger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
 // Use an instance of this to log in a standard format
 type StdLogger struct{}
 
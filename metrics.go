@@ -0,0 +1,39 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp_server
+
+import "time"
+
+// Metrics receives measurements of the server, e.g. to feed them into a
+// histogram of a monitoring system. Its methods are called concurrently by
+// all sessions.
+type Metrics interface {
+	// params  - command name in upper case, time its execution took
+	//           including data transfers
+	ObserveCommand(string, time.Duration)
+}
+
+// Directions of transfers reported to TransferMetrics.
+const (
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+)
+
+// TransferMetrics is an optional interface a Metrics can implement to
+// observe the data transfers of RETR, STOR, APPE, STOU and the chunks of
+// SITE RUPLOAD as well.
+type TransferMetrics interface {
+	// params  - TransferUpload or TransferDownload, number of bytes
+	//           transferred, time the transfer took. Failed and aborted
+	//           transfers are reported with the bytes transferred so far.
+	ObserveTransfer(string, int64, time.Duration)
+}
+
+// AuthMetrics is an optional interface a Metrics can implement to observe
+// login attempts as well.
+type AuthMetrics interface {
+	// params  - username, whether the password was accepted
+	ObserveAuth(string, bool)
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp_server
+
+import "io"
+
+var (
+	_ Driver = &SplitDriver{}
+)
+
+// SplitDriver routes reading operations to one driver and modifying
+// operations to another one. It can serve downloads from a stable snapshot
+// while uploads land in a staging area, which is promoted to the snapshot
+// outside of the server.
+//
+// Stat, ChangeDir, ListDir and GetFile are passed to Read. DeleteDir,
+// DeleteFile, Rename, MakeDir and PutFile are passed to Write. As a result
+// the server only sees the snapshot: uploaded files and created directories
+// are not listed or downloadable until they are promoted, and checks the
+// commands do with Stat before modifying, like RNFR, are done against the
+// snapshot and not the staging area. Promoting has to replace the snapshot
+// atomically, e.g. by switching a symlink, for clients to never see a
+// partially promoted state.
+type SplitDriver struct {
+	Read  Driver
+	Write Driver
+}
+
+// NewSplitDriver returns a driver reading from read and writing to write.
+func NewSplitDriver(read Driver, write Driver) *SplitDriver {
+	return &SplitDriver{Read: read, Write: write}
+}
+
+// Stat returns the file info of path in the read driver
+func (d *SplitDriver) Stat(path string) (FileInfo, error) {
+	return d.Read.Stat(path)
+}
+
+// ChangeDir checks path in the read driver
+func (d *SplitDriver) ChangeDir(path string) error {
+	return d.Read.ChangeDir(path)
+}
+
+// ListDir lists path in the read driver
+func (d *SplitDriver) ListDir(path string, callback func(FileInfo) error) error {
+	return d.Read.ListDir(path, callback)
+}
+
+// DeleteDir deletes path in the write driver
+func (d *SplitDriver) DeleteDir(path string) error {
+	return d.Write.DeleteDir(path)
+}
+
+// DeleteFile deletes path in the write driver
+func (d *SplitDriver) DeleteFile(path string) error {
+	return d.Write.DeleteFile(path)
+}
+
+// Rename renames within the write driver
+func (d *SplitDriver) Rename(fromPath string, toPath string) error {
+	return d.Write.Rename(fromPath, toPath)
+}
+
+// MakeDir creates path in the write driver
+func (d *SplitDriver) MakeDir(path string) error {
+	return d.Write.MakeDir(path)
+}
+
+// GetFile reads path from the read driver
+func (d *SplitDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	return d.Read.GetFile(path, offset)
+}
+
+// PutFile writes path to the write driver
+func (d *SplitDriver) PutFile(path string, data io.Reader, appendData bool) (int64, error) {
+	return d.Write.PutFile(path, data, appendData)
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp_server
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// recordingDriver records the names of the called methods and the paths
+// passed to them.
+type recordingDriver struct {
+	calls []string
+	paths []string
+}
+
+func (d *recordingDriver) record(call string, path string) {
+	d.calls = append(d.calls, call)
+	d.paths = append(d.paths, path)
+}
+
+func (d *recordingDriver) Stat(path string) (FileInfo, error) {
+	d.record("Stat", path)
+	return testFileInfo{name: path}, nil
+}
+
+func (d *recordingDriver) ChangeDir(path string) error {
+	d.record("ChangeDir", path)
+	return nil
+}
+
+func (d *recordingDriver) ListDir(path string, callback func(FileInfo) error) error {
+	d.record("ListDir", path)
+	return nil
+}
+
+func (d *recordingDriver) DeleteDir(path string) error {
+	d.record("DeleteDir", path)
+	return nil
+}
+
+func (d *recordingDriver) DeleteFile(path string) error {
+	d.record("DeleteFile", path)
+	return nil
+}
+
+func (d *recordingDriver) Rename(fromPath string, toPath string) error {
+	d.record("Rename", fromPath+" "+toPath)
+	return nil
+}
+
+func (d *recordingDriver) MakeDir(path string) error {
+	d.record("MakeDir", path)
+	return nil
+}
+
+func (d *recordingDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	d.record("GetFile", path)
+	return 0, ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func (d *recordingDriver) PutFile(path string, data io.Reader, appendData bool) (int64, error) {
+	d.record("PutFile", path)
+	return 0, nil
+}
+
+func TestSplitDriver(t *testing.T) {
+	read := &recordingDriver{}
+	write := &recordingDriver{}
+	driver := NewSplitDriver(read, write)
+
+	driver.Stat("/a")
+	driver.ChangeDir("/")
+	driver.ListDir("/", func(FileInfo) error { return nil })
+	driver.GetFile("/a", 0)
+	driver.DeleteDir("/d")
+	driver.DeleteFile("/a")
+	driver.Rename("/a", "/b")
+	driver.MakeDir("/d")
+	driver.PutFile("/a", strings.NewReader(""), false)
+
+	if calls := strings.Join(read.calls, ","); calls != "Stat,ChangeDir,ListDir,GetFile" {
+		t.Errorf("read driver got %s", calls)
+	}
+	if calls := strings.Join(write.calls, ","); calls != "DeleteDir,DeleteFile,Rename,MakeDir,PutFile" {
+		t.Errorf("write driver got %s", calls)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp_server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	_ Driver = &VirtualFS{}
+)
+
+// errCrossMountRename is returned when renaming from one mount to another.
+var errCrossMountRename = errors.New("Rename between different mounts not supported")
+
+// VirtualFS presents several drivers in one namespace. Each driver is
+// mounted at a path prefix, e.g. "/public", and gets the paths below it with
+// the prefix stripped, so "/public/a.txt" is passed on as "/a.txt". The
+// directories leading to the mount points, like the root, are virtual: they
+// list the mount points below them and can not be modified. A path belongs
+// to the mount with the longest matching prefix.
+type VirtualFS struct {
+	mounts map[string]Driver
+}
+
+// NewVirtualFS returns a VirtualFS without mounts.
+func NewVirtualFS() *VirtualFS {
+	return &VirtualFS{mounts: make(map[string]Driver)}
+}
+
+// Mount makes driver available at prefix.
+func (fs *VirtualFS) Mount(prefix string, driver Driver) {
+	fs.mounts[path.Clean("/"+prefix)] = driver
+}
+
+// resolve returns the driver responsible for filePath and the path within
+// it, or nil if the path is not within a mount.
+func (fs *VirtualFS) resolve(filePath string) (Driver, string) {
+	filePath = path.Clean("/" + filePath)
+	for prefix := filePath; ; prefix = path.Dir(prefix) {
+		if driver, ok := fs.mounts[prefix]; ok {
+			return driver, path.Clean("/" + strings.TrimPrefix(filePath, prefix))
+		}
+		if prefix == "/" {
+			return nil, ""
+		}
+	}
+}
+
+// virtualChildren returns the names of the entries of a virtual directory
+// and whether the directory exists.
+func (fs *VirtualFS) virtualChildren(dir string) ([]string, bool) {
+	dir = path.Clean("/" + dir)
+	names := make(map[string]bool)
+	exists := false
+	for prefix := range fs.mounts {
+		var rest string
+		if dir == "/" && prefix != "/" {
+			rest = prefix[1:]
+		} else if strings.HasPrefix(prefix, dir+"/") {
+			rest = prefix[len(dir)+1:]
+		} else {
+			continue
+		}
+		exists = true
+		names[strings.SplitN(rest, "/", 2)[0]] = true
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted, exists || dir == "/"
+}
+
+// virtualDirInfo is the FileInfo of a virtual directory.
+type virtualDirInfo struct {
+	name string
+}
+
+func (f virtualDirInfo) Name() string       { return f.name }
+func (f virtualDirInfo) Size() int64        { return 0 }
+func (f virtualDirInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (f virtualDirInfo) ModTime() time.Time { return time.Time{} }
+func (f virtualDirInfo) IsDir() bool        { return true }
+func (f virtualDirInfo) Sys() interface{}   { return nil }
+func (f virtualDirInfo) Owner() string      { return "root" }
+func (f virtualDirInfo) Group() string      { return "root" }
+
+// virtualPathError returns the error for an operation on filePath, which is
+// not within a mount.
+func (fs *VirtualFS) virtualPathError(op string, filePath string) error {
+	if _, exists := fs.virtualChildren(filePath); exists {
+		return &os.PathError{Op: op, Path: filePath, Err: os.ErrPermission}
+	}
+	return &os.PathError{Op: op, Path: filePath, Err: os.ErrNotExist}
+}
+
+// Stat returns the file info of path
+func (fs *VirtualFS) Stat(filePath string) (FileInfo, error) {
+	driver, subPath := fs.resolve(filePath)
+	if driver != nil {
+		return driver.Stat(subPath)
+	}
+	if _, exists := fs.virtualChildren(filePath); exists {
+		return virtualDirInfo{path.Base(filePath)}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: filePath, Err: os.ErrNotExist}
+}
+
+// ChangeDir checks path can be changed to
+func (fs *VirtualFS) ChangeDir(filePath string) error {
+	driver, subPath := fs.resolve(filePath)
+	if driver != nil {
+		return driver.ChangeDir(subPath)
+	}
+	if _, exists := fs.virtualChildren(filePath); exists {
+		return nil
+	}
+	return &os.PathError{Op: "chdir", Path: filePath, Err: os.ErrNotExist}
+}
+
+// ListDir lists the entries of path, for virtual directories the mount
+// points and virtual directories below them
+func (fs *VirtualFS) ListDir(filePath string, callback func(FileInfo) error) error {
+	driver, subPath := fs.resolve(filePath)
+	if driver != nil {
+		return driver.ListDir(subPath, callback)
+	}
+	names, exists := fs.virtualChildren(filePath)
+	if !exists {
+		return &os.PathError{Op: "readdir", Path: filePath, Err: os.ErrNotExist}
+	}
+	for _, name := range names {
+		if err := callback(virtualDirInfo{name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteDir deletes path
+func (fs *VirtualFS) DeleteDir(filePath string) error {
+	driver, subPath := fs.resolve(filePath)
+	if driver == nil || subPath == "/" {
+		return &os.PathError{Op: "rmdir", Path: filePath, Err: os.ErrPermission}
+	}
+	return driver.DeleteDir(subPath)
+}
+
+// DeleteFile deletes path
+func (fs *VirtualFS) DeleteFile(filePath string) error {
+	driver, subPath := fs.resolve(filePath)
+	if driver == nil {
+		return fs.virtualPathError("remove", filePath)
+	}
+	return driver.DeleteFile(subPath)
+}
+
+// Rename renames within one mount
+func (fs *VirtualFS) Rename(fromPath string, toPath string) error {
+	fromDriver, fromSubPath := fs.resolve(fromPath)
+	toDriver, toSubPath := fs.resolve(toPath)
+	if fromDriver == nil || fromSubPath == "/" {
+		return fs.virtualPathError("rename", fromPath)
+	}
+	if toDriver != fromDriver || toSubPath == "/" {
+		return errCrossMountRename
+	}
+	return fromDriver.Rename(fromSubPath, toSubPath)
+}
+
+// MakeDir creates path
+func (fs *VirtualFS) MakeDir(filePath string) error {
+	driver, subPath := fs.resolve(filePath)
+	if driver == nil || subPath == "/" {
+		return &os.PathError{Op: "mkdir", Path: filePath, Err: os.ErrPermission}
+	}
+	return driver.MakeDir(subPath)
+}
+
+// GetFile reads path
+func (fs *VirtualFS) GetFile(filePath string, offset int64) (int64, io.ReadCloser, error) {
+	driver, subPath := fs.resolve(filePath)
+	if driver == nil {
+		return 0, nil, fs.virtualPathError("open", filePath)
+	}
+	return driver.GetFile(subPath, offset)
+}
+
+// PutFile writes path
+func (fs *VirtualFS) PutFile(filePath string, data io.Reader, appendData bool) (int64, error) {
+	driver, subPath := fs.resolve(filePath)
+	if driver == nil {
+		return 0, fs.virtualPathError("open", filePath)
+	}
+	return driver.PutFile(subPath, data, appendData)
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp_server
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVirtualFS(t *testing.T) {
+	public := &recordingDriver{}
+	home := &recordingDriver{}
+	fs := NewVirtualFS()
+	fs.Mount("/public", public)
+	fs.Mount("users/me/", home)
+
+	fs.Stat("/public")
+	fs.GetFile("/public/a.txt", 0)
+	fs.PutFile("/users/me/dir/b.txt", strings.NewReader(""), false)
+	fs.Rename("/users/me/b.txt", "/users/me/c.txt")
+	fs.ListDir("/users/me", func(FileInfo) error { return nil })
+
+	if result := strings.Join(public.paths, ","); result != "/,/a.txt" {
+		t.Errorf("public got %s", result)
+	}
+	if result := strings.Join(home.paths, ","); result != "/dir/b.txt,/b.txt /c.txt,/" {
+		t.Errorf("home got %s", result)
+	}
+
+	if err := fs.Rename("/public/a.txt", "/users/me/a.txt"); err != errCrossMountRename {
+		t.Errorf("rename between mounts: %v", err)
+	}
+	if err := fs.MakeDir("/new"); !os.IsPermission(err) {
+		t.Errorf("MakeDir in the virtual root: %v", err)
+	}
+	if _, err := fs.Stat("/missing"); !os.IsNotExist(err) {
+		t.Errorf("Stat of a missing path: %v", err)
+	}
+	if info, err := fs.Stat("/users"); err != nil || !info.IsDir() {
+		t.Errorf("Stat of a virtual directory: %v", err)
+	}
+}
+
+func TestVirtualFSListRoot(t *testing.T) {
+	fs := NewVirtualFS()
+	fs.Mount("/public", &recordingDriver{})
+	fs.Mount("/users/me", &recordingDriver{})
+	fs.Mount("/users/shared", &recordingDriver{})
+
+	cases := map[string]string{
+		"/":      "public,users",
+		"/users": "me,shared",
+	}
+	for dir, expected := range cases {
+		var names []string
+		err := fs.ListDir(dir, func(f FileInfo) error {
+			if !f.IsDir() {
+				t.Errorf("%s is not a directory", f.Name())
+			}
+			names = append(names, f.Name())
+			return nil
+		})
+		if err != nil || strings.Join(names, ",") != expected {
+			t.Errorf("ListDir(%s) = %v, %v, want %s", dir, names, err, expected)
+		}
+	}
+	if err := fs.ListDir("/user", func(FileInfo) error { return nil }); !os.IsNotExist(err) {
+		t.Errorf("ListDir of a missing virtual directory: %v", err)
+	}
+}